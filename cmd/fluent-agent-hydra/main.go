@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
@@ -25,12 +26,17 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
+
 	var (
 		configFile  string
 		help        bool
 		fieldName   string
 		monitorAddr string
 		showVersion bool
+		configTest  bool
 	)
 	flag.StringVar(&configFile, "c", "", "configuration file path")
 	flag.BoolVar(&help, "h", false, "show help message")
@@ -40,6 +46,7 @@ func main() {
 	flag.StringVar(&monitorAddr, "m", "", "monitor HTTP server address")
 	flag.BoolVar(&showVersion, "v", false, "show version")
 	flag.BoolVar(&showVersion, "version", false, "show version")
+	flag.BoolVar(&configTest, "t", false, "test configuration and exit")
 	flag.Parse()
 
 	if showVersion {
@@ -78,14 +85,36 @@ func main() {
 		usage()
 	}
 
-	context := hydra.Run(config)
+	if configTest {
+		os.Exit(testConfig(configFile, config))
+	}
+
+	context, err := hydra.Run(config)
+	if err != nil {
+		log.Println("Can't start", err)
+		os.Exit(2)
+	}
 	go func() {
 		context.InputProcess.Wait()
 		sigCh <- hydra.NewSignal("all input processes terminated")
 	}()
 
 	// waiting for all input processes are terminated or got os signal
-	sig := <-sigCh
+	var sig os.Signal
+	for {
+		sig = <-sigCh
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if configFile == "" {
+			log.Println("[warning] SIGNAL", sig, "config file is not specified. ignored")
+			continue
+		}
+		log.Println("[info] SIGNAL", sig, "reloading config")
+		if err := context.ReloadConfigFile(); err != nil {
+			log.Println("[error] Can't reload config", err)
+		}
+	}
 
 	log.Println("[info] SIGNAL", sig, "shutting down")
 	pprof.StopCPUProfile()
@@ -104,11 +133,78 @@ func main() {
 	os.Exit(0)
 }
 
+func testConfig(configFile string, config *hydra.Config) int {
+	if configFile == "" {
+		configFile = "(command line arguments)"
+	}
+	errs := config.Validate()
+	for _, err := range errs {
+		fmt.Printf("%s: %s\n", configFile, err)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%s: %d problems found\n", configFile, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: syntax is ok\n", configFile)
+	return 0
+}
+
+func replay(args []string) int {
+	var (
+		configFile string
+		servers    string
+		option     hydra.ReplayOption
+	)
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", "", "configuration file path (servers and routes are used)")
+	fs.StringVar(&servers, "s", "", "comma separated servers to send records (instead of -c)")
+	fs.IntVar(&option.Rate, "rate", 0, "max records per second (DEFAULT: unlimited)")
+	fs.DurationVar(&option.ProgressInterval, "progress", 10*time.Second, "interval of progress reports")
+	fs.DurationVar(&option.Timeout, "timeout", 5*time.Minute, "give up when no records are sent for the duration. 0 waits forever")
+	fs.Usage = func() {
+		fmt.Println("Usage of fluent-agent-hydra replay")
+		fmt.Println("")
+		fmt.Println("  fluent-agent-hydra replay -c config.toml [options] FILE...")
+		fmt.Println("  fluent-agent-hydra replay -s HOST:PORT[,HOST:PORT...] [options] FILE...")
+		fmt.Println("")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var config *hydra.Config
+	switch {
+	case configFile != "":
+		var err error
+		config, err = hydra.ReadConfig(configFile)
+		if err != nil {
+			log.Println("Can't load config", err)
+			return 2
+		}
+	case servers != "":
+		config = &hydra.Config{Servers: hydra.NewConfigServers(strings.Split(servers, ","))}
+		config.Restrict()
+	default:
+		fs.Usage()
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+	if err := hydra.Replay(config, fs.Args(), option); err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	return 0
+}
+
 func usage() {
 	fmt.Println("Usage of fluent-agent-hydra")
 	fmt.Println("")
 	fmt.Println("  fluent-agent-hydra -c config.toml")
+	fmt.Println("  fluent-agent-hydra -t -c config.toml")
 	fmt.Println("  fluent-agent-hydra [options] TAG TARGET_FILE PRIMARY_SERVER SECONDARY_SERVER")
+	fmt.Println("  fluent-agent-hydra replay [options] FILE...")
 	fmt.Println("")
 	flag.PrintDefaults()
 	os.Exit(1)
@@ -21,6 +21,9 @@ limitations under the License.
 package fluent
 
 import (
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
@@ -30,6 +33,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/ugorji/go/codec"
 )
 
 const (
@@ -42,10 +47,27 @@ const (
 )
 
 type Config struct {
-	Server    string
-	Timeout   time.Duration
-	RetryWait int
-	MaxRetry  int
+	Server         string
+	Timeout        time.Duration // timeout of writes
+	ConnectTimeout time.Duration // Timeout if zero
+	RetryWait      int           // milliseconds to wait before the first reconnect
+	MaxRetry       int           // number of times the wait grows by defaultReconnectWaitIncreRate
+	RetryWaitMax   time.Duration // cap of the wait. no cap if zero
+	RetryJitter    float64       // randomizes the wait by +-RetryJitter (0.0 - 1.0)
+	TLSConfig      *tls.Config   // connect with TLS if not nil
+
+	// The connection is refreshed after ReconnectAfterSends sends, or ReconnectInterval passed since connected.
+	ReconnectAfterSends int64
+	ReconnectInterval   time.Duration
+
+	// KeepAlive is the period of TCP keepalive. Negative disables it (see net.Dialer).
+	KeepAlive time.Duration
+
+	// SharedKey enables the handshake of forward protocol (HELO, PING and PONG) after connected.
+	SharedKey    string
+	SelfHostname string // os.Hostname() if empty
+	Username     string
+	Password     string
 }
 
 type Fluent struct {
@@ -58,6 +80,8 @@ type Fluent struct {
 	lastError       error
 	lastErrorAt     time.Time
 	Sent            int64
+	connectedAt     time.Time
+	sentOnConn      int64
 }
 
 var Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -70,12 +94,22 @@ func New(config Config) (f *Fluent, err error) {
 	if config.Timeout == 0 {
 		config.Timeout = defaultTimeout
 	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = config.Timeout
+	}
 	if config.RetryWait == 0 {
 		config.RetryWait = defaultRetryWait
 	}
 	if config.MaxRetry == 0 {
 		config.MaxRetry = defaultMaxRetry
 	}
+	if config.TLSConfig != nil && config.TLSConfig.ServerName == "" {
+		// verify the certificate by the host name, not by the resolved address
+		if host, _, err := net.SplitHostPort(config.Server); err == nil {
+			config.TLSConfig = config.TLSConfig.Clone()
+			config.TLSConfig.ServerName = host
+		}
+	}
 	f = &Fluent{
 		Config:          config,
 		reconnecting:    false,
@@ -151,11 +185,47 @@ func (f *Fluent) connect() (err error) {
 	}
 	resolved := fmt.Sprintf(format, addr, port)
 	log.Printf("[info] Connect to %s (%s)", f.Server, resolved)
-	f.conn, err = net.DialTimeout("tcp", resolved, f.Config.Timeout)
+	conn, err := f.dial(resolved, f.Config.ConnectTimeout)
+	if err == nil {
+		f.conn = conn
+		f.connectedAt = time.Now()
+		f.sentOnConn = 0
+	} else {
+		f.conn = nil
+	}
 	f.recordError(err)
 	return
 }
 
+// dial connects to addr by TLS if enabled, and authenticates the connection by SharedKey.
+func (f *Fluent) dial(addr string, timeout time.Duration) (conn net.Conn, err error) {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: f.Config.KeepAlive,
+	}
+	if f.Config.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, f.Config.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err == nil && f.Config.SharedKey != "" {
+		if err = f.clientHandshake(conn); err != nil {
+			conn.Close()
+		}
+	}
+	return
+}
+
+// Heartbeat connects to the server and closes the connection immediately.
+// TLS and SharedKey handshakes are done as same as connections for sending, so the server doesn't see failed handshakes.
+func (f *Fluent) Heartbeat(timeout time.Duration) error {
+	conn, err := f.dial(f.Server, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func (f *Fluent) recordError(err error) {
 	f.lastErrorAt = time.Now()
 	f.lastError = err
@@ -175,9 +245,8 @@ func (f *Fluent) reconnect() {
 		} else {
 			log.Println("[warning]", err)
 		}
-		waitN := math.Min(float64(i), float64(f.Config.MaxRetry))
-		waitTime := f.Config.RetryWait * e(defaultReconnectWaitIncreRate, waitN)
-		log.Printf("[info] Waiting %.1f sec to reconnect %s", float64(waitTime)/float64(1000), f.Server)
+		waitTime := f.backoff(i)
+		log.Printf("[info] Waiting %.1f sec to reconnect %s", waitTime.Seconds(), f.Server)
 
 		select { // wait for timeout or cancel
 		case _, ok := <-f.cancelReconnect:
@@ -188,11 +257,38 @@ func (f *Fluent) reconnect() {
 				log.Println("[info] Accept cancel reconnect")
 				return
 			}
-		case <-time.After(time.Duration(waitTime) * time.Millisecond):
+		case <-time.After(waitTime):
 		}
 	}
 }
 
+// backoff returns the wait before the i-th reconnect.
+func (f *Fluent) backoff(i int) time.Duration {
+	waitN := math.Min(float64(i), float64(f.Config.MaxRetry))
+	wait := time.Duration(f.Config.RetryWait*e(defaultReconnectWaitIncreRate, waitN)) * time.Millisecond
+	if f.Config.RetryWaitMax > 0 && wait > f.Config.RetryWaitMax {
+		wait = f.Config.RetryWaitMax
+	}
+	if f.Config.RetryJitter > 0 {
+		wait = time.Duration(float64(wait) * (1 + f.Config.RetryJitter*(2*rand.Float64()-1)))
+	}
+	return wait
+}
+
+// Expired returns true if the connection should be refreshed by ReconnectAfterSends or ReconnectInterval.
+func (f *Fluent) Expired() bool {
+	if f.conn == nil {
+		return false
+	}
+	if f.Config.ReconnectAfterSends > 0 && f.sentOnConn >= f.Config.ReconnectAfterSends {
+		return true
+	}
+	if f.Config.ReconnectInterval > 0 && time.Since(f.connectedAt) >= f.Config.ReconnectInterval {
+		return true
+	}
+	return false
+}
+
 func (f *Fluent) RefreshConnection() error {
 	f.Close()
 	if err := f.connect(); err != nil {
@@ -221,10 +317,61 @@ func (f *Fluent) Send(buffer []byte) (err error) {
 			f.Close()
 		}
 		f.Sent++
+		f.sentOnConn++
 	}
 	return
 }
 
+// AckError is returned by SendWithAck when the server didn't respond the ack for the chunk.
+type AckError struct {
+	Chunk string
+	Err   error
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("ack response for chunk %s: %s", e.Chunk, e.Err)
+}
+
+// NewChunkID generates a unique chunk ID for the chunk option of forward protocol.
+func NewChunkID() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// SendWithAck sends buffer packed with the chunk option, and waits for the ack response from the server until timeout.
+// When the ack couldn't be received, the connection is closed because the state of the stream is unknown.
+func (f *Fluent) SendWithAck(buffer []byte, chunk string, timeout time.Duration) error {
+	if err := f.Send(buffer); err != nil {
+		return err
+	}
+	conn := f.conn
+	if conn == nil {
+		return &AckError{Chunk: chunk, Err: errors.New("connection closed")}
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var res map[string]interface{}
+	err := codec.NewDecoder(conn, &mh).Decode(&res)
+	if err == nil {
+		if ack := toString(res["ack"]); ack != chunk {
+			err = fmt.Errorf("unexpected ack %s", ack)
+		}
+	}
+	if err != nil {
+		err = &AckError{Chunk: chunk, Err: err}
+		f.recordError(err)
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// WriteAck writes the ack response for the chunk.
+func WriteAck(conn net.Conn, chunk string) error {
+	return writeMsgpack(conn, map[string]interface{}{"ack": chunk})
+}
+
 func (f *Fluent) LastErrorString() string {
 	if f.lastError != nil {
 		return fmt.Sprintf("[%s] %s", f.lastErrorAt, f.lastError)
@@ -57,3 +57,83 @@ func startDummyServer(host string) string {
 	}()
 	return <-ch
 }
+
+func TestExpired(t *testing.T) {
+	port := startDummyServer("127.0.0.1")
+	f, err := fluent.New(fluent.Config{
+		Server:              "127.0.0.1:" + port,
+		ReconnectAfterSends: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Send([]byte{})
+	if f.Expired() {
+		t.Error("must not be expired after 1 send")
+	}
+	f.Send([]byte{})
+	if !f.Expired() {
+		t.Error("must be expired after 2 sends")
+	}
+	if err := f.RefreshConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Expired() {
+		t.Error("must not be expired after refreshed")
+	}
+
+	g, err := fluent.New(fluent.Config{
+		Server:            "127.0.0.1:" + port,
+		ReconnectInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if g.Expired() {
+		t.Error("must not be expired just after connected")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !g.Expired() {
+		t.Error("must be expired after ReconnectInterval")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	auth := &fluent.ServerAuth{SharedKey: "secret", SelfHostname: "aggregator"}
+	errCh := make(chan error, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			errCh <- fluent.ServerHandshake(conn, auth, time.Second)
+			conn.Close()
+		}
+	}()
+
+	f := &fluent.Fluent{Config: fluent.Config{
+		Server:    l.Addr().String(),
+		Timeout:   time.Second,
+		SharedKey: "secret",
+	}}
+	if err := f.Heartbeat(time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Error("heartbeat must pass the handshake", err)
+	}
+
+	f.SharedKey = "wrong"
+	if err := f.Heartbeat(time.Second); err == nil {
+		t.Error("heartbeat with a wrong shared key must fail")
+	}
+	<-errCh
+}
@@ -0,0 +1,167 @@
+package fluent
+
+import (
+	crand "crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// ServerAuth is the authentication config of the server side of the forward protocol handshake.
+type ServerAuth struct {
+	SharedKey    string
+	SelfHostname string
+	Users        map[string]string // username => password. user authentication is required if not empty
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	crand.Read(b)
+	return b
+}
+
+func sha512Hex(values ...string) string {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestEqual compares digests in constant time not to leak them by timing.
+func digestEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func selfHostname(name string) string {
+	if name != "" {
+		return name
+	}
+	name, _ = os.Hostname()
+	return name
+}
+
+func readMessage(conn net.Conn, timeout time.Duration) ([]interface{}, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var v []interface{}
+	if err := codec.NewDecoder(conn, &mh).Decode(&v); err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, errors.New("empty message")
+	}
+	return v, nil
+}
+
+func writeMessage(conn net.Conn, timeout time.Duration, v ...interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return writeMsgpack(conn, v)
+}
+
+// clientHandshake authenticates the connection by HELO, PING and PONG messages.
+func (f *Fluent) clientHandshake(conn net.Conn) error {
+	timeout := f.Config.Timeout
+	helo, err := readMessage(conn, timeout)
+	if err != nil {
+		return fmt.Errorf("handshake with %s: %s", f.Server, err)
+	}
+	if len(helo) < 2 || toString(helo[0]) != "HELO" {
+		return fmt.Errorf("handshake with %s: HELO expected", f.Server)
+	}
+	options, _ := helo[1].(map[string]interface{})
+	nonce := toString(options["nonce"])
+	authSalt := toString(options["auth"])
+
+	hostname := selfHostname(f.Config.SelfHostname)
+	sharedKeySalt := string(randomBytes(16))
+	var password string
+	if authSalt != "" {
+		password = sha512Hex(authSalt, f.Config.Username, f.Config.Password)
+	}
+	err = writeMessage(conn, timeout,
+		"PING",
+		hostname,
+		sharedKeySalt,
+		sha512Hex(sharedKeySalt, hostname, nonce, f.Config.SharedKey),
+		f.Config.Username,
+		password,
+	)
+	if err != nil {
+		return fmt.Errorf("handshake with %s: %s", f.Server, err)
+	}
+
+	pong, err := readMessage(conn, timeout)
+	if err != nil {
+		return fmt.Errorf("handshake with %s: %s", f.Server, err)
+	}
+	if len(pong) < 5 || toString(pong[0]) != "PONG" {
+		return fmt.Errorf("handshake with %s: PONG expected", f.Server)
+	}
+	if ok, _ := pong[1].(bool); !ok {
+		return fmt.Errorf("handshake with %s: authentication failed: %s", f.Server, toString(pong[2]))
+	}
+	serverHostname := toString(pong[3])
+	if !digestEqual(toString(pong[4]), sha512Hex(sharedKeySalt, serverHostname, nonce, f.Config.SharedKey)) {
+		return fmt.Errorf("handshake with %s: shared key mismatch", f.Server)
+	}
+	return nil
+}
+
+// ServerHandshake authenticates the client connection by HELO, PING and PONG messages.
+func ServerHandshake(conn net.Conn, auth *ServerAuth, timeout time.Duration) error {
+	nonce := string(randomBytes(16))
+	var authSalt string
+	if len(auth.Users) > 0 {
+		authSalt = string(randomBytes(16))
+	}
+	err := writeMessage(conn, timeout, "HELO", map[string]interface{}{
+		"nonce":     []byte(nonce),
+		"auth":      []byte(authSalt),
+		"keepalive": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	ping, err := readMessage(conn, timeout)
+	if err != nil {
+		return err
+	}
+	if len(ping) < 6 || toString(ping[0]) != "PING" {
+		return errors.New("PING expected")
+	}
+	clientHostname := toString(ping[1])
+	sharedKeySalt := toString(ping[2])
+	hostname := selfHostname(auth.SelfHostname)
+
+	reason := ""
+	if !digestEqual(toString(ping[3]), sha512Hex(sharedKeySalt, clientHostname, nonce, auth.SharedKey)) {
+		reason = "shared_key mismatch"
+	} else if authSalt != "" {
+		username := toString(ping[4])
+		password, ok := auth.Users[username]
+		if !ok || !digestEqual(toString(ping[5]), sha512Hex(authSalt, username, password)) {
+			reason = "username/password mismatch"
+		}
+	}
+	if reason != "" {
+		writeMessage(conn, timeout, "PONG", false, reason, "", "")
+		return fmt.Errorf("authentication failed from %s (%s): %s", clientHostname, conn.RemoteAddr(), reason)
+	}
+	return writeMessage(conn, timeout,
+		"PONG",
+		true,
+		"",
+		hostname,
+		sha512Hex(sharedKeySalt, hostname, nonce, auth.SharedKey),
+	)
+}
@@ -20,6 +20,7 @@ const (
 	mpStr16              = 0xda
 	mpStr32              = 0xdb
 	mp2ElmArray          = 0x92
+	mp3ElmArray          = 0x93
 	mp1ElmMap            = 0x81
 	mpBytes8             = 0xc4
 	mpBytes16            = 0xc5
@@ -128,16 +129,29 @@ func toMsgpackRecord(ts time.Time, data map[string]interface{}) ([]byte, error)
 }
 
 func toMsgpackRecordSet(tag string, bin []byte) []byte {
+	return toMsgpackRecordSetWithOption(tag, bin, nil)
+}
+
+// toMsgpackRecordSetWithOption packs [tag, bin, option]. If option is nil, [tag, bin] is packed.
+func toMsgpackRecordSetWithOption(tag string, bin []byte, option map[string]interface{}) []byte {
 	b := new(msgpackBuffer)
 	// required capacity
-	b.Grow(len(tag) + len(bin) + 16)
-	// 2 elments array [tag, bin]
-	b.WriteByte(mp2ElmArray)
+	b.Grow(len(tag) + len(bin) + 64)
+	if option == nil {
+		// 2 elments array [tag, bin]
+		b.WriteByte(mp2ElmArray)
+	} else {
+		// 3 elments array [tag, bin, option]
+		b.WriteByte(mp3ElmArray)
+	}
 	// tag
 	b.WriteMpStringHead(len(tag))
 	b.WriteString(tag)
 	// buf
 	b.WriteMpStringHead(len(bin))
 	b.Write(bin)
+	if option != nil {
+		writeMsgpack(b, option)
+	}
 	return b.Bytes()
 }
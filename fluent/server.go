@@ -26,12 +26,13 @@ package fluent
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -162,6 +163,105 @@ func (rs *FluentRecordSet) PackAsPackedForward() ([]byte, error) {
 	return toMsgpackRecordSet(rs.Tag, buffer), nil
 }
 
+// Copy returns a deep copy of rs, which can be modified without affecting rs.
+func (rs *FluentRecordSet) Copy() *FluentRecordSet {
+	records := make([]FluentRecordType, len(rs.Records))
+	for i, record := range rs.Records {
+		switch r := record.(type) {
+		case *TinyFluentRecord:
+			records[i] = &TinyFluentRecord{Timestamp: r.Timestamp, Data: copyMap(r.Data)}
+		case *TinyFluentMessage:
+			records[i] = &TinyFluentMessage{Timestamp: r.Timestamp, FieldName: r.FieldName, Message: copyBytes(r.Message)}
+		case *FluentRecord:
+			records[i] = &FluentRecord{Tag: r.Tag, Timestamp: r.Timestamp, Data: copyMap(r.Data)}
+		default:
+			records[i] = record
+		}
+	}
+	return &FluentRecordSet{Tag: rs.Tag, Records: records}
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		c[key] = copyValue(value)
+	}
+	return c
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyMap(v)
+	case map[interface{}]interface{}:
+		c := make(map[interface{}]interface{}, len(v))
+		for key, value := range v {
+			c[key] = copyValue(value)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, value := range v {
+			c[i] = copyValue(value)
+		}
+		return c
+	case []byte:
+		return copyBytes(v)
+	default:
+		return v
+	}
+}
+
+// PackAsPackedForwardWithChunk packs rs with the chunk option to require an ack response from servers.
+func (rs *FluentRecordSet) PackAsPackedForwardWithChunk(chunk string) ([]byte, error) {
+	return rs.PackAsPackedForwardWithOption(Option{Chunk: chunk})
+}
+
+// PackAsPackedForwardWithOption packs rs with option.
+// If option.Compressed is "gzip", entries are packed as CompressedPackedForward mode.
+func (rs *FluentRecordSet) PackAsPackedForwardWithOption(option Option) ([]byte, error) {
+	buffer := make([]byte, 0)
+	for _, record := range rs.Records {
+		data, err := record.Pack()
+		if err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, data...)
+	}
+	m := make(map[string]interface{}, 2)
+	if option.Chunk != "" {
+		m["chunk"] = option.Chunk
+	}
+	switch option.Compressed {
+	case "":
+	case CompressionGzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write(buffer)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		buffer = b.Bytes()
+		m["compressed"] = CompressionGzip
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", option.Compressed)
+	}
+	if len(m) == 0 {
+		return toMsgpackRecordSet(rs.Tag, buffer), nil
+	}
+	return toMsgpackRecordSetWithOption(rs.Tag, buffer, m), nil
+}
+
 func (rs *FluentRecordSet) PackAsForward() ([]byte, error) {
 	records := make([]interface{}, len(rs.Records))
 	var err error
@@ -202,6 +302,21 @@ func coerceInPlace(data map[string]interface{}) {
 			data[k] = string(v_) // XXX: byte => rune
 		case map[string]interface{}:
 			coerceInPlace(v_)
+		case []interface{}:
+			coerceSliceInPlace(v_)
+		}
+	}
+}
+
+func coerceSliceInPlace(data []interface{}) {
+	for i, v := range data {
+		switch v_ := v.(type) {
+		case []byte:
+			data[i] = string(v_)
+		case map[string]interface{}:
+			coerceInPlace(v_)
+		case []interface{}:
+			coerceSliceInPlace(v_)
 		}
 	}
 }
@@ -240,25 +355,71 @@ func decodeRecordSet(tag []byte, entries []interface{}) (FluentRecordSet, error)
 	}, nil
 }
 
-func DecodeEntries(conn net.Conn) ([]FluentRecordSet, error) {
+// CompressionGzip is the value of "compressed" option for CompressedPackedForward mode.
+const CompressionGzip = "gzip"
+
+// Option is the option of forward protocol.
+type Option struct {
+	Chunk      string
+	Compressed string
+}
+
+func decodeOption(v interface{}) Option {
+	var option Option
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return option
+	}
+	option.Chunk = toString(m["chunk"])
+	option.Compressed = toString(m["compressed"])
+	return option
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func DecodeEntries(conn io.Reader) ([]FluentRecordSet, error) {
+	recordSets, _, err := DecodeEntriesWithOption(conn)
+	return recordSets, err
+}
+
+// DecodeEntriesWithOption works like DecodeEntries, and also returns the option sent with entries.
+func DecodeEntriesWithOption(conn io.Reader) ([]FluentRecordSet, Option, error) {
+	var option Option
 	dec := codec.NewDecoder(conn, &mh)
 	v := []interface{}{nil, nil, nil}
 	err := dec.Decode(&v)
 	if err != nil {
-		return nil, err
+		return nil, option, err
+	}
+	if len(v) < 2 {
+		return nil, option, errors.New("Unexpected payload format")
 	}
 	tag, ok := v[0].([]byte)
 	if !ok {
-		return nil, errors.New("Failed to decode tag field")
+		return nil, option, errors.New("Failed to decode tag field")
 	}
 
 	var retval []FluentRecordSet
 	switch timestamp_or_entries := v[1].(type) {
 	case int, uint, int64, uint64, int32, uint32, float32, float64:
 		timestamp := toInt64(timestamp_or_entries)
+		if len(v) > 3 {
+			option = decodeOption(v[3])
+		}
+		if len(v) < 3 {
+			return nil, option, errors.New("Failed to decode data field")
+		}
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New("Failed to decode data field")
+			return nil, option, errors.New("Failed to decode data field")
 		}
 		coerceInPlace(data)
 		retval = []FluentRecordSet{
@@ -274,9 +435,15 @@ func DecodeEntries(conn net.Conn) ([]FluentRecordSet, error) {
 		}
 	case time.Time:
 		timestamp := timestamp_or_entries
+		if len(v) > 3 {
+			option = decodeOption(v[3])
+		}
+		if len(v) < 3 {
+			return nil, option, errors.New("Failed to decode data field")
+		}
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New("Failed to decode data field")
+			return nil, option, errors.New("Failed to decode data field")
 		}
 		coerceInPlace(data)
 		retval = []FluentRecordSet{
@@ -292,14 +459,31 @@ func DecodeEntries(conn net.Conn) ([]FluentRecordSet, error) {
 		}
 	case []interface{}: // Forward
 		if !ok {
-			return nil, errors.New("Unexpected payload format")
+			return nil, option, errors.New("Unexpected payload format")
+		}
+		if len(v) > 2 {
+			option = decodeOption(v[2])
 		}
 		recordSet, err := decodeRecordSet(tag, timestamp_or_entries)
 		if err != nil {
-			return nil, err
+			return nil, option, err
 		}
 		retval = []FluentRecordSet{recordSet}
 	case []byte: // PackedForward
+		if len(v) > 2 {
+			option = decodeOption(v[2])
+		}
+		switch option.Compressed {
+		case "":
+		case CompressionGzip: // CompressedPackedForward
+			decompressed, err := gunzip(timestamp_or_entries)
+			if err != nil {
+				return nil, option, err
+			}
+			timestamp_or_entries = decompressed
+		default:
+			return nil, option, fmt.Errorf("Unsupported compression %s", option.Compressed)
+		}
 		reader := bytes.NewReader(timestamp_or_entries)
 		entries := make([]interface{}, 0)
 		for {
@@ -308,19 +492,19 @@ func DecodeEntries(conn net.Conn) ([]FluentRecordSet, error) {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				return nil, errors.New("Unexpected payload format")
+				return nil, option, errors.New("Unexpected payload format")
 			}
 			entries = append(entries, entry)
 		}
 		recordSet, err := decodeRecordSet(tag, entries)
 		if err != nil {
-			return nil, err
+			return nil, option, err
 		}
 		retval = []FluentRecordSet{recordSet}
 	default:
-		return nil, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
+		return nil, option, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
 	}
-	return retval, nil
+	return retval, option, nil
 }
 
 func toInt64(v interface{}) int64 {
@@ -344,3 +528,13 @@ func toInt64(v interface{}) int64 {
 	}
 	return 0
 }
+
+// gunzip decompresses b. Concatenated gzip members are decompressed as a stream.
+func gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -1,6 +1,8 @@
 package fluent_test
 
 import (
+	"bytes"
+	"net"
 	"testing"
 	"time"
 
@@ -25,3 +27,144 @@ func TestPack(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCopy(t *testing.T) {
+	rs := &fluent.FluentRecordSet{
+		Tag: "test",
+		Records: []fluent.FluentRecordType{
+			&fluent.TinyFluentRecord{
+				Data: map[string]interface{}{
+					"message": []byte("text"),
+					"nested":  map[string]interface{}{"key": "value"},
+				},
+			},
+			&fluent.TinyFluentMessage{FieldName: "message", Message: []byte("text")},
+		},
+	}
+	c := rs.Copy()
+	data := c.Records[0].GetAllData()
+	data["message"].([]byte)[0] = 'T'
+	data["nested"].(map[string]interface{})["key"] = "modified"
+	c.Records[1].(*fluent.TinyFluentMessage).Message[0] = 'T'
+
+	if v, _ := rs.Records[0].GetData("message"); string(v.([]byte)) != "text" {
+		t.Errorf("bytes must be copied. got %s", v)
+	}
+	if v, _ := rs.Records[0].GetData("nested"); v.(map[string]interface{})["key"] != "value" {
+		t.Errorf("nested map must be copied. got %v", v)
+	}
+	if v, _ := rs.Records[1].GetData("message"); string(v.([]byte)) != "text" {
+		t.Errorf("message must be copied. got %s", v)
+	}
+}
+
+func TestDecodeEntriesWithOption(t *testing.T) {
+	rs := &fluent.FluentRecordSet{
+		Tag: "test",
+		Records: []fluent.FluentRecordType{
+			&fluent.TinyFluentRecord{
+				Timestamp: time.Now(),
+				Data:      map[string]interface{}{"message": "text"},
+			},
+		},
+	}
+	chunk := fluent.NewChunkID()
+	packed, err := rs.PackAsPackedForwardWithChunk(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write(packed)
+
+	recordSets, option, err := fluent.DecodeEntriesWithOption(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordSets) != 1 || recordSets[0].Tag != "test" || len(recordSets[0].Records) != 1 {
+		t.Errorf("unexpected record sets %#v", recordSets)
+	}
+	if option.Chunk != chunk {
+		t.Errorf("chunk %s expected %s", option.Chunk, chunk)
+	}
+}
+
+func TestDecodeCompressedPackedForward(t *testing.T) {
+	rs := &fluent.FluentRecordSet{Tag: "test"}
+	for i := 0; i < 100; i++ {
+		rs.Records = append(rs.Records, &fluent.TinyFluentRecord{
+			Timestamp: time.Now(),
+			Data:      map[string]interface{}{"message": "compressible text compressible text"},
+		})
+	}
+	plain, err := rs.PackAsPackedForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed, err := rs.PackAsPackedForwardWithOption(fluent.Option{Compressed: fluent.CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed) >= len(plain) {
+		t.Errorf("compressed %d bytes is not smaller than %d bytes", len(packed), len(plain))
+	}
+
+	recordSets, option, err := fluent.DecodeEntriesWithOption(bytes.NewReader(packed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if option.Compressed != fluent.CompressionGzip {
+		t.Errorf("compressed option %s expected gzip", option.Compressed)
+	}
+	if len(recordSets) != 1 || len(recordSets[0].Records) != len(rs.Records) {
+		t.Fatalf("unexpected record sets %#v", recordSets)
+	}
+	if v, _ := recordSets[0].Records[0].GetData("message"); v != "compressible text compressible text" {
+		t.Errorf("unexpected message %v", v)
+	}
+
+	if _, err := rs.PackAsPackedForwardWithOption(fluent.Option{Compressed: "lz4"}); err == nil {
+		t.Error("unsupported compression must be an error")
+	}
+}
+
+func TestDecodeNestedBytes(t *testing.T) {
+	rs := &fluent.FluentRecordSet{
+		Tag: "test",
+		Records: []fluent.FluentRecordType{
+			&fluent.TinyFluentRecord{
+				Timestamp: time.Now(),
+				Data: map[string]interface{}{
+					"message": []byte("text"),
+					"list": []interface{}{
+						[]byte("item"),
+						map[string]interface{}{"key": []byte("value")},
+						[]interface{}{[]byte("nested")},
+					},
+				},
+			},
+		},
+	}
+	packed, err := rs.PackAsPackedForward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSets, _, err := fluent.DecodeEntriesWithOption(bytes.NewReader(packed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := recordSets[0].Records[0].GetAllData()
+	if v, ok := data["message"].(string); !ok || v != "text" {
+		t.Errorf("message must be decoded as string. got %#v", data["message"])
+	}
+	list := data["list"].([]interface{})
+	if v, ok := list[0].(string); !ok || v != "item" {
+		t.Errorf("item in array must be decoded as string. got %#v", list[0])
+	}
+	if v, ok := list[1].(map[string]interface{})["key"].(string); !ok || v != "value" {
+		t.Errorf("value of map in array must be decoded as string. got %#v", list[1])
+	}
+	if v, ok := list[2].([]interface{})[0].(string); !ok || v != "nested" {
+		t.Errorf("item in nested array must be decoded as string. got %#v", list[2])
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
 	github.com/fsnotify/fsnotify v1.4.7 // indirect
 	github.com/fukata/golang-stats-api-handler v1.0.0
+	github.com/golang/snappy v0.0.4
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/mattn/go-scan v0.0.0-20161028081550-c32d62d79baf
 	github.com/philhofer/fwd v1.0.0 // indirect
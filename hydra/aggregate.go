@@ -0,0 +1,218 @@
+package hydra
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	DefaultAggregateMatch    = "**"
+	DefaultAggregateInterval = 60 * time.Second
+	AggregateCountKey        = "count"
+	AggregateSumKey          = "sum"
+	AggregateMinKey          = "min"
+	AggregateMaxKey          = "max"
+	AggregateIntervalKey     = "interval"
+)
+
+// Aggregator is a Filter which groups records by fields over a time window,
+// and emits summary records at the end of the window.
+type Aggregator struct {
+	matcher     *TagMatcher
+	tag         string
+	groupBy     []string
+	field       string
+	percentiles []float64
+	interval    time.Duration
+	dropRecords bool
+
+	windowStart time.Time
+	groups      map[string]*aggregateGroup
+	order       []string
+}
+
+type aggregateGroup struct {
+	keys   map[string]interface{}
+	count  int64
+	values []float64
+}
+
+func NewAggregator(config *ConfigAggregation) (*Aggregator, error) {
+	matcher, err := NewTagMatcher(config.Match)
+	if err != nil {
+		return nil, err
+	}
+	if config.Tag == "" {
+		return nil, fmt.Errorf("aggregation for %s requires Tag", matcher)
+	}
+	for _, p := range config.Percentiles {
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("aggregation for %s: invalid percentile %g", matcher, p)
+		}
+		if config.Field == "" {
+			return nil, fmt.Errorf("aggregation for %s: Percentiles requires Field", matcher)
+		}
+	}
+	a := &Aggregator{
+		matcher:     matcher,
+		tag:         config.Tag,
+		groupBy:     config.GroupBy,
+		field:       config.Field,
+		percentiles: config.Percentiles,
+		interval:    config.Interval.Duration,
+		dropRecords: config.DropRecords,
+	}
+	a.reset(time.Now())
+	return a, nil
+}
+
+func (a *Aggregator) reset(now time.Time) {
+	a.windowStart = now.Truncate(a.interval)
+	a.groups = make(map[string]*aggregateGroup)
+	a.order = a.order[:0]
+}
+
+func (a *Aggregator) Filter(rs *fluent.FluentRecordSet) *fluent.FluentRecordSet {
+	if !a.matcher.Match(rs.Tag) {
+		return rs
+	}
+	for _, record := range rs.Records {
+		a.add(record)
+	}
+	if a.dropRecords {
+		return nil
+	}
+	return rs
+}
+
+func (a *Aggregator) add(record fluent.FluentRecordType) {
+	keys := make(map[string]interface{}, len(a.groupBy))
+	values := make([]string, len(a.groupBy))
+	for i, name := range a.groupBy {
+		if v, ok := record.GetData(name); ok {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			keys[name] = v
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	key := strings.Join(values, "\x00")
+	g, ok := a.groups[key]
+	if !ok {
+		g = &aggregateGroup{keys: keys}
+		a.groups[key] = g
+		a.order = append(a.order, key)
+	}
+	g.count++
+	if a.field == "" {
+		return
+	}
+	if v, ok := record.GetData(a.field); ok {
+		if f, ok := toFloat64(v); ok {
+			g.values = append(g.values, f)
+		}
+	}
+}
+
+// Flush returns summary records when the window was ended at now. If force is true, the current window is flushed anyway.
+func (a *Aggregator) Flush(now time.Time, force bool) []*fluent.FluentRecordSet {
+	if !force && now.Before(a.windowStart.Add(a.interval)) {
+		return nil
+	}
+	defer a.reset(now)
+	if len(a.groups) == 0 {
+		return nil
+	}
+	records := make([]fluent.FluentRecordType, 0, len(a.groups))
+	for _, key := range a.order {
+		records = append(records, a.summarize(a.groups[key]))
+	}
+	return []*fluent.FluentRecordSet{
+		{
+			Tag:     a.tag,
+			Records: records,
+		},
+	}
+}
+
+func (a *Aggregator) summarize(g *aggregateGroup) *fluent.TinyFluentRecord {
+	data := make(map[string]interface{}, len(g.keys)+5+len(a.percentiles))
+	for k, v := range g.keys {
+		data[k] = v
+	}
+	data[AggregateCountKey] = g.count
+	data[AggregateIntervalKey] = a.interval.Seconds()
+	if len(g.values) > 0 {
+		sort.Float64s(g.values)
+		sum := float64(0)
+		for _, v := range g.values {
+			sum += v
+		}
+		data[AggregateSumKey] = sum
+		data[AggregateMinKey] = g.values[0]
+		data[AggregateMaxKey] = g.values[len(g.values)-1]
+		for _, p := range a.percentiles {
+			data[percentileKey(p)] = percentile(g.values, p)
+		}
+	}
+	return &fluent.TinyFluentRecord{
+		Timestamp: a.windowStart,
+		Data:      data,
+	}
+}
+
+func percentileKey(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int, int32, int64, uint, uint32, uint64:
+		return float64(toInt64(v)), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	}
+	return 0
+}
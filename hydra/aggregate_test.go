@@ -0,0 +1,96 @@
+package hydra_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func newAggregator(t *testing.T, config *hydra.ConfigAggregation) *hydra.Aggregator {
+	config.Restrict(&hydra.Config{})
+	a, err := hydra.NewAggregator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator(t, &hydra.ConfigAggregation{
+		Match:       "access",
+		Tag:         "access.metrics",
+		GroupBy:     []string{"status"},
+		Field:       "reqtime",
+		Percentiles: []float64{50, 90},
+		DropRecords: true,
+	})
+	buf := []byte("status:200\treqtime:0.1\n" +
+		"status:200\treqtime:0.3\n" +
+		"status:200\treqtime:0.2\n" +
+		"status:500\treqtime:1.5\n" +
+		"status:500")
+	rs := hydra.NewFluentRecordSet("access", "message", hydra.FormatLTSV, nil, nil, buf)
+	if a.Filter(rs) != nil {
+		t.Error("records must be dropped")
+	}
+	other := &fluent.FluentRecordSet{Tag: "other"}
+	if a.Filter(other) != other {
+		t.Error("unmatched records must be passed")
+	}
+
+	if rss := a.Flush(time.Now(), false); rss != nil {
+		t.Errorf("window must not be flushed yet %#v", rss)
+	}
+	rss := a.Flush(time.Now(), true)
+	if len(rss) != 1 || rss[0].Tag != "access.metrics" || len(rss[0].Records) != 2 {
+		t.Fatalf("unexpected summary %#v", rss)
+	}
+	s200 := rss[0].Records[0].GetAllData()
+	if s200["status"] != "200" || s200["count"] != int64(3) ||
+		s200["min"] != 0.1 || s200["max"] != 0.3 ||
+		s200["p50"] != 0.2 || s200["p90"] != 0.3 {
+		t.Errorf("unexpected summary for 200 %#v", s200)
+	}
+	s500 := rss[0].Records[1].GetAllData()
+	if s500["status"] != "500" || s500["count"] != int64(2) || s500["sum"] != 1.5 {
+		t.Errorf("unexpected summary for 500 %#v", s500)
+	}
+
+	if rss := a.Flush(time.Now(), true); rss != nil {
+		t.Errorf("empty window must not be flushed %#v", rss)
+	}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	a := newAggregator(t, &hydra.ConfigAggregation{
+		Tag:      "metrics",
+		Interval: hydra.Duration{Duration: time.Second},
+	})
+	rs := hydra.NewFluentRecordSet("foo", "message", hydra.FormatNone, nil, nil, []byte("a\nb"))
+	if a.Filter(rs) != rs {
+		t.Error("records must be passed")
+	}
+	rss := a.Flush(time.Now().Add(time.Second), false)
+	if len(rss) != 1 || len(rss[0].Records) != 1 {
+		t.Fatalf("unexpected summary %#v", rss)
+	}
+	if n, _ := rss[0].Records[0].GetData("count"); n != int64(2) {
+		t.Errorf("unexpected count %v", n)
+	}
+}
+
+func TestAggregatorInvalidConfig(t *testing.T) {
+	configs := []*hydra.ConfigAggregation{
+		{},
+		{Tag: "foo", Percentiles: []float64{99}},
+		{Tag: "foo", Field: "bar", Percentiles: []float64{101}},
+	}
+	for _, config := range configs {
+		config.Restrict(&hydra.Config{})
+		if _, err := hydra.NewAggregator(config); err == nil {
+			t.Errorf("config must be invalid %#v", config)
+		}
+	}
+}
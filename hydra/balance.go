@@ -0,0 +1,198 @@
+package hydra
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+// DefaultServerWeight is the weight of servers used by RoundRobin (same as fluentd).
+const DefaultServerWeight = 60
+
+// weightedRoundRobin selects servers in proportion to their weights by smooth weighted round robin.
+type weightedRoundRobin struct {
+	weights []int
+	current []int
+}
+
+func newWeightedRoundRobin(weights []int) *weightedRoundRobin {
+	return &weightedRoundRobin{
+		weights: weights,
+		current: make([]int, len(weights)),
+	}
+}
+
+// next selects one of candidates (indices of servers). It returns -1 if candidates is empty.
+func (w *weightedRoundRobin) next(candidates []int) int {
+	best, total := -1, 0
+	for _, i := range candidates {
+		w.current[i] += w.weights[i]
+		total += w.weights[i]
+		if best == -1 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best != -1 {
+		w.current[best] -= total
+	}
+	return best
+}
+
+// candidates returns indices of servers in the order to try.
+// Active servers are tried at first (from the one selected by weighted round robin if RoundRobin is enabled),
+// and standby servers are tried only after all active servers.
+func (f *OutForward) candidates() []int {
+	order := make([]int, 0, len(f.loggers))
+	var standby []int
+	for i := range f.loggers {
+		if f.standby[i] {
+			standby = append(standby, i)
+		} else {
+			order = append(order, i)
+		}
+	}
+	if f.RoundRobin {
+		var available []int
+		for _, i := range order {
+			if !f.loggers[i].IsReconnecting() && !f.isDown(i) {
+				available = append(available, i)
+			}
+		}
+		if first := f.wrr.next(available); first != -1 {
+			for n, i := range order {
+				if i == first {
+					// rotate to start from the selected server
+					order = append(order[n:], order[:n]...)
+					break
+				}
+			}
+		}
+	}
+	return append(order, standby...)
+}
+
+// HashKeyTag as HashKey hashes record sets by the tag.
+const HashKeyTag = "@tag"
+
+// virtualNodes is the number of points on the hash ring for a server of DefaultServerWeight.
+const virtualNodes = 160
+
+// hashRing maps keys to servers by consistent hashing.
+// When a server is unavailable, only keys on the server are moved to the next server on the ring.
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint32
+	server int
+}
+
+// newHashRing places active (not standby) servers on the ring by their addresses with points in proportion to their weights.
+func newHashRing(servers []*ConfigServer, weights []int) *hashRing {
+	r := &hashRing{}
+	for i, server := range servers {
+		if server.standby() {
+			continue
+		}
+		n := virtualNodes * weights[i] / DefaultServerWeight
+		if n < 1 {
+			n = 1
+		}
+		for v := 0; v < n; v++ {
+			r.points = append(r.points, ringPoint{
+				hash:   hashOf(fmt.Sprintf("%s-%d", server.Address(), v)),
+				server: i,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+func hashOf(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// lookup returns the first available server clockwise from the hash of key. It returns -1 if no servers are available.
+func (r *hashRing) lookup(key string, available func(int) bool) int {
+	if len(r.points) == 0 {
+		return -1
+	}
+	h := hashOf(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	checked := make(map[int]bool)
+	for n := 0; n < len(r.points); n++ {
+		p := r.points[(start+n)%len(r.points)]
+		if checked[p.server] {
+			continue
+		}
+		if available(p.server) {
+			return p.server
+		}
+		checked[p.server] = true
+	}
+	return -1
+}
+
+type hashPart struct {
+	server    int
+	recordSet *fluent.FluentRecordSet
+}
+
+// hashKeyString returns the string of v to hash. Strings decoded from msgpack may be []byte.
+func hashKeyString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// split splits the record set into parts for each server by the hash of HashKey.
+// Standby servers are used when no servers on the ring are available. It returns nil if all servers are unavailable.
+func (f *OutForward) split(rs *fluent.FluentRecordSet) []*hashPart {
+	servers := make(map[string]int)
+	parts := make(map[int]*hashPart)
+	var ordered []*hashPart
+	for _, record := range rs.Records {
+		key := rs.Tag
+		if f.HashKey != HashKeyTag {
+			key = ""
+			if v, ok := record.GetData(f.HashKey); ok {
+				key = hashKeyString(v)
+			}
+		}
+		i, ok := servers[key]
+		if !ok {
+			i = f.ring.lookup(key, f.available)
+			if i == -1 {
+				i = f.availableStandby()
+			}
+			if i == -1 {
+				return nil
+			}
+			servers[key] = i
+		}
+		part, ok := parts[i]
+		if !ok {
+			part = &hashPart{server: i, recordSet: &fluent.FluentRecordSet{Tag: rs.Tag}}
+			parts[i] = part
+			ordered = append(ordered, part)
+		}
+		part.recordSet.Records = append(part.recordSet.Records, record)
+	}
+	return ordered
+}
+
+func (f *OutForward) availableStandby() int {
+	for i := range f.loggers {
+		if f.standby[i] && f.available(i) {
+			return i
+		}
+	}
+	return -1
+}
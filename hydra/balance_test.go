@@ -0,0 +1,396 @@
+package hydra_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func waitCounter(counter *int64, expected int64, timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if n := atomic.LoadInt64(counter); n >= expected {
+			return n
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return atomic.LoadInt64(counter)
+}
+
+func TestForwardWeight(t *testing.T) {
+	log.Println("---- TestForwardWeight ----")
+	var heavy, light, standby, zero int64
+	heavyAddr, heavyCloser := runMockServer(t, "", &heavy)
+	defer close(heavyCloser)
+	lightAddr, lightCloser := runMockServer(t, "", &light)
+	defer close(lightCloser)
+	standbyAddr, standbyCloser := runMockServer(t, "", &standby)
+	defer close(standbyCloser)
+	zeroAddr, zeroCloser := runMockServer(t, "", &zero)
+	defer close(zeroCloser)
+
+	servers := []*hydra.ConfigServer{
+		newConfigServer(heavyAddr),
+		newConfigServer(lightAddr),
+		newConfigServer(standbyAddr),
+		newConfigServer(zeroAddr),
+	}
+	heavyWeight, lightWeight, zeroWeight := 30, 10, 0
+	servers[0].Weight = &heavyWeight
+	servers[1].Weight = &lightWeight
+	servers[2].Standby = true
+	servers[3].Weight = &zeroWeight
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.RoundRobin = true
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	for i := 0; i < 40; i++ {
+		c.MessageCh <- prepareRecordSet()
+	}
+	lines := int64(len(TestMessageLines))
+	if n := waitCounter(&heavy, 30*lines, 3*time.Second); n != 30*lines {
+		t.Errorf("heavy server recieved %d expected %d", n, 30*lines)
+	}
+	if n := waitCounter(&light, 10*lines, 3*time.Second); n != 10*lines {
+		t.Errorf("light server recieved %d expected %d", n, 10*lines)
+	}
+	if n := atomic.LoadInt64(&standby); n != 0 {
+		t.Errorf("standby server must not recieve while active servers are available. recieved %d", n)
+	}
+	if n := atomic.LoadInt64(&zero); n != 0 {
+		t.Errorf("server of Weight 0 must not recieve while active servers are available. recieved %d", n)
+	}
+}
+
+func TestForwardStandby(t *testing.T) {
+	log.Println("---- TestForwardStandby ----")
+	var active, standby int64
+	activeAddr, activeCloser := runMockServer(t, "", &active)
+	close(activeCloser) // active server is down
+	sleep(1)
+	standbyAddr, standbyCloser := runMockServer(t, "", &standby)
+	defer close(standbyCloser)
+
+	servers := []*hydra.ConfigServer{
+		newConfigServer(standbyAddr),
+		newConfigServer(activeAddr),
+	}
+	servers[0].Standby = true
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	c.MessageCh <- prepareRecordSet()
+	lines := int64(len(TestMessageLines))
+	if n := waitCounter(&standby, lines, 3*time.Second); n != lines {
+		t.Errorf("standby server recieved %d expected %d", n, lines)
+	}
+}
+
+func TestValidateStandby(t *testing.T) {
+	invalid, zero := -1, 0
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{
+			{Host: "127.0.0.1", Standby: true, Weight: &invalid},
+			{Host: "127.0.0.1", Weight: &zero},
+		},
+	}
+	config.Restrict()
+	expected := []string{
+		"Servers[0]: invalid Weight -1",
+		"Servers: all servers are Standby or Weight = 0",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Fatalf("%d problems expected, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+}
+
+// keyCollector records which server recieved records of each user_id.
+type keyCollector struct {
+	mu    sync.Mutex
+	keys  map[string]string
+	count int
+	dup   []string
+}
+
+func (kc *keyCollector) run(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					recordSets, err := fluent.DecodeEntries(conn)
+					if err != nil {
+						return
+					}
+					kc.mu.Lock()
+					for _, rs := range recordSets {
+						for _, record := range rs.Records {
+							v, _ := record.GetData("user_id")
+							key := fmt.Sprintf("%s", v)
+							if prev, ok := kc.keys[key]; ok && prev != addr {
+								kc.dup = append(kc.dup, key)
+							}
+							kc.keys[key] = addr
+							kc.count++
+						}
+					}
+					kc.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return addr, func() { l.Close() }
+}
+
+func (kc *keyCollector) wait(n int) {
+	for i := 0; i < 30; i++ {
+		kc.mu.Lock()
+		count := kc.count
+		kc.mu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// hashedRecordSet returns a record set of n users. user_id is []byte (as decoded from msgpack) if asBytes is true.
+func hashedRecordSet(n int, asBytes bool) *fluent.FluentRecordSet {
+	rs := &fluent.FluentRecordSet{Tag: TestTag}
+	for i := 0; i < n; i++ {
+		var id interface{} = fmt.Sprintf("user%d", i)
+		if asBytes {
+			id = []byte(fmt.Sprintf("user%d", i))
+		}
+		rs.Records = append(rs.Records, &fluent.TinyFluentRecord{
+			Timestamp: time.Now(),
+			Data:      map[string]interface{}{"user_id": id},
+		})
+	}
+	return rs
+}
+
+func forwardHashed(t *testing.T, kc *keyCollector, servers []*hydra.ConfigServer, n int) map[string]string {
+	kc.mu.Lock()
+	kc.keys = make(map[string]string)
+	kc.count = 0
+	kc.mu.Unlock()
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.HashKey = "user_id"
+	c.RunProcess(outForward)
+	c.MessageCh <- hashedRecordSet(n, false)
+	c.MessageCh <- hashedRecordSet(n, true) // same keys as strings
+	kc.wait(2 * n)
+	c.Shutdown()
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if kc.count != 2*n {
+		t.Errorf("recieved %d records expected %d", kc.count, 2*n)
+	}
+	if len(kc.dup) > 0 {
+		t.Errorf("records of the same key were sent to different servers %v", kc.dup)
+	}
+	keys := make(map[string]string, len(kc.keys))
+	for k, v := range kc.keys {
+		keys[k] = v
+	}
+	return keys
+}
+
+func TestForwardConsistentHash(t *testing.T) {
+	log.Println("---- TestForwardConsistentHash ----")
+	kc := &keyCollector{}
+	var servers []*hydra.ConfigServer
+	for i := 0; i < 3; i++ {
+		addr, closer := kc.run(t)
+		defer closer()
+		servers = append(servers, newConfigServer(addr))
+	}
+	n := 100
+	keys := forwardHashed(t, kc, servers, n)
+	used := make(map[string]bool)
+	for _, addr := range keys {
+		used[addr] = true
+	}
+	if len(used) != len(servers) {
+		t.Errorf("keys must be distributed to all servers. used %d servers", len(used))
+	}
+
+	// a server which is down is skipped, and only keys on it are moved to the next server on the ring
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	keysWithDead := forwardHashed(t, kc, append(servers, newConfigServer(dead.Addr().String())), n)
+	for key, addr := range keys {
+		if keysWithDead[key] != addr {
+			t.Errorf("key %s moved from %s to %s", key, addr, keysWithDead[key])
+		}
+	}
+}
+
+func TestValidateHashKey(t *testing.T) {
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{
+			{Host: "127.0.0.1"},
+		},
+		ServerRoundRobin: true,
+		ServerHashKey:    "user_id",
+	}
+	config.Restrict()
+	errs := config.Validate()
+	if len(errs) != 1 || errs[0].Error() != "ServerHashKey: can't be used with ServerRoundRobin" {
+		t.Errorf("unexpected problems %v", errs)
+	}
+}
+
+func TestValidateWeight(t *testing.T) {
+	light := 10
+	servers := []*hydra.ConfigServer{
+		{Host: "127.0.0.1", Weight: &light},
+		{Host: "127.0.0.1"},
+	}
+	config := &hydra.Config{Servers: servers}
+	config.Restrict()
+	errs := config.Validate()
+	if len(errs) != 1 || errs[0].Error() != "Servers[0]: Weight 10 has no effect without RoundRobin or HashKey" {
+		t.Errorf("unexpected problems %v", errs)
+	}
+
+	for _, config := range []*hydra.Config{
+		{Servers: servers, ServerRoundRobin: true},
+		{Servers: servers, ServerHashKey: "user_id"},
+	} {
+		config.Restrict()
+		if errs := config.Validate(); len(errs) != 0 {
+			t.Errorf("unexpected problems %v", errs)
+		}
+	}
+}
+
+// runOneShotServer accepts only one connection and reads one chunk, and sends the number of records to the returned channel.
+// The ack is returned if ack is true.
+func runOneShotServer(t *testing.T, ack bool) (string, chan int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan int, 1)
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		recordSets, option, err := fluent.DecodeEntriesWithOption(conn)
+		if err != nil {
+			return
+		}
+		if ack {
+			fluent.WriteAck(conn, option.Chunk)
+		}
+		n := 0
+		for _, rs := range recordSets {
+			n += len(rs.Records)
+		}
+		ch <- n
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestForwardConsistentHashBuffer(t *testing.T) {
+	log.Println("---- TestForwardConsistentHashBuffer ----")
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-buffer")
+	defer os.RemoveAll(dir)
+
+	// a record set buffered while servers were down
+	n := 100
+	b, err := hydra.NewDiskBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Push(hashedRecordSet(n, false))
+
+	// a server acks the first part and goes down, and another one goes down without acks
+	ackAddr, ackCh := runOneShotServer(t, true)
+	downAddr, _ := runOneShotServer(t, false)
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{
+		newConfigServer(ackAddr),
+		newConfigServer(downAddr),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.HashKey = "user_id"
+	outForward.RequireAckResponse = true
+	outForward.AckResponseTimeout = 300 * time.Millisecond
+	if err := outForward.EnableBuffer(dir, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+
+	var sent int
+	select {
+	case sent = <-ackCh:
+	case <-time.After(3 * time.Second):
+		t.Fatal("a part of the buffered record set was not sent")
+	}
+	sleep(2) // all servers are down, and the rest is waiting in buffer
+	c.Shutdown()
+
+	// only the rest is kept in buffer not to send records again
+	b, err = hydra.NewDiskBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := b.Peek()
+	if rs == nil || b.Len() != 1 {
+		t.Fatalf("the rest must be kept in buffer. %d chunks", b.Len())
+	}
+	if sent == 0 || sent == n || len(rs.Records) != n-sent {
+		t.Errorf("%d records were sent and %d records are buffered. %d records expected", sent, len(rs.Records), n)
+	}
+}
@@ -0,0 +1,151 @@
+package hydra
+
+import (
+	"log"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+// recordSetOverhead is an estimated size of a packed record set except for records.
+const recordSetOverhead = 16
+
+// Batcher coalesces record sets by tag into chunks, and splits record sets which exceed the chunk limits.
+// A chunk becomes ready when it reaches ChunkLimitSize (bytes) or ChunkLimitRecords, or FlushInterval passed.
+// Without FlushInterval, record sets are not coalesced but only split.
+type Batcher struct {
+	ChunkLimitSize    int
+	ChunkLimitRecords int
+	FlushInterval     time.Duration
+
+	batches map[string]*batch
+	order   []string
+	ready   []*fluent.FluentRecordSet
+}
+
+type batch struct {
+	recordSet *fluent.FluentRecordSet
+	bytes     int
+	since     time.Time
+}
+
+func NewBatcher(chunkLimitSize, chunkLimitRecords int, flushInterval time.Duration) *Batcher {
+	return &Batcher{
+		ChunkLimitSize:    chunkLimitSize,
+		ChunkLimitRecords: chunkLimitRecords,
+		FlushInterval:     flushInterval,
+		batches:           make(map[string]*batch),
+	}
+}
+
+func (b *Batcher) enabled() bool {
+	return b.ChunkLimitSize > 0 || b.ChunkLimitRecords > 0 || b.FlushInterval > 0
+}
+
+// Add appends records in rs to the chunk of the tag.
+func (b *Batcher) Add(rs *fluent.FluentRecordSet) {
+	if !b.enabled() {
+		b.ready = append(b.ready, rs)
+		return
+	}
+	for _, record := range rs.Records {
+		size := 0
+		if b.ChunkLimitSize > 0 {
+			packed, err := record.Pack()
+			if err != nil {
+				log.Println("[error] Couldn't pack record. dropped", err)
+				continue
+			}
+			size = len(packed)
+		}
+		bt := b.batches[rs.Tag]
+		if bt != nil && b.exceeds(bt, size) {
+			b.flushTag(rs.Tag)
+			bt = nil
+		}
+		if bt == nil {
+			bt = &batch{
+				recordSet: &fluent.FluentRecordSet{Tag: rs.Tag},
+				bytes:     len(rs.Tag) + recordSetOverhead,
+				since:     time.Now(),
+			}
+			b.batches[rs.Tag] = bt
+			b.order = append(b.order, rs.Tag)
+		}
+		if b.ChunkLimitSize > 0 && bt.bytes+size > b.ChunkLimitSize {
+			log.Printf("[warning] a record of tag %s (%d bytes) exceeds ChunkLimitSize", rs.Tag, size)
+		}
+		bt.recordSet.Records = append(bt.recordSet.Records, record)
+		bt.bytes += size
+		if b.ChunkLimitRecords > 0 && len(bt.recordSet.Records) >= b.ChunkLimitRecords {
+			b.flushTag(rs.Tag)
+		}
+	}
+	if b.FlushInterval == 0 {
+		b.flushTag(rs.Tag)
+	}
+}
+
+func (b *Batcher) exceeds(bt *batch, size int) bool {
+	if b.ChunkLimitSize > 0 && bt.bytes+size > b.ChunkLimitSize {
+		return true
+	}
+	if b.ChunkLimitRecords > 0 && len(bt.recordSet.Records) >= b.ChunkLimitRecords {
+		return true
+	}
+	return false
+}
+
+func (b *Batcher) flushTag(tag string) {
+	bt, ok := b.batches[tag]
+	if !ok {
+		return
+	}
+	delete(b.batches, tag)
+	for i, t := range b.order {
+		if t == tag {
+			b.order = append(b.order[:i], b.order[i+1:]...)
+			break
+		}
+	}
+	if len(bt.recordSet.Records) > 0 {
+		b.ready = append(b.ready, bt.recordSet)
+	}
+}
+
+// Flush makes chunks which were started FlushInterval ago ready. If force is true, all chunks are made ready.
+func (b *Batcher) Flush(now time.Time, force bool) {
+	for len(b.order) > 0 {
+		tag := b.order[0]
+		if !force && now.Before(b.batches[tag].since.Add(b.FlushInterval)) {
+			return
+		}
+		b.flushTag(tag)
+	}
+}
+
+// Deadline returns the time when the oldest chunk should be flushed.
+func (b *Batcher) Deadline() (time.Time, bool) {
+	if len(b.order) == 0 {
+		return time.Time{}, false
+	}
+	return b.batches[b.order[0]].since.Add(b.FlushInterval), true
+}
+
+// Next returns a ready chunk. It returns nil if no chunks are ready.
+func (b *Batcher) Next() *fluent.FluentRecordSet {
+	if len(b.ready) == 0 {
+		return nil
+	}
+	rs := b.ready[0]
+	b.ready = b.ready[1:]
+	return rs
+}
+
+// Drain returns all of chunks including not ready ones.
+func (b *Batcher) Drain() []*fluent.FluentRecordSet {
+	b.Flush(time.Now(), true)
+	ready := b.ready
+	b.ready = nil
+	return ready
+}
@@ -0,0 +1,83 @@
+package hydra_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestBatcherCoalesce(t *testing.T) {
+	b := hydra.NewBatcher(0, 0, time.Second)
+	now := time.Now()
+	b.Add(newDummyRecordSet(2))
+	b.Add(newDummyRecordSet(3))
+	other := newDummyRecordSet(1)
+	other.Tag = "other"
+	b.Add(other)
+	if rs := b.Next(); rs != nil {
+		t.Errorf("no chunks must be ready before FlushInterval. got %#v", rs)
+	}
+	if deadline, ok := b.Deadline(); !ok || deadline.Before(now.Add(time.Second)) {
+		t.Errorf("unexpected deadline %s", deadline)
+	}
+	b.Flush(now.Add(2*time.Second), false)
+	rs := b.Next()
+	if rs == nil || rs.Tag != "dummy" || len(rs.Records) != 5 {
+		t.Errorf("unexpected chunk %#v", rs)
+	}
+	rs = b.Next()
+	if rs == nil || rs.Tag != "other" || len(rs.Records) != 1 {
+		t.Errorf("unexpected chunk %#v", rs)
+	}
+	if b.Next() != nil {
+		t.Error("too many chunks")
+	}
+}
+
+func TestBatcherSplitByRecords(t *testing.T) {
+	b := hydra.NewBatcher(0, 4, 0)
+	b.Add(newDummyRecordSet(10))
+	for _, n := range []int{4, 4, 2} {
+		rs := b.Next()
+		if rs == nil || len(rs.Records) != n {
+			t.Fatalf("chunk of %d records expected, got %#v", n, rs)
+		}
+	}
+	if b.Next() != nil {
+		t.Error("too many chunks")
+	}
+}
+
+func TestBatcherSplitBySize(t *testing.T) {
+	limit := 100
+	b := hydra.NewBatcher(limit, 0, time.Minute)
+	b.Add(newDummyRecordSet(20))
+	chunks := b.Drain()
+	if len(chunks) < 2 {
+		t.Errorf("record set must be split. got %d chunks", len(chunks))
+	}
+	n := 0
+	for _, rs := range chunks {
+		packed, err := rs.PackAsPackedForward()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed) > limit {
+			t.Errorf("chunk size %d exceeds %d", len(packed), limit)
+		}
+		n += len(rs.Records)
+	}
+	if n != 20 {
+		t.Errorf("%d records expected, got %d", 20, n)
+	}
+}
+
+func TestBatcherDisabled(t *testing.T) {
+	b := hydra.NewBatcher(0, 0, 0)
+	rs := newDummyRecordSet(3)
+	b.Add(rs)
+	if b.Next() != rs {
+		t.Error("record set must be passed through")
+	}
+}
@@ -2,6 +2,8 @@ package hydra
 
 import (
 	"container/list"
+	"log"
+
 	"github.com/fujiwara/fluent-agent-hydra/fluent"
 )
 
@@ -10,6 +12,13 @@ type MessageQueue struct {
 	locker      chan interface{}
 	messages    int64
 	maxMessages int64
+	kept        int64 // messages which must not be disposed
+}
+
+// queuedRecordSet is a record set in the queue. Kept record sets are not disposed.
+type queuedRecordSet struct {
+	*fluent.FluentRecordSet
+	kept bool
 }
 
 func NewMessageQueue(maxMessages int) *MessageQueue {
@@ -32,33 +41,67 @@ func (q *MessageQueue) unlock() {
 	q.locker <- nil
 }
 
+// Enqueue adds recordSet to the queue. When the queue is full, the oldest messages are disposed
+// (or recordSet itself if only kept messages are queued). It returns the number of messages disposed.
 func (q *MessageQueue) Enqueue(recordSet *fluent.FluentRecordSet) int64 {
 	q.lock()
 	defer q.unlock()
 	messages := int64(len(recordSet.Records))
-	disposed := int64(0)
-	for q.messages+messages > q.maxMessages && q.list.Len() > 0 {
-		_rs := q.dequeue() // dispose first value
-		rs := _rs.(*fluent.FluentRecordSet)
-		disposed += int64(len(rs.Records))
-		q.messages -= int64(len(rs.Records))
+	if q.kept > 0 && q.kept+messages > q.maxMessages {
+		log.Printf("[warning] message queue is full of acked chunks. %d messages of tag:%s are disposed", messages, recordSet.Tag)
+		return messages
 	}
-	q.list.PushBack(recordSet)
+	disposed := q.dispose(messages)
+	q.list.PushBack(&queuedRecordSet{FluentRecordSet: recordSet})
 	q.messages += messages
 	return disposed
 }
 
+// EnqueueKept adds recordSet which must not be disposed, like chunks acked to senders.
+// It returns false without adding when the queue is full of kept messages.
+func (q *MessageQueue) EnqueueKept(recordSet *fluent.FluentRecordSet) bool {
+	q.lock()
+	defer q.unlock()
+	messages := int64(len(recordSet.Records))
+	if q.kept > 0 && q.kept+messages > q.maxMessages {
+		return false
+	}
+	q.dispose(messages)
+	q.list.PushBack(&queuedRecordSet{FluentRecordSet: recordSet, kept: true})
+	q.messages += messages
+	q.kept += messages
+	return true
+}
+
+// dispose removes the oldest record sets which are not kept until messages can be added.
+func (q *MessageQueue) dispose(messages int64) int64 {
+	disposed := int64(0)
+	for e := q.list.Front(); e != nil && q.messages+messages > q.maxMessages; {
+		next := e.Next()
+		if rs := e.Value.(*queuedRecordSet); !rs.kept {
+			q.list.Remove(e)
+			disposed += int64(len(rs.Records))
+			q.messages -= int64(len(rs.Records))
+		}
+		e = next
+	}
+	return disposed
+}
+
 func (q *MessageQueue) Dequeue() (*fluent.FluentRecordSet, bool) {
 	q.lock()
 	defer q.unlock()
 	if q.list.Len() == 0 {
 		q.messages = 0
+		q.kept = 0
 		return nil, false
 	}
-	_rs := q.dequeue()
-	rs := _rs.(*fluent.FluentRecordSet)
+	rs := q.dequeue().(*queuedRecordSet)
 	q.messages -= int64(len(rs.Records))
-	return rs, true
+	if rs.kept {
+		q.kept -= int64(len(rs.Records))
+	}
+	return rs.FluentRecordSet, true
 }
 
 func (q *MessageQueue) dequeue() interface{} {
@@ -86,3 +86,37 @@ func TestMessageQueue(t *testing.T) {
 		t.Error("invaid queue.Len()", queue.Len())
 	}
 }
+
+func TestMessageQueueKept(t *testing.T) {
+	queue := hydra.NewMessageQueue(10)
+	queue.Enqueue(newDummyRecordSet(3))
+	if !queue.EnqueueKept(newDummyRecordSet(4)) {
+		t.Fatal("EnqueueKept failed")
+	}
+
+	// [3 4(kept)] + 6 => disposed=[3]
+	if d := queue.Enqueue(newDummyRecordSet(6)); d != 3 {
+		t.Errorf("invalid disposed %d expected 3", d)
+	}
+	// [4(kept) 6] + 7 => the new one is disposed not to dispose kept messages
+	if d := queue.Enqueue(newDummyRecordSet(7)); d != 7 {
+		t.Errorf("invalid disposed %d expected 7", d)
+	}
+	// [4(kept) 6] + 6(kept) => disposed=[6]
+	if !queue.EnqueueKept(newDummyRecordSet(6)) {
+		t.Fatal("EnqueueKept failed")
+	}
+	if queue.Len() != 10 {
+		t.Errorf("invalid queue.Len() %d expected 10", queue.Len())
+	}
+	// [4(kept) 6(kept)] is full of kept messages
+	if queue.EnqueueKept(newDummyRecordSet(1)) {
+		t.Error("EnqueueKept must fail when the queue is full of kept messages")
+	}
+	if rs, ok := queue.Dequeue(); !ok || len(rs.Records) != 4 {
+		t.Error("invalid dequeued rs", rs)
+	}
+	if !queue.EnqueueKept(newDummyRecordSet(1)) {
+		t.Error("EnqueueKept failed after dequeued")
+	}
+}
@@ -1,9 +1,14 @@
 package hydra
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"time"
 
@@ -11,29 +16,279 @@ import (
 )
 
 const (
-	DefaultFluentdPort       = 24224
-	DefaultFieldName         = "message"
-	DefaultMaxBufferMessages = 1024 * 1024
-	DefaultTimeKey           = "time"
+	DefaultFluentdPort         = 24224
+	DefaultFieldName           = "message"
+	DefaultMaxBufferMessages   = 1024 * 1024
+	DefaultTimeKey             = "time"
+	DefaultServerGroup         = "default"
+	DefaultAckResponseTimeout  = 30 * time.Second
+	DefaultHeartbeatInterval   = 1 * time.Second
+	DefaultPhiThreshold        = 16
+	DefaultHardTimeout         = 60 * time.Second
+	DefaultReconnectAfterSends = 100
 )
 
 var DefaultTimeFormat = TimeFormat(time.RFC3339)
 
 type Config struct {
-	TagPrefix        string
-	FieldName        string
-	ReadBufferSize   int
-	Servers          []*ConfigServer
-	ServerRoundRobin bool
-	Logs             []*ConfigLogfile
-	Receiver         *ConfigReceiver
-	Monitor          *ConfigMonitor
-	SubSecondTime    bool
+	TagPrefix          string
+	FieldName          string
+	ReadBufferSize     int
+	Servers            []*ConfigServer
+	ServerRoundRobin   bool
+	ServerHashKey      string
+	ServerWorkers      int
+	ServerOrderByTag   bool
+	RequireAckResponse bool
+	AckResponseTimeout Duration
+	Heartbeat          *ConfigHeartbeat
+	Secondary          *ConfigSecondary
+	Logs               []*ConfigLogfile
+	Receiver           *ConfigReceiver
+	Monitor            *ConfigMonitor
+	Buffer             *ConfigBuffer
+	ChunkLimitSize     int
+	ChunkLimitRecords  int
+	FlushInterval      Duration
+	SubSecondTime      bool
+	Redactions         []*ConfigRedaction
+	Aggregations       []*ConfigAggregation
+	Include            []string
+	ServerGroups       []*ConfigServerGroup
+	Routes             []*ConfigRoute
+	DefaultGroup       string
+
+	filename string
+	problems []*ConfigError
+}
+
+// includedConfig is a part of Config which can be defined in included files.
+type includedConfig struct {
+	Logs    []*ConfigLogfile
+	Servers []*ConfigServer
+}
+
+// Duration is a time.Duration which is decoded from a string like "10s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 type ConfigServer struct {
 	Host string
 	Port int
+
+	// TLS connects to the server with TLS.
+	// The server certificate is verified by CAFile (or system roots) and ServerName (or Host).
+	TLS                bool
+	CAFile             string
+	CertFile           string // client certificate
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool // for testing only
+
+	// SharedKey enables the handshake of forward protocol (secure forward).
+	// Username and Password are sent when the server requires user authentication.
+	SharedKey    string
+	SelfHostname string
+	Username     string
+	Password     string
+
+	// Compress = "gzip" sends records as CompressedPackedForward mode.
+	Compress string
+
+	// Weight is the ratio of records sent to the server by RoundRobin (default 60).
+	// With HashKey, the share of the hash ring is in proportion to Weight. Failover (neither of them) ignores Weight.
+	// Standby servers are used only when all other servers are unavailable.
+	// Servers of Weight = 0 are used as Standby (same as fluentd).
+	Weight  *int
+	Standby bool
+
+	ConnectTimeout Duration // default 3s
+	WriteTimeout   Duration // default 3s
+
+	// Reconnecting waits RetryWait * 1.5^n (n <= MaxRetry), capped by RetryWaitMax and randomized by +-RetryJitter.
+	RetryWait    Duration // default 500ms
+	MaxRetry     int      // default 12
+	RetryWaitMax Duration
+	RetryJitter  float64 // 0.0 - 1.0
+
+	// The connection is refreshed after ReconnectAfterSends sends (default 100, -1 disables),
+	// or ReconnectInterval passed since connected.
+	ReconnectAfterSends int64
+	ReconnectInterval   Duration
+
+	// TCPKeepAlive is the period of TCP keepalive (default 15s). Negative disables it.
+	TCPKeepAlive Duration
+
+	// ResolveInterval enables resolving Host periodically. Each address is connected as an endpoint of the server.
+	ResolveInterval Duration
+}
+
+// ConfigServerGroup is a named set of servers which records are routed to.
+type ConfigServerGroup struct {
+	Name       string
+	Servers    []*ConfigServer
+	RoundRobin bool
+
+	// HashKey sends records which have the same value of the field to the same server by consistent hashing.
+	// HashKey = "@tag" hashes record sets by the tag.
+	HashKey string
+
+	// Workers is the number of sender workers, each of which has its own connection to every server (default 1).
+	// Record sets are distributed to workers in turn, so records of a tag may be sent out of order.
+	Workers int
+
+	// OrderByTag distributes record sets to workers by tags, so the order of records is preserved for each tag.
+	// Records of a tag are sent by only one worker.
+	OrderByTag bool
+
+	// RequireAckResponse makes out_forward to wait for the ack from servers, and resend chunks to another server on timeout.
+	RequireAckResponse bool
+	AckResponseTimeout Duration
+
+	Heartbeat *ConfigHeartbeat
+	Secondary *ConfigSecondary
+
+	// File writes record sets into local files instead of sending them to Servers.
+	File *ConfigOutFile
+
+	// HTTP posts record sets to HTTP endpoints instead of sending them to Servers.
+	// RoundRobin selects an endpoint by round robin.
+	HTTP *ConfigOutHTTP
+
+	// Elasticsearch writes record sets by the bulk API of Elasticsearch (or OpenSearch) instead of sending them to Servers.
+	Elasticsearch *ConfigOutElasticsearch
+
+	// Loki pushes record sets to Grafana Loki instead of sending them to Servers.
+	Loki *ConfigOutLoki
+}
+
+// ConfigHeartbeat enables heartbeats to servers (compatible with fluentd's out_forward).
+// Servers are marked down until the first heartbeat arrives.
+// Servers which don't respond to heartbeats are marked down and excluded from selection until they recover.
+type ConfigHeartbeat struct {
+	Type     string // "tcp" (connect, with TLS and SharedKey handshakes) | "udp" (ping)
+	Interval Duration
+
+	// Detector = "phi" (phi accrual failure detector) | "threshold".
+	// A server is marked down when phi exceeds PhiThreshold, or no heartbeat arrived for HardTimeout.
+	Detector     string
+	PhiThreshold float64
+	HardTimeout  Duration
+}
+
+// ConfigSecondary writes record sets into files instead of retrying forever
+// when all servers are unavailable for RetryTimeout (like fluentd's <secondary>).
+type ConfigSecondary struct {
+	Path           string // directory of files
+	Format         string // "msgpack" (forward protocol) | "json" (JSON lines)
+	RetryTimeout   Duration
+	RotateSize     int64
+	RotateInterval Duration
+}
+
+// ConfigOutFile writes record sets into files (like fluentd's out_file).
+// Path is expanded by {tag} and %Y, %m, %d, %H, %M, %S of the current time.
+// ("${...}" is not used for the tag, because it is expanded as an environment variable.)
+type ConfigOutFile struct {
+	Path   string
+	Format string // "json" (default) | "ltsv" | "msgpack" (forward protocol)
+
+	// IncludeTime and IncludeTag prefix lines with the time and the tag separated by tabs,
+	// as same as dump files of fluent-http-tailf.
+	IncludeTime bool
+	IncludeTag  bool
+
+	// Files are rotated when the expanded Path changes, or by RotateSize and RotateInterval.
+	RotateSize     int64
+	RotateInterval Duration
+
+	// Compress = "gzip" compresses closed files.
+	Compress string
+
+	// Files older than MaxAge, or out of the newest MaxFiles are removed.
+	MaxAge   Duration
+	MaxFiles int
+}
+
+// ConfigOutHTTP posts batches of records to HTTP endpoints (like fluentd's out_http).
+// When an endpoint fails, the next one in URLs is used.
+type ConfigOutHTTP struct {
+	URLs     []string
+	Format   string // "ndjson" (default) | "json" (array of records)
+	Compress string // "gzip"
+	Headers  map[string]string
+
+	// TagKey and TimeKey add the tag and the time (RFC3339) of records with the keys.
+	TagKey  string
+	TimeKey string
+
+	Timeout Duration // default 10s
+
+	// Failed requests (5xx, 429 or network errors) are retried after RetryWait * 1.5^n capped by RetryWaitMax.
+	RetryWait    Duration // default 500ms
+	RetryWaitMax Duration // default 30s
+}
+
+// ConfigOutElasticsearch writes records by the bulk API of Elasticsearch (or OpenSearch).
+// URLs are base URLs of the cluster, and the next one is used when a request fails.
+type ConfigOutElasticsearch struct {
+	URLs []string
+
+	// Index is the name of the index expanded by {tag} and %Y, %m, %d, %H of the record time in UTC (default "fluentd-%Y.%m.%d").
+	Index string
+
+	// IDKey uses the value of the field as _id of documents.
+	IDKey string
+
+	// TimeKey is the field of the record time (default "@timestamp"). TagKey adds the tag with the key.
+	TimeKey string
+	TagKey  string
+
+	Username string // basic authentication
+	Password string
+	Headers  map[string]string
+	Compress string // "gzip"
+
+	Timeout      Duration // default 10s
+	RetryWait    Duration // default 500ms
+	RetryWaitMax Duration // default 30s
+}
+
+// ConfigOutLoki pushes records to Grafana Loki by the push API.
+// URLs are base URLs of Loki, and the next one is used when a request fails.
+type ConfigOutLoki struct {
+	URLs []string
+
+	// Records are grouped into streams by labels of the tag (named TagLabel, default "tag") and the fields of Labels.
+	Labels   []string
+	TagLabel string
+
+	// LineKey uses the value of the field as log lines instead of JSON of records.
+	LineKey string
+
+	Format   string // "json" (default) | "protobuf" (compressed by snappy)
+	TenantID string // X-Scope-OrgID
+	Username string // basic authentication
+	Password string
+	Headers  map[string]string
+	Compress string // "gzip" for Format = "json"
+
+	Timeout      Duration // default 10s
+	RetryWait    Duration // default 500ms
+	RetryWaitMax Duration // default 30s
+}
+
+// ConfigRoute routes record sets which have tags matched to Match to Groups.
+type ConfigRoute struct {
+	Match  string
+	Groups []string
 }
 
 type ConfigLogfile struct {
@@ -46,12 +301,60 @@ type ConfigLogfile struct {
 	TimeParse  bool
 	TimeKey    string
 	TimeFormat TimeFormat
+
+	// ParseErrorTag routes lines failed to parse to "<Tag>.<ParseErrorTag>".
+	ParseErrorTag string
+}
+
+// ConfigBuffer is a disk buffer of out_forward used while all servers are unavailable.
+// A sub directory is made for each server group in Path.
+type ConfigBuffer struct {
+	Path           string
+	TotalLimitSize int64
 }
 
 type ConfigReceiver struct {
 	Host              string
 	Port              int
 	MaxBufferMessages int
+
+	// TLS accepts connections with TLS by CertFile and KeyFile.
+	// When ClientCAFile is set, client certificates are required and verified.
+	TLS          bool
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	// SharedKey requires clients to authenticate by the handshake of forward protocol.
+	// When Users are defined, clients must send one of them as username and password too.
+	SharedKey    string
+	SelfHostname string
+	Users        []*ConfigUser
+}
+
+type ConfigUser struct {
+	Username string
+	Password string
+}
+
+type ConfigRedaction struct {
+	Match       string
+	Fields      []string
+	Detectors   []string
+	Regexps     []*Regexp
+	Mode        RedactMode
+	PartialKeep *int
+	HashKey     string
+}
+
+type ConfigAggregation struct {
+	Match       string
+	Tag         string
+	GroupBy     []string
+	Field       string
+	Percentiles []float64
+	Interval    Duration
+	DropRecords bool
 }
 
 type ConfigMonitor struct {
@@ -62,13 +365,125 @@ type ConfigMonitor struct {
 func ReadConfig(filename string) (*Config, error) {
 	var config Config
 	log.Println("[info] Loading config file:", filename)
-	if _, err := toml.DecodeFile(filename, &config); err != nil {
+	problems, err := decodeConfigFile(filename, &config)
+	if err != nil {
 		return nil, err
 	}
+	config.filename = filename
+	config.problems = problems
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Include %s: %s", pattern, err)
+		}
+		for _, file := range files {
+			log.Println("[info] Including config file:", file)
+			var included includedConfig
+			problems, err := decodeConfigFile(file, &included)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+			config.Logs = append(config.Logs, included.Logs...)
+			config.Servers = append(config.Servers, included.Servers...)
+			for _, p := range problems {
+				p.Location = file + ": " + p.Location
+			}
+			config.problems = append(config.problems, problems...)
+		}
+	}
+	for _, p := range config.problems {
+		log.Println("[warning]", p)
+	}
 	config.Restrict()
 	return &config, nil
 }
 
+// decodeConfigFile decodes the TOML file into v after expanding environment variables in string values.
+func decodeConfigFile(filename string, v interface{}) ([]*ConfigError, error) {
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(filename, &raw); err != nil {
+		return nil, err
+	}
+	var errs configErrors
+	expandEnvInValue(raw, "", &errs)
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+		return nil, err
+	}
+	md, err := toml.Decode(buf.String(), v)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range md.Undecoded() {
+		errs.add(key.String(), "unknown key")
+	}
+	problems := make([]*ConfigError, 0, len(errs))
+	for _, err := range errs {
+		problems = append(problems, err.(*ConfigError))
+	}
+	return problems, nil
+}
+
+var envVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// ExpandEnv replaces ${VAR} and ${VAR:-default} in s with environment variables.
+// Names of undefined variables which have no default value are returned.
+func ExpandEnv(s string) (string, []string) {
+	var undefined []string
+	expanded := envVarRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sub := envVarRegexp.FindStringSubmatch(m)
+		name, def := sub[1], sub[2]
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		if def != "" {
+			return def[2:]
+		}
+		if _, ok := os.LookupEnv(name); !ok {
+			undefined = append(undefined, name)
+		}
+		return ""
+	})
+	return expanded, undefined
+}
+
+func expandEnvInValue(v interface{}, location string, errs *configErrors) interface{} {
+	switch v := v.(type) {
+	case string:
+		expanded, undefined := ExpandEnv(v)
+		for _, name := range undefined {
+			errs.add(location, "environment variable %s is not defined", name)
+		}
+		return expanded
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			l := key
+			if location != "" {
+				l = location + "." + key
+			}
+			v[key] = expandEnvInValue(v[key], l, errs)
+		}
+	case []map[string]interface{}:
+		for i, value := range v {
+			expandEnvInValue(value, fmt.Sprintf("%s[%d]", location, i), errs)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = expandEnvInValue(value, fmt.Sprintf("%s[%d]", location, i), errs)
+		}
+	}
+	return v
+}
+
 func NewConfigByArgs(args []string, fieldName string, monitorAddr string) *Config {
 	tag := args[0]
 	file := args[1]
@@ -81,25 +496,9 @@ func NewConfigByArgs(args []string, fieldName string, monitorAddr string) *Confi
 	}
 	configLogfiles := []*ConfigLogfile{configLogfile}
 
-	configServers := make([]*ConfigServer, len(servers))
-	for i, server := range servers {
-		var port int
-		host, _port, err := net.SplitHostPort(server)
-		if err != nil {
-			host = server
-			port = DefaultFluentdPort
-		} else {
-			port, _ = strconv.Atoi(_port)
-		}
-		configServers[i] = &ConfigServer{
-			Host: host,
-			Port: port,
-		}
-	}
-
 	config := &Config{
 		FieldName: fieldName,
-		Servers:   configServers,
+		Servers:   NewConfigServers(servers),
 		Logs:      configLogfiles,
 	}
 
@@ -120,10 +519,147 @@ func NewConfigByArgs(args []string, fieldName string, monitorAddr string) *Confi
 	return config
 }
 
+// NewConfigServers returns configs of servers by addresses "host[:port]".
+func NewConfigServers(servers []string) []*ConfigServer {
+	configServers := make([]*ConfigServer, len(servers))
+	for i, server := range servers {
+		var port int
+		host, _port, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+			port = DefaultFluentdPort
+		} else {
+			port, _ = strconv.Atoi(_port)
+		}
+		configServers[i] = &ConfigServer{
+			Host: host,
+			Port: port,
+		}
+	}
+	return configServers
+}
+
+// weight returns Weight, or DefaultServerWeight if Weight is not set.
+func (cs *ConfigServer) weight() int {
+	if cs.Weight == nil {
+		return DefaultServerWeight
+	}
+	return *cs.Weight
+}
+
+// standby returns true if the server is Standby or Weight is 0.
+func (cs *ConfigServer) standby() bool {
+	return cs.Standby || cs.weight() == 0
+}
+
 func (cs *ConfigServer) Restrict(c *Config) {
 	if cs.Port == 0 {
 		cs.Port = DefaultFluentdPort
 	}
+	if cs.Weight == nil {
+		weight := DefaultServerWeight
+		cs.Weight = &weight
+	}
+	switch cs.ReconnectAfterSends {
+	case 0:
+		cs.ReconnectAfterSends = DefaultReconnectAfterSends
+	case -1:
+		cs.ReconnectAfterSends = 0
+	}
+}
+
+func (cs *ConfigSecondary) Restrict(c *Config) {
+	if cs.Format == "" {
+		cs.Format = SecondaryMsgpack
+	}
+	if cs.RetryTimeout.Duration == 0 {
+		cs.RetryTimeout.Duration = DefaultSecondaryRetryTimeout
+	}
+	if cs.RotateSize == 0 {
+		cs.RotateSize = DefaultSecondaryRotateSize
+	}
+	if cs.RotateInterval.Duration == 0 {
+		cs.RotateInterval.Duration = DefaultSecondaryRotateInterval
+	}
+}
+
+func (cf *ConfigOutFile) Restrict(c *Config) {
+	if cf.Path != "" {
+		// same as paths of files found by retention
+		cf.Path = filepath.Clean(cf.Path)
+	}
+	if cf.Format == "" {
+		cf.Format = OutFileJSON
+	}
+}
+
+func (ch *ConfigOutHTTP) Restrict(c *Config) {
+	if ch.Format == "" {
+		ch.Format = OutHTTPNDJSON
+	}
+	if ch.Timeout.Duration == 0 {
+		ch.Timeout.Duration = DefaultHTTPTimeout
+	}
+	if ch.RetryWait.Duration == 0 {
+		ch.RetryWait.Duration = DefaultHTTPRetryWait
+	}
+	if ch.RetryWaitMax.Duration == 0 {
+		ch.RetryWaitMax.Duration = DefaultHTTPRetryWaitMax
+	}
+}
+
+func (ce *ConfigOutElasticsearch) Restrict(c *Config) {
+	if ce.Index == "" {
+		ce.Index = DefaultElasticsearchIndex
+	}
+	if ce.TimeKey == "" {
+		ce.TimeKey = DefaultElasticsearchTimeKey
+	}
+	if ce.Timeout.Duration == 0 {
+		ce.Timeout.Duration = DefaultHTTPTimeout
+	}
+	if ce.RetryWait.Duration == 0 {
+		ce.RetryWait.Duration = DefaultHTTPRetryWait
+	}
+	if ce.RetryWaitMax.Duration == 0 {
+		ce.RetryWaitMax.Duration = DefaultHTTPRetryWaitMax
+	}
+}
+
+func (cl *ConfigOutLoki) Restrict(c *Config) {
+	if cl.TagLabel == "" {
+		cl.TagLabel = DefaultLokiTagLabel
+	}
+	if cl.Format == "" {
+		cl.Format = LokiJSON
+	}
+	if cl.Timeout.Duration == 0 {
+		cl.Timeout.Duration = DefaultHTTPTimeout
+	}
+	if cl.RetryWait.Duration == 0 {
+		cl.RetryWait.Duration = DefaultHTTPRetryWait
+	}
+	if cl.RetryWaitMax.Duration == 0 {
+		cl.RetryWaitMax.Duration = DefaultHTTPRetryWaitMax
+	}
+}
+
+func (ch *ConfigHeartbeat) Restrict(c *Config) {
+	if ch.Type == "" {
+		ch.Type = HeartbeatTCP
+	}
+	if ch.Interval.Duration == 0 {
+		ch.Interval.Duration = DefaultHeartbeatInterval
+	}
+	if ch.Detector == "" {
+		ch.Detector = DetectorPhi
+	}
+	if ch.PhiThreshold == 0 {
+		ch.PhiThreshold = DefaultPhiThreshold
+	}
+	if ch.HardTimeout.Duration == 0 {
+		ch.HardTimeout.Duration = DefaultHardTimeout
+	}
 }
 
 func (cr *ConfigReceiver) Restrict(c *Config) {
@@ -159,6 +695,9 @@ func (cl *ConfigLogfile) Restrict(c *Config) {
 	if cl.TimeFormat == "" {
 		cl.TimeFormat = DefaultTimeFormat
 	}
+	if cl.ParseErrorTag != "" {
+		cl.ParseErrorTag = cl.Tag + "." + cl.ParseErrorTag
+	}
 }
 
 func (cr *ConfigMonitor) Restrict(c *Config) {
@@ -167,17 +706,152 @@ func (cr *ConfigMonitor) Restrict(c *Config) {
 	}
 }
 
+func (cr *ConfigRedaction) Restrict(c *Config) {
+	if cr.Match == "" {
+		cr.Match = DefaultRedactMatch
+	}
+	if cr.PartialKeep == nil {
+		keep := DefaultRedactPartialKeep
+		cr.PartialKeep = &keep
+	}
+}
+
+func (ca *ConfigAggregation) Restrict(c *Config) {
+	if ca.Match == "" {
+		ca.Match = DefaultAggregateMatch
+	}
+	if ca.Interval.Duration == 0 {
+		ca.Interval.Duration = DefaultAggregateInterval
+	}
+}
+
+// OutputGroups returns all server groups. Servers (and ServerRoundRobin) are treated as the group named DefaultServerGroup.
+func (c *Config) OutputGroups() []*ConfigServerGroup {
+	groups := make([]*ConfigServerGroup, 0, len(c.ServerGroups)+1)
+	if len(c.Servers) > 0 {
+		groups = append(groups, &ConfigServerGroup{
+			Name:               DefaultServerGroup,
+			Servers:            c.Servers,
+			RoundRobin:         c.ServerRoundRobin,
+			HashKey:            c.ServerHashKey,
+			Workers:            c.ServerWorkers,
+			OrderByTag:         c.ServerOrderByTag,
+			RequireAckResponse: c.RequireAckResponse,
+			AckResponseTimeout: c.AckResponseTimeout,
+			Heartbeat:          c.Heartbeat,
+			Secondary:          c.Secondary,
+		})
+	}
+	return append(groups, c.ServerGroups...)
+}
+
+// DefaultOutputGroup returns the name of the group which record sets not matched to any routes are sent to.
+func (c *Config) DefaultOutputGroup() string {
+	if c.DefaultGroup != "" {
+		return c.DefaultGroup
+	}
+	return DefaultServerGroup
+}
+
+// outputs returns the kinds of outputs defined in the group.
+func (g *ConfigServerGroup) outputs() []string {
+	var outputs []string
+	if len(g.Servers) > 0 {
+		outputs = append(outputs, "Servers")
+	}
+	if g.File != nil {
+		outputs = append(outputs, "File")
+	}
+	if g.HTTP != nil {
+		outputs = append(outputs, "HTTP")
+	}
+	if g.Elasticsearch != nil {
+		outputs = append(outputs, "Elasticsearch")
+	}
+	if g.Loki != nil {
+		outputs = append(outputs, "Loki")
+	}
+	return outputs
+}
+
+// numServers returns the number of servers (and endpoints of HTTP outputs) in the group, which have stats in the monitor.
+func (g *ConfigServerGroup) numServers() int {
+	n := len(g.Servers)
+	if g.HTTP != nil {
+		n += len(g.HTTP.URLs)
+	}
+	if g.Elasticsearch != nil {
+		n += len(g.Elasticsearch.URLs)
+	}
+	if g.Loki != nil {
+		n += len(g.Loki.URLs)
+	}
+	return n
+}
+
+func (c *Config) numServers() int {
+	n := 0
+	for _, group := range c.OutputGroups() {
+		n += group.numServers()
+	}
+	return n
+}
+
 func (c *Config) Restrict() {
 	if c.FieldName == "" {
 		c.FieldName = DefaultFieldName
 	}
+	if c.AckResponseTimeout.Duration == 0 {
+		c.AckResponseTimeout.Duration = DefaultAckResponseTimeout
+	}
 	for _, subconf := range c.Servers {
 		subconf.Restrict(c)
 	}
+	if c.Heartbeat != nil {
+		c.Heartbeat.Restrict(c)
+	}
+	if c.Secondary != nil {
+		c.Secondary.Restrict(c)
+	}
+	for _, group := range c.ServerGroups {
+		if group.AckResponseTimeout.Duration == 0 {
+			group.AckResponseTimeout.Duration = DefaultAckResponseTimeout
+		}
+		if group.Heartbeat != nil {
+			group.Heartbeat.Restrict(c)
+		}
+		if group.Secondary != nil {
+			group.Secondary.Restrict(c)
+		}
+		if group.File != nil {
+			group.File.Restrict(c)
+		}
+		if group.HTTP != nil {
+			group.HTTP.Restrict(c)
+		}
+		if group.Elasticsearch != nil {
+			group.Elasticsearch.Restrict(c)
+		}
+		if group.Loki != nil {
+			group.Loki.Restrict(c)
+		}
+		for _, subconf := range group.Servers {
+			subconf.Restrict(c)
+		}
+	}
 	for _, subconf := range c.Logs {
 		subconf.Restrict(c)
 	}
 	if c.Receiver != nil {
 		c.Receiver.Restrict(c)
 	}
+	if c.Buffer != nil && c.Buffer.TotalLimitSize == 0 {
+		c.Buffer.TotalLimitSize = DefaultBufferTotalLimitSize
+	}
+	for _, subconf := range c.Redactions {
+		subconf.Restrict(c)
+	}
+	for _, subconf := range c.Aggregations {
+		subconf.Restrict(c)
+	}
 }
@@ -2,7 +2,12 @@ package hydra_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fujiwara/fluent-agent-hydra/hydra"
 )
@@ -35,6 +40,10 @@ func TestReadConfig(t *testing.T) {
 	if config.Servers[1].Host != "127.0.0.1" || config.Servers[1].Port != 24225 {
 		t.Errorf("invalid Servers[1] got %#v", config.Servers[1])
 	}
+	// unset Weight is the default, and Weight = 0 is kept
+	if *config.Servers[0].Weight != hydra.DefaultServerWeight || *config.Servers[1].Weight != 0 {
+		t.Errorf("invalid Weight got %d %d", *config.Servers[0].Weight, *config.Servers[1].Weight)
+	}
 
 	if len(config.Logs) != 5 {
 		t.Errorf("invalid Logs got %#v", config.Logs)
@@ -57,7 +66,8 @@ func TestReadConfig(t *testing.T) {
 		c.File != "/tmp/baz.log" ||
 		c.TimeParse != true ||
 		c.TimeKey != "time" ||
-		c.TimeFormat != "2006-01-02T15:04:05Z07:00" {
+		c.TimeFormat != "2006-01-02T15:04:05Z07:00" ||
+		c.ParseErrorTag != "foo.ltsv.parse_error" {
 		t.Errorf("invalid Logs[2] got %#v", c)
 	}
 
@@ -85,4 +95,151 @@ func TestReadConfig(t *testing.T) {
 	if config.Monitor.Host != "127.0.0.2" || config.Monitor.Port != 24223 {
 		t.Errorf("invalid Monitor got %#v", config.Monitor)
 	}
+
+	if len(config.Redactions) != 2 {
+		t.Fatalf("invalid Redactions got %#v", config.Redactions)
+	}
+	if c := config.Redactions[0]; c.Match != "**" ||
+		c.Mode != hydra.RedactModeMask ||
+		len(c.Detectors) != 2 {
+		t.Errorf("invalid Redactions[0] got %#v", c)
+	}
+	if c := config.Redactions[1]; c.Match != "foo.ltsv" ||
+		c.Mode != hydra.RedactModeHash ||
+		c.HashKey != "secret" ||
+		len(c.Fields) != 1 {
+		t.Errorf("invalid Redactions[1] got %#v", c)
+	}
+	if len(config.Aggregations) != 1 {
+		t.Fatalf("invalid Aggregations got %#v", config.Aggregations)
+	}
+	if c := config.Aggregations[0]; c.Tag != "foo.ltsv.metrics" ||
+		c.Interval.Duration != 10*time.Second ||
+		len(c.Percentiles) != 2 || c.Percentiles[1] != 99.9 ||
+		c.DropRecords != false {
+		t.Errorf("invalid Aggregations[0] got %#v", c)
+	}
+
+	filters, err := hydra.NewFilters(config)
+	if err != nil || len(filters) != 3 {
+		t.Errorf("invalid filters got %#v %s", filters, err)
+	}
+}
+
+var includeMainConfig = `
+TagPrefix = "${HYDRA_TEST_PREFIX}"
+Include = ["conf.d/*.toml"]
+
+[[Servers]]
+Host = "${HYDRA_TEST_HOST:-127.0.0.1}"
+Port = 24224
+
+[[Logs]]
+Tag = "main"
+File = "${HYDRA_TEST_LOG_DIR}/main.log"
+`
+
+var includeSubConfig = `
+[[Servers]]
+Host = "${HYDRA_TEST_UNDEFINED}"
+Port = 24225
+
+[[Logs]]
+Tag = "sub"
+File = "/tmp/sub.log"
+
+[Receiver]
+Port = 24224
+`
+
+func TestReadConfigIncludeAndEnv(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hydra-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "hydra.toml"), []byte(includeMainConfig), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "sub.toml"), []byte(includeSubConfig), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "sub.txt"), []byte("invalid"), 0644)
+
+	os.Setenv("HYDRA_TEST_PREFIX", "env")
+	os.Setenv("HYDRA_TEST_LOG_DIR", "/var/log")
+	defer os.Unsetenv("HYDRA_TEST_PREFIX")
+	defer os.Unsetenv("HYDRA_TEST_LOG_DIR")
+
+	config, err := hydra.ReadConfig(filepath.Join(dir, "hydra.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TagPrefix != "env" {
+		t.Error("invalid TagPrefix got", config.TagPrefix)
+	}
+	if len(config.Servers) != 2 {
+		t.Fatalf("invalid Servers got %#v", config.Servers)
+	}
+	if config.Servers[0].Host != "127.0.0.1" || config.Servers[1].Port != 24225 {
+		t.Errorf("invalid Servers got %#v %#v", config.Servers[0], config.Servers[1])
+	}
+	if len(config.Logs) != 2 {
+		t.Fatalf("invalid Logs got %#v", config.Logs)
+	}
+	if config.Logs[0].File != "/var/log/main.log" || config.Logs[0].Tag != "env.main" {
+		t.Errorf("invalid Logs[0] got %#v", config.Logs[0])
+	}
+	if config.Logs[1].Tag != "env.sub" {
+		t.Errorf("invalid Logs[1] got %#v", config.Logs[1])
+	}
+
+	sub := filepath.Join(dir, "conf.d", "sub.toml")
+	expected := []string{
+		sub + ": Receiver: unknown key",
+		sub + ": Receiver.Port: unknown key",
+		sub + ": Servers[0].Host: environment variable HYDRA_TEST_UNDEFINED is not defined",
+	}
+	errs := config.Validate()
+	for _, e := range expected {
+		found := false
+		for _, err := range errs {
+			if err.Error() == e {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s is not found in %v", e, errs)
+		}
+	}
+}
+
+var invalidRedactionConfig = `
+[[Servers]]
+Host = "127.0.0.1"
+Port = 24224
+
+[[Redactions]]
+Fields = ["password"]
+Mode = "hash"
+`
+
+func TestReadConfigInvalidFilters(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hydra-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hydra.toml")
+	ioutil.WriteFile(file, []byte(invalidRedactionConfig), 0644)
+
+	// loaded to report all problems by Validate, and fails to run
+	config, err := hydra.ReadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := config.Validate(); len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "Redactions[0]: ") {
+		t.Errorf("a problem of Redactions[0] expected, got %v", errs)
+	}
+	if c, err := hydra.Run(config); err == nil {
+		c.Shutdown()
+		t.Error("Run must fail with an invalid redaction")
+	}
 }
@@ -0,0 +1,517 @@
+package hydra
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+// ConfigError is a problem of the config found by Validate.
+type ConfigError struct {
+	Location string
+	Message  string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Location + ": " + e.Message
+}
+
+type configErrors []error
+
+func (errs *configErrors) add(location, format string, args ...interface{}) {
+	*errs = append(*errs, &ConfigError{
+		Location: location,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks the whole of config and returns all problems found.
+func (c *Config) Validate() []error {
+	var errs configErrors
+	for _, p := range c.problems {
+		errs = append(errs, p)
+	}
+
+	if len(c.OutputGroups()) == 0 {
+		errs.add("Servers", "no servers are defined")
+	}
+	for i, cs := range c.Servers {
+		cs.validate(&errs, fmt.Sprintf("Servers[%d]", i))
+	}
+	validateStandby(&errs, "Servers", c.Servers)
+	validateWeight(&errs, "Servers", c.Servers, c.ServerRoundRobin || c.ServerHashKey != "")
+	if c.ServerHashKey != "" && c.ServerRoundRobin {
+		errs.add("ServerHashKey", "can't be used with ServerRoundRobin")
+	}
+	if c.ServerWorkers < 0 {
+		errs.add("ServerWorkers", "must not be negative")
+	}
+	if c.Heartbeat != nil {
+		c.Heartbeat.validate(&errs, "Heartbeat")
+	}
+	if c.Secondary != nil {
+		c.Secondary.validate(&errs, "Secondary")
+	}
+	groups := make(map[string]string)
+	if len(c.Servers) > 0 {
+		groups[DefaultServerGroup] = "Servers"
+	}
+	for i, group := range c.ServerGroups {
+		location := fmt.Sprintf("ServerGroups[%d]", i)
+		if group.Name == "" {
+			errs.add(location, "Name is required")
+		} else if prev, ok := groups[group.Name]; ok {
+			errs.add(location, "Name %s is duplicated with %s", group.Name, prev)
+		} else {
+			groups[group.Name] = location
+		}
+		switch outputs := group.outputs(); len(outputs) {
+		case 0:
+			errs.add(location, "no servers are defined")
+		case 1:
+		default:
+			errs.add(location, "only one of %s can be defined", strings.Join(outputs, ", "))
+		}
+		if group.File != nil {
+			group.File.validate(&errs, location+".File")
+		}
+		if group.HTTP != nil {
+			group.HTTP.validate(&errs, location+".HTTP")
+		}
+		if group.Elasticsearch != nil {
+			group.Elasticsearch.validate(&errs, location+".Elasticsearch")
+		}
+		if group.Loki != nil {
+			group.Loki.validate(&errs, location+".Loki")
+		}
+		if group.Heartbeat != nil {
+			group.Heartbeat.validate(&errs, location+".Heartbeat")
+		}
+		if group.Secondary != nil {
+			group.Secondary.validate(&errs, location+".Secondary")
+		}
+		for j, cs := range group.Servers {
+			cs.validate(&errs, fmt.Sprintf("%s.Servers[%d]", location, j))
+		}
+		validateStandby(&errs, location, group.Servers)
+		validateWeight(&errs, location+".Servers", group.Servers, group.RoundRobin || group.HashKey != "")
+		if group.HashKey != "" && group.RoundRobin {
+			errs.add(location, "HashKey can't be used with RoundRobin")
+		}
+		if group.Workers < 0 {
+			errs.add(location, "Workers must not be negative")
+		}
+	}
+	for i, route := range c.Routes {
+		location := fmt.Sprintf("Routes[%d]", i)
+		if _, err := NewTagMatcher(route.Match); err != nil {
+			errs.add(location, "Match: %s", err)
+		}
+		if len(route.Groups) == 0 {
+			errs.add(location, "Groups is required")
+		}
+		for _, name := range route.Groups {
+			if _, ok := groups[name]; !ok {
+				errs.add(location, "group %s is not defined", name)
+			}
+		}
+	}
+	if _, ok := groups[c.DefaultOutputGroup()]; c.DefaultGroup != "" && !ok {
+		errs.add("DefaultGroup", "group %s is not defined", c.DefaultGroup)
+	}
+
+	files := make(map[string]string)
+	for i, cl := range c.Logs {
+		location := fmt.Sprintf("Logs[%d]", i)
+		cl.validate(&errs, location)
+		if key, err := tailKey(cl); err == nil && cl.File != "" {
+			if prev, ok := files[key]; ok {
+				errs.add(location, "File %s is duplicated with %s", key, prev)
+			} else {
+				files[key] = location
+			}
+		}
+	}
+
+	if c.Receiver != nil {
+		validatePort(&errs, "Receiver", c.Receiver.Port)
+		if _, err := c.Receiver.TLSConfig(); err != nil {
+			errs.add("Receiver", "TLS: %s", err)
+		}
+		if len(c.Receiver.Users) > 0 && c.Receiver.SharedKey == "" {
+			errs.add("Receiver", "SharedKey is required for Users")
+		}
+		for i, u := range c.Receiver.Users {
+			if u.Username == "" {
+				errs.add(fmt.Sprintf("Receiver.Users[%d]", i), "Username is required")
+			}
+		}
+	}
+	if c.Monitor != nil {
+		validatePort(&errs, "Monitor", c.Monitor.Port)
+		if c.Receiver != nil && c.Receiver.Port != 0 && c.Receiver.Port == c.Monitor.Port &&
+			hostsOverlap(c.Receiver.Host, c.Monitor.Host) {
+			errs.add("Monitor", "Port %d conflicts with Receiver", c.Monitor.Port)
+		}
+	}
+
+	if c.ChunkLimitSize < 0 {
+		errs.add("ChunkLimitSize", "must not be negative")
+	}
+	if c.ChunkLimitRecords < 0 {
+		errs.add("ChunkLimitRecords", "must not be negative")
+	}
+	if c.FlushInterval.Duration < 0 {
+		errs.add("FlushInterval", "must not be negative")
+	}
+	if c.Buffer != nil {
+		if c.Buffer.Path == "" {
+			errs.add("Buffer", "Path is required")
+		} else if err := validateBufferPath(c.Buffer.Path); err != nil {
+			errs.add("Buffer", "%s", err)
+		}
+		if c.Buffer.TotalLimitSize < 0 {
+			errs.add("Buffer", "invalid TotalLimitSize %d", c.Buffer.TotalLimitSize)
+		}
+	}
+
+	for i, cr := range c.Redactions {
+		if _, err := NewRedactor(cr); err != nil {
+			errs.add(fmt.Sprintf("Redactions[%d]", i), "%s", err)
+		}
+	}
+	for i, ca := range c.Aggregations {
+		location := fmt.Sprintf("Aggregations[%d]", i)
+		if ca.Interval.Duration <= 0 {
+			errs.add(location, "Interval must be positive")
+			continue
+		}
+		if _, err := NewAggregator(ca); err != nil {
+			errs.add(location, "%s", err)
+		}
+	}
+	return errs
+}
+
+func (cs *ConfigServer) validate(errs *configErrors, location string) {
+	if cs.Host == "" {
+		errs.add(location, "Host is required")
+	}
+	validatePort(errs, location, cs.Port)
+	if _, err := cs.TLSConfig(); err != nil {
+		errs.add(location, "TLS: %s", err)
+	}
+	if cs.Username != "" && cs.SharedKey == "" {
+		errs.add(location, "SharedKey is required for Username")
+	}
+	if cs.weight() < 0 {
+		errs.add(location, "invalid Weight %d", cs.weight())
+	}
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"ConnectTimeout", cs.ConnectTimeout},
+		{"WriteTimeout", cs.WriteTimeout},
+		{"RetryWait", cs.RetryWait},
+		{"RetryWaitMax", cs.RetryWaitMax},
+		{"ReconnectInterval", cs.ReconnectInterval},
+		{"ResolveInterval", cs.ResolveInterval},
+	}
+	for _, v := range durations {
+		if v.d.Duration < 0 {
+			errs.add(location, "%s must not be negative", v.name)
+		}
+	}
+	if cs.MaxRetry < 0 {
+		errs.add(location, "MaxRetry must not be negative")
+	}
+	if cs.RetryJitter < 0 || cs.RetryJitter > 1 {
+		errs.add(location, "RetryJitter must be between 0.0 and 1.0")
+	}
+	if cs.ReconnectAfterSends < 0 {
+		errs.add(location, "invalid ReconnectAfterSends %d", cs.ReconnectAfterSends)
+	}
+	if cs.Compress != "" && cs.Compress != fluent.CompressionGzip {
+		errs.add(location, "unsupported Compress %s", cs.Compress)
+	}
+}
+
+func validateStandby(errs *configErrors, location string, servers []*ConfigServer) {
+	if len(servers) == 0 {
+		return
+	}
+	for _, cs := range servers {
+		if !cs.standby() {
+			return
+		}
+	}
+	errs.add(location, "all servers are Standby or Weight = 0")
+}
+
+// validateWeight reports Weight which is ignored because servers are not balanced by RoundRobin or HashKey.
+func validateWeight(errs *configErrors, location string, servers []*ConfigServer, balanced bool) {
+	if balanced {
+		return
+	}
+	for i, cs := range servers {
+		if w := cs.weight(); w > 0 && w != DefaultServerWeight {
+			errs.add(fmt.Sprintf("%s[%d]", location, i), "Weight %d has no effect without RoundRobin or HashKey", w)
+		}
+	}
+}
+
+func (ch *ConfigHeartbeat) validate(errs *configErrors, location string) {
+	switch ch.Type {
+	case HeartbeatTCP, HeartbeatUDP:
+	default:
+		errs.add(location, "unknown Type %s", ch.Type)
+	}
+	switch ch.Detector {
+	case DetectorPhi, DetectorThreshold:
+	default:
+		errs.add(location, "unknown Detector %s", ch.Detector)
+	}
+	if ch.Interval.Duration < 0 {
+		errs.add(location, "Interval must not be negative")
+	}
+	if ch.PhiThreshold < 0 {
+		errs.add(location, "PhiThreshold must not be negative")
+	}
+	if ch.HardTimeout.Duration < 0 {
+		errs.add(location, "HardTimeout must not be negative")
+	}
+}
+
+func (cf *ConfigOutFile) validate(errs *configErrors, location string) {
+	if cf.Path == "" {
+		errs.add(location, "Path is required")
+	} else if err := validateBufferPath(filepath.Dir(cf.Path)); err != nil {
+		errs.add(location, "%s", err)
+	}
+	switch cf.Format {
+	case OutFileJSON, OutFileLTSV, OutFileMsgpack:
+	default:
+		errs.add(location, "unknown Format %s", cf.Format)
+	}
+	if cf.Format == OutFileMsgpack && (cf.IncludeTime || cf.IncludeTag) {
+		errs.add(location, "IncludeTime and IncludeTag can't be used with Format = \"msgpack\"")
+	}
+	if cf.RotateSize < 0 {
+		errs.add(location, "invalid RotateSize %d", cf.RotateSize)
+	}
+	if cf.RotateInterval.Duration < 0 {
+		errs.add(location, "RotateInterval must not be negative")
+	}
+	if cf.Compress != "" && cf.Compress != fluent.CompressionGzip {
+		errs.add(location, "unsupported Compress %s", cf.Compress)
+	}
+	if cf.MaxAge.Duration < 0 {
+		errs.add(location, "MaxAge must not be negative")
+	}
+	if cf.MaxFiles < 0 {
+		errs.add(location, "invalid MaxFiles %d", cf.MaxFiles)
+	}
+}
+
+func (ch *ConfigOutHTTP) validate(errs *configErrors, location string) {
+	validateURLs(errs, location, ch.URLs)
+	switch ch.Format {
+	case OutHTTPNDJSON, OutHTTPJSON:
+	default:
+		errs.add(location, "unknown Format %s", ch.Format)
+	}
+	validateHTTPOptions(errs, location, ch.Compress, ch.Timeout, ch.RetryWait, ch.RetryWaitMax)
+}
+
+func (ce *ConfigOutElasticsearch) validate(errs *configErrors, location string) {
+	validateURLs(errs, location, ce.URLs)
+	if strings.Contains(ce.Index, ",") || strings.HasPrefix(ce.Index, "_") {
+		errs.add(location, "invalid Index %s", ce.Index)
+	}
+	if ce.Password != "" && ce.Username == "" {
+		errs.add(location, "Username is required for Password")
+	}
+	validateHTTPOptions(errs, location, ce.Compress, ce.Timeout, ce.RetryWait, ce.RetryWaitMax)
+}
+
+func (cl *ConfigOutLoki) validate(errs *configErrors, location string) {
+	validateURLs(errs, location, cl.URLs)
+	if !lokiLabelNameRegexp.MatchString(cl.TagLabel) {
+		errs.add(location, "invalid TagLabel %s", cl.TagLabel)
+	}
+	labels := map[string]string{cl.TagLabel: "TagLabel"}
+	for i, field := range cl.Labels {
+		name := lokiLabelName(field)
+		if field == "" {
+			errs.add(location, "Labels[%d] is empty", i)
+		} else if prev, ok := labels[name]; ok {
+			errs.add(location, "Labels[%d]: label %s is duplicated with %s", i, name, prev)
+		} else {
+			labels[name] = fmt.Sprintf("Labels[%d]", i)
+		}
+	}
+	switch cl.Format {
+	case LokiJSON:
+	case LokiProtobuf:
+		if cl.Compress != "" {
+			errs.add(location, "Compress can't be used with Format = \"protobuf\"")
+		}
+	default:
+		errs.add(location, "unknown Format %s", cl.Format)
+	}
+	if cl.Password != "" && cl.Username == "" {
+		errs.add(location, "Username is required for Password")
+	}
+	validateHTTPOptions(errs, location, cl.Compress, cl.Timeout, cl.RetryWait, cl.RetryWaitMax)
+}
+
+func validateURLs(errs *configErrors, location string, urls []string) {
+	if len(urls) == 0 {
+		errs.add(location, "URLs is required")
+	}
+	for i, u := range urls {
+		if parsed, err := url.Parse(u); err != nil {
+			errs.add(location, "URLs[%d]: %s", i, err)
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+			errs.add(location, "URLs[%d]: invalid URL %s", i, u)
+		}
+	}
+}
+
+func validateHTTPOptions(errs *configErrors, location, compress string, timeout, retryWait, retryWaitMax Duration) {
+	if compress != "" && compress != fluent.CompressionGzip {
+		errs.add(location, "unsupported Compress %s", compress)
+	}
+	if timeout.Duration < 0 {
+		errs.add(location, "Timeout must not be negative")
+	}
+	if retryWait.Duration < 0 {
+		errs.add(location, "RetryWait must not be negative")
+	}
+	if retryWaitMax.Duration < 0 {
+		errs.add(location, "RetryWaitMax must not be negative")
+	}
+}
+
+func (cs *ConfigSecondary) validate(errs *configErrors, location string) {
+	if cs.Path == "" {
+		errs.add(location, "Path is required")
+	} else if err := validateBufferPath(cs.Path); err != nil {
+		errs.add(location, "%s", err)
+	}
+	switch cs.Format {
+	case SecondaryMsgpack, SecondaryJSON:
+	default:
+		errs.add(location, "unknown Format %s", cs.Format)
+	}
+	if cs.RetryTimeout.Duration < 0 {
+		errs.add(location, "RetryTimeout must not be negative")
+	}
+	if cs.RotateSize < 0 {
+		errs.add(location, "invalid RotateSize %d", cs.RotateSize)
+	}
+	if cs.RotateInterval.Duration < 0 {
+		errs.add(location, "RotateInterval must not be negative")
+	}
+}
+
+func (cl *ConfigLogfile) validate(errs *configErrors, location string) {
+	if cl.Tag == "" {
+		errs.add(location, "Tag is required")
+	}
+	if cl.File == "" {
+		errs.add(location, "File is required")
+	} else if !cl.IsStdin() {
+		validateLogfilePath(errs, location, cl.File)
+	}
+	if cl.Format == FormatRegexp && (cl.Regexp == nil || cl.Regexp.Regexp == nil) {
+		errs.add(location, "Regexp is required for Format = \"Regexp\"")
+	}
+	if cl.Format != FormatRegexp && cl.Regexp != nil && cl.Regexp.Regexp != nil {
+		errs.add(location, "Regexp is ignored for Format = \"%s\"", cl.Format)
+	}
+	if err := cl.ConvertMap.Validate(); err != nil {
+		errs.add(location, "Types: %s", err)
+	}
+	if cl.TimeParse {
+		if err := cl.TimeFormat.Validate(); err != nil {
+			errs.add(location, "TimeFormat: %s", err)
+		}
+	}
+}
+
+func validateLogfilePath(errs *configErrors, location, file string) {
+	filename, err := Rel2Abs(file)
+	if err != nil {
+		errs.add(location, "%s", err)
+		return
+	}
+	dir := filepath.Dir(filename)
+	if st, err := os.Stat(dir); err != nil {
+		errs.add(location, "directory of File is not accessible: %s", err)
+		return
+	} else if !st.IsDir() {
+		errs.add(location, "%s is not a directory", dir)
+		return
+	}
+	// the file may be created later, so only an existing file is checked
+	if f, err := os.Open(filename); err == nil {
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		errs.add(location, "File is not readable: %s", err)
+	}
+}
+
+// validateBufferPath checks the buffer directory (or its nearest existing parent to make it) is writable.
+func validateBufferPath(path string) error {
+	for {
+		st, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			parent := filepath.Dir(path)
+			if parent == path {
+				return err
+			}
+			path = parent
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		f, err := ioutil.TempFile(path, ".hydra")
+		if err != nil {
+			return fmt.Errorf("Path is not writable: %s", err)
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
+
+func validatePort(errs *configErrors, location string, port int) {
+	if port < 0 || port > 65535 {
+		errs.add(location, "invalid Port %d", port)
+	}
+}
+
+func hostsOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+	for _, h := range []string{a, b} {
+		if h == "" {
+			return true
+		}
+		if ip := net.ParseIP(h); ip != nil && ip.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package hydra_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestValidateConfig(t *testing.T) {
+	config, err := hydra.ReadConfig("./config_test.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := config.Validate(); len(errs) != 0 {
+		t.Errorf("config_test.toml must be valid: %v", errs)
+	}
+}
+
+var invalidConfig = `
+Fromat = "x"
+
+[[Servers]]
+Port = 24224
+
+[[Logs]]
+Tag = "a"
+File = "/nonexistent/dir/a.log"
+Format = "Regexp"
+Types = "size:interger,ok:bool"
+TimeParse = true
+TimeFormat = "YYYY-MM-DD"
+
+[[Logs]]
+Tag = "b"
+File = "/tmp/b.log"
+
+[[Logs]]
+Tag = "c"
+File = "/tmp/b.log"
+
+[Receiver]
+Port = 24224
+
+[Monitor]
+Port = 24224
+
+[[Aggregations]]
+Field = "reqtime"
+`
+
+func TestValidateInvalidConfig(t *testing.T) {
+	f, _ := ioutil.TempFile(os.TempDir(), "hydra-config")
+	defer os.Remove(f.Name())
+	f.WriteString(invalidConfig)
+	f.Close()
+
+	config, err := hydra.ReadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"Fromat: unknown key",
+		"Servers[0]: Host is required",
+		"Logs[0]: directory of File is not accessible",
+		"Logs[0]: Regexp is required",
+		"Logs[0]: Types: unknown types size:interger",
+		"Logs[0]: TimeFormat:",
+		"Logs[2]: File /tmp/b.log is duplicated with Logs[1]",
+		"Monitor: Port 24224 conflicts with Receiver",
+		"Aggregations[0]: aggregation for ** requires Tag",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Errorf("%d problems expected, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if i >= len(expected) {
+			break
+		}
+		if !strings.HasPrefix(err.Error(), expected[i]) {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+}
+
+func TestTimeFormatValidate(t *testing.T) {
+	for _, f := range []hydra.TimeFormat{hydra.DefaultTimeFormat, hydra.TimeFormatApache, hydra.TimeFormatSyslog, hydra.TimeFormatUnix} {
+		if err := f.Validate(); err != nil {
+			t.Errorf("%s must be valid: %s", f, err)
+		}
+	}
+	if err := hydra.TimeFormat("YYYY-MM-DD").Validate(); err == nil {
+		t.Error("YYYY-MM-DD must be invalid")
+	}
+}
+
+func TestValidateServerGroups(t *testing.T) {
+	config := &hydra.Config{
+		Servers:       []*hydra.ConfigServer{{Host: "127.0.0.1", Port: 24224}},
+		ServerWorkers: -1,
+		ServerGroups: []*hydra.ConfigServerGroup{
+			{Name: "default", Servers: []*hydra.ConfigServer{{Host: "127.0.0.1", Port: 24225}}},
+			{Name: "security", Workers: -2, Secondary: &hydra.ConfigSecondary{Format: "xml"}},
+			{Name: "archive", File: &hydra.ConfigOutFile{Format: "msgpack", IncludeTag: true, Compress: "zip", MaxFiles: -1}},
+			{
+				Name:    "both",
+				Servers: []*hydra.ConfigServer{{Host: "127.0.0.1", Port: 24226}},
+				File:    &hydra.ConfigOutFile{Path: "/tmp/hydra/{tag}.log"},
+			},
+			{Name: "ingest", HTTP: &hydra.ConfigOutHTTP{URLs: []string{"ftp://example.com/", "http://"}, Format: "xml", Compress: "br"}},
+			{Name: "http", HTTP: &hydra.ConfigOutHTTP{}},
+			{Name: "loki", Loki: &hydra.ConfigOutLoki{URLs: []string{"http://loki:3100"}, TagLabel: "tag-name", Labels: []string{"le.vel", "le_vel"}, Format: "protobuf", Compress: "gzip"}},
+			{Name: "es", Elasticsearch: &hydra.ConfigOutElasticsearch{URLs: []string{"http://es:9200"}, Index: "_all", Password: "secret"}},
+		},
+		Routes: []*hydra.ConfigRoute{
+			{Match: "security.{a,b", Groups: []string{"unknown"}},
+		},
+		DefaultGroup: "app",
+	}
+	config.Restrict()
+	expected := []string{
+		"ServerWorkers: must not be negative",
+		"ServerGroups[0]: Name default is duplicated with Servers",
+		"ServerGroups[1]: no servers are defined",
+		"ServerGroups[1].Secondary: Path is required",
+		"ServerGroups[1].Secondary: unknown Format xml",
+		"ServerGroups[1]: Workers must not be negative",
+		"ServerGroups[2].File: Path is required",
+		"ServerGroups[2].File: IncludeTime and IncludeTag can't be used with Format = \"msgpack\"",
+		"ServerGroups[2].File: unsupported Compress zip",
+		"ServerGroups[2].File: invalid MaxFiles -1",
+		"ServerGroups[3]: only one of Servers, File can be defined",
+		"ServerGroups[4].HTTP: URLs[0]: invalid URL ftp://example.com/",
+		"ServerGroups[4].HTTP: URLs[1]: invalid URL http://",
+		"ServerGroups[4].HTTP: unknown Format xml",
+		"ServerGroups[4].HTTP: unsupported Compress br",
+		"ServerGroups[5].HTTP: URLs is required",
+		"ServerGroups[6].Loki: invalid TagLabel tag-name",
+		"ServerGroups[6].Loki: Labels[1]: label le_vel is duplicated with Labels[0]",
+		"ServerGroups[6].Loki: Compress can't be used with Format = \"protobuf\"",
+		"ServerGroups[7].Elasticsearch: invalid Index _all",
+		"ServerGroups[7].Elasticsearch: Username is required for Password",
+		"Routes[0]: Match: invalid tag pattern security.{a,b: unclosed {",
+		"Routes[0]: group unknown is not defined",
+		"DefaultGroup: group app is not defined",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Errorf("%d problems expected, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if i < len(expected) && err.Error() != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+}
+
+func TestValidateServerTimeouts(t *testing.T) {
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{
+			{
+				Host:                "127.0.0.1",
+				ConnectTimeout:      hydra.Duration{Duration: -time.Second},
+				RetryJitter:         1.5,
+				ReconnectAfterSends: -2,
+			},
+			{Host: "127.0.0.1", ReconnectAfterSends: -1},
+		},
+	}
+	config.Restrict()
+	expected := []string{
+		"Servers[0]: ConnectTimeout must not be negative",
+		"Servers[0]: RetryJitter must be between 0.0 and 1.0",
+		"Servers[0]: invalid ReconnectAfterSends -2",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Fatalf("%d problems expected, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+	if config.Servers[0].ReconnectAfterSends != -2 || config.Servers[1].ReconnectAfterSends != 0 {
+		t.Errorf("unexpected ReconnectAfterSends %d %d", config.Servers[0].ReconnectAfterSends, config.Servers[1].ReconnectAfterSends)
+	}
+}
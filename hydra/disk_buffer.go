@@ -0,0 +1,286 @@
+package hydra
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	DefaultBufferTotalLimitSize = 512 * 1024 * 1024
+	bufferChunkSuffix           = ".chunk"
+	bufferTmpSuffix             = ".tmp"
+	bufferBrokenSuffix          = ".broken"
+)
+
+var ErrBufferFull = errors.New("buffer is full")
+
+// DiskBuffer is a file based FIFO queue of FluentRecordSet.
+// Each record set is stored into a chunk file, which is written to a temporary file and renamed after synced.
+// Chunk files left in the directory are replayed in order when the buffer is opened again.
+type DiskBuffer struct {
+	dir    string
+	limit  int64
+	size   int64
+	seq    uint64
+	chunks []*bufferChunk
+	head   *fluent.FluentRecordSet
+	mu     sync.Mutex
+}
+
+type bufferChunk struct {
+	path string
+	size int64
+}
+
+// NewDiskBuffer opens the buffer directory, and loads chunk files stored in it.
+func NewDiskBuffer(dir string, limit int64) (*DiskBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	b := &DiskBuffer{
+		dir:   dir,
+		limit: limit,
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	sizes := make(map[uint64]int64)
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case strings.HasSuffix(name, bufferTmpSuffix):
+			// incomplete chunk written before crash
+			log.Println("[warning] remove incomplete buffer chunk", name)
+			os.Remove(filepath.Join(dir, name))
+		case strings.HasSuffix(name, bufferChunkSuffix):
+			seq, err := strconv.ParseUint(strings.TrimSuffix(name, bufferChunkSuffix), 10, 64)
+			if err != nil {
+				continue
+			}
+			seqs = append(seqs, seq)
+			sizes[seq] = fi.Size()
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		b.chunks = append(b.chunks, &bufferChunk{path: b.chunkPath(seq), size: sizes[seq]})
+		b.size += sizes[seq]
+		b.seq = seq
+	}
+	if len(b.chunks) > 0 {
+		log.Printf("[info] %d buffer chunks (%d bytes) found in %s", len(b.chunks), b.size, dir)
+	}
+	return b, nil
+}
+
+func (b *DiskBuffer) chunkPath(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", seq, bufferChunkSuffix))
+}
+
+// Push appends rs to the tail of buffer. When the total size exceeds the limit, ErrBufferFull is returned.
+func (b *DiskBuffer) Push(rs *fluent.FluentRecordSet) error {
+	return b.push(rs, false)
+}
+
+func (b *DiskBuffer) push(rs *fluent.FluentRecordSet, force bool) error {
+	packed, err := rs.PackAsPackedForward()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !force && b.size+int64(len(packed)) > b.limit && len(b.chunks) > 0 {
+		return ErrBufferFull
+	}
+	seq := b.seq + 1
+	path := b.chunkPath(seq)
+	if err := writeBufferChunk(path, packed); err != nil {
+		return err
+	}
+	b.seq = seq
+	b.chunks = append(b.chunks, &bufferChunk{path: path, size: int64(len(packed))})
+	b.size += int64(len(packed))
+	return nil
+}
+
+// ReplaceHead replaces the head of buffer with rs, which is the rest of the head not sent yet.
+func (b *DiskBuffer) ReplaceHead(rs *fluent.FluentRecordSet) error {
+	packed, err := rs.PackAsPackedForward()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.chunks) == 0 {
+		return errors.New("buffer is empty")
+	}
+	chunk := b.chunks[0]
+	if err := writeBufferChunk(chunk.path, packed); err != nil {
+		return err
+	}
+	b.size += int64(len(packed)) - chunk.size
+	chunk.size = int64(len(packed))
+	b.head = rs
+	return nil
+}
+
+// writeBufferChunk writes packed into a temporary file, and renames it to path after synced.
+// The directory is synced too, so the renamed chunk survives a crash.
+func writeBufferChunk(path string, packed []byte) error {
+	tmp := path + bufferTmpSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(packed); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// sync the directory to persist the rename
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Peek returns the record set at the head of buffer. It returns nil if buffer is empty.
+// Broken chunks which can't be decoded are renamed and skipped.
+func (b *DiskBuffer) Peek() *fluent.FluentRecordSet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.head == nil && len(b.chunks) > 0 {
+		chunk := b.chunks[0]
+		rs, err := readBufferChunk(chunk.path)
+		if err != nil {
+			log.Println("[error] broken buffer chunk", chunk.path, err)
+			os.Rename(chunk.path, chunk.path+bufferBrokenSuffix)
+			b.shift()
+			continue
+		}
+		b.head = rs
+	}
+	return b.head
+}
+
+// Pop removes the head of buffer.
+func (b *DiskBuffer) Pop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.chunks) == 0 {
+		return
+	}
+	if err := os.Remove(b.chunks[0].path); err != nil {
+		log.Println("[warning]", err)
+	}
+	b.shift()
+}
+
+func (b *DiskBuffer) shift() {
+	b.size -= b.chunks[0].size
+	b.chunks = b.chunks[1:]
+	b.head = nil
+}
+
+// Len returns the number of chunks in buffer.
+func (b *DiskBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.chunks)
+}
+
+// Size returns the total bytes of chunks in buffer.
+func (b *DiskBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+func readBufferChunk(path string) (*fluent.FluentRecordSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recordSets, err := fluent.DecodeEntries(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(recordSets) != 1 {
+		return nil, fmt.Errorf("unexpected %d record sets", len(recordSets))
+	}
+	return &recordSets[0], nil
+}
+
+// GroupPath returns the buffer directory for the server group.
+func (c *ConfigBuffer) GroupPath(group string) string {
+	return filepath.Join(c.Path, url.PathEscape(group))
+}
+
+// WorkerPath returns the buffer directory for the i-th sender worker of the server group.
+// The first worker uses the group directory, so the buffer is kept when the number of workers changes.
+func (c *ConfigBuffer) WorkerPath(group string, i int) string {
+	if i == 0 {
+		return c.GroupPath(group)
+	}
+	return filepath.Join(c.GroupPath(group), strconv.Itoa(i))
+}
+
+// orphanWorkerPaths returns buffer directories of workers which don't exist anymore.
+func (c *ConfigBuffer) orphanWorkerPaths(group string, workers int) []string {
+	files, err := ioutil.ReadDir(c.GroupPath(group))
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		if i, err := strconv.Atoi(fi.Name()); err == nil && i >= workers {
+			paths = append(paths, filepath.Join(c.GroupPath(group), fi.Name()))
+		}
+	}
+	return paths
+}
+
+// moveBuffer moves record sets buffered in dir to buffers chosen by tags, and removes dir.
+// Record sets are moved even if the destination is full, not to lose them.
+func moveBuffer(dir string, dest func(tag string) *DiskBuffer) error {
+	src, err := NewDiskBuffer(dir, 0)
+	if err != nil {
+		return err
+	}
+	for rs := src.Peek(); rs != nil; rs = src.Peek() {
+		if err := dest(rs.Tag).push(rs, true); err != nil {
+			return err
+		}
+		src.Pop()
+	}
+	return os.Remove(dir)
+}
@@ -0,0 +1,120 @@
+package hydra_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestDiskBuffer(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-buffer")
+	defer os.RemoveAll(dir)
+
+	b, err := hydra.NewDiskBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Peek() != nil {
+		t.Error("empty buffer must return nil")
+	}
+	for i := 1; i <= 3; i++ {
+		if err := b.Push(newDummyRecordSet(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Len() != 3 || b.Size() == 0 {
+		t.Errorf("unexpected Len %d Size %d", b.Len(), b.Size())
+	}
+	rs := b.Peek()
+	if len(rs.Records) != 1 {
+		t.Errorf("unexpected head records %d", len(rs.Records))
+	}
+	if v, _ := rs.Records[0].GetData("message"); v != "message0" {
+		t.Errorf("unexpected record %v", rs.Records[0])
+	}
+	b.Pop()
+
+	// an incomplete chunk is removed, and chunks are replayed in order after reopen
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000004.chunk.tmp"), []byte("xxx"), 0644)
+	b, err = hydra.NewDiskBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("unexpected Len %d after reopen", b.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000004.chunk.tmp")); !os.IsNotExist(err) {
+		t.Error("incomplete chunk must be removed", err)
+	}
+	for _, n := range []int{2, 3} {
+		rs := b.Peek()
+		if rs == nil || len(rs.Records) != n {
+			t.Fatalf("unexpected head %#v expected %d records", rs, n)
+		}
+		b.Pop()
+	}
+	if b.Len() != 0 || b.Size() != 0 {
+		t.Errorf("unexpected Len %d Size %d", b.Len(), b.Size())
+	}
+}
+
+func TestDiskBufferLimit(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-buffer")
+	defer os.RemoveAll(dir)
+
+	b, err := hydra.NewDiskBuffer(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first chunk is accepted even if it exceeds the limit
+	if err := b.Push(newDummyRecordSet(10)); err != nil {
+		t.Error(err)
+	}
+	if err := b.Push(newDummyRecordSet(1)); err != hydra.ErrBufferFull {
+		t.Errorf("ErrBufferFull expected got %v", err)
+	}
+	b.Pop()
+	if err := b.Push(newDummyRecordSet(1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiskBufferReplaceHead(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-buffer")
+	defer os.RemoveAll(dir)
+
+	b, err := hydra.NewDiskBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReplaceHead(newDummyRecordSet(1)); err == nil {
+		t.Error("ReplaceHead of empty buffer must fail")
+	}
+	b.Push(newDummyRecordSet(10))
+	b.Push(newDummyRecordSet(2))
+	size := b.Size()
+	if err := b.ReplaceHead(newDummyRecordSet(3)); err != nil {
+		t.Fatal(err)
+	}
+	if rs := b.Peek(); len(rs.Records) != 3 {
+		t.Errorf("unexpected head records %d", len(rs.Records))
+	}
+	if b.Len() != 2 || b.Size() >= size {
+		t.Errorf("unexpected Len %d Size %d", b.Len(), b.Size())
+	}
+
+	// the replaced head is kept in order after reopen
+	b, err = hydra.NewDiskBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{3, 2} {
+		if rs := b.Peek(); rs == nil || len(rs.Records) != n {
+			t.Fatalf("unexpected head %#v expected %d records", rs, n)
+		}
+		b.Pop()
+	}
+}
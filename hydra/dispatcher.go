@@ -0,0 +1,122 @@
+package hydra
+
+import (
+	"hash/fnv"
+	"log"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+// Dispatcher distributes record sets of a server group to sender workers in turn.
+// With OrderByTag, record sets are distributed by the hash of tags, so record sets of a tag are always sent in order by the same worker.
+type Dispatcher struct {
+	OrderByTag bool
+
+	group   string
+	next    int
+	inputCh chan *fluent.FluentRecordSet
+	outputs []chan *fluent.FluentRecordSet
+	held    *fluent.FluentRecordSet
+	stopCh  chan interface{}
+	done    chan interface{}
+}
+
+func NewDispatcher(group string, inputCh chan *fluent.FluentRecordSet, workers int) *Dispatcher {
+	d := &Dispatcher{
+		group:   group,
+		inputCh: inputCh,
+		outputs: make([]chan *fluent.FluentRecordSet, workers),
+		stopCh:  make(chan interface{}),
+		done:    make(chan interface{}),
+	}
+	for i := range d.outputs {
+		d.outputs[i] = make(chan *fluent.FluentRecordSet, MessageChannelBufferLen)
+	}
+	return d
+}
+
+// Output returns the channel for the i-th worker.
+func (d *Dispatcher) Output(i int) chan *fluent.FluentRecordSet {
+	return d.outputs[i]
+}
+
+// Worker returns the index of the worker for the tag by OrderByTag.
+func (d *Dispatcher) Worker(tag string) int {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+	return int(h.Sum32() % uint32(len(d.outputs)))
+}
+
+// worker returns the index of the worker for rs.
+func (d *Dispatcher) worker(rs *fluent.FluentRecordSet) int {
+	if d.OrderByTag {
+		return d.Worker(rs.Tag)
+	}
+	i := d.next
+	d.next = (d.next + 1) % len(d.outputs)
+	return i
+}
+
+// Split splits record sets by workers.
+func (d *Dispatcher) Split(sets []*fluent.FluentRecordSet) [][]*fluent.FluentRecordSet {
+	split := make([][]*fluent.FluentRecordSet, len(d.outputs))
+	for _, rs := range sets {
+		i := d.worker(rs)
+		split[i] = append(split[i], rs)
+	}
+	return split
+}
+
+// Stop stops dispatching and waits for finishing it.
+// Record sets which were not passed to workers yet are returned.
+func (d *Dispatcher) Stop() []*fluent.FluentRecordSet {
+	close(d.stopCh)
+	<-d.done
+	var sets []*fluent.FluentRecordSet
+	if d.held != nil {
+		sets = append(sets, d.held)
+		d.held = nil
+	}
+	for {
+		select {
+		case rs, ok := <-d.inputCh:
+			if !ok {
+				return sets
+			}
+			sets = append(sets, rs)
+		default:
+			return sets
+		}
+	}
+}
+
+func (d *Dispatcher) Run(c *Context) {
+	c.OutputProcess.Add(1)
+	defer c.OutputProcess.Done()
+	defer close(d.done)
+
+	c.StartProcess.Done()
+
+	for {
+		select {
+		case rs, ok := <-d.inputCh:
+			if !ok {
+				log.Println("[info] shutdown dispatcher for server group", d.group)
+				for _, ch := range d.outputs {
+					close(ch)
+				}
+				return
+			}
+			select {
+			case d.outputs[d.worker(rs)] <- rs:
+			case <-d.stopCh:
+				d.held = rs
+				log.Println("[info] stop dispatcher for server group", d.group)
+				return
+			}
+		case <-d.stopCh:
+			log.Println("[info] stop dispatcher for server group", d.group)
+			return
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package hydra
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+// LookupHost resolves host names of servers. It is replaceable for testing.
+var LookupHost = net.LookupHost
+
+// Endpoints is a set of connections to a server.
+// When ResolveInterval is set, the host name of the server is resolved periodically and each address becomes an endpoint.
+// Records are sent to available endpoints by round robin, and endpoints of addresses which disappeared from DNS are drained.
+type Endpoints struct {
+	Server string
+
+	config    fluent.Config
+	host      string
+	port      string
+	lookup    func(string) ([]string, error)
+	endpoints []*fluent.Fluent
+	draining  []*fluent.Fluent
+	next      int
+	mu        sync.Mutex
+	stopCh    chan interface{}
+	stopOnce  sync.Once
+}
+
+// NewEndpoints connects to the server of config. If resolveInterval is 0, the server is connected by the host name as is.
+func NewEndpoints(config fluent.Config, resolveInterval time.Duration) *Endpoints {
+	e := &Endpoints{
+		Server: config.Server,
+		config: config,
+		lookup: LookupHost,
+		stopCh: make(chan interface{}),
+	}
+	host, port, err := net.SplitHostPort(config.Server)
+	if resolveInterval <= 0 || err != nil || net.ParseIP(host) != nil {
+		e.endpoints = []*fluent.Fluent{e.connect(config.Server)}
+		return e
+	}
+	e.host, e.port = host, port
+	if e.config.TLSConfig != nil && e.config.TLSConfig.ServerName == "" {
+		// verify the certificate by the host name, not by the address
+		e.config.TLSConfig = e.config.TLSConfig.Clone()
+		e.config.TLSConfig.ServerName = host
+	}
+	addrs, err := e.resolve()
+	if err != nil {
+		log.Println("[warning]", err)
+		addrs = []string{config.Server} // resolved by fluent.Fluent on connecting
+	}
+	for _, addr := range addrs {
+		e.endpoints = append(e.endpoints, e.connect(addr))
+	}
+	go e.resolveLoop(resolveInterval)
+	return e
+}
+
+func (e *Endpoints) connect(addr string) *fluent.Fluent {
+	config := e.config
+	config.Server = addr
+	logger, err := fluent.New(config)
+	if err != nil {
+		log.Println("[warning]", err)
+		logger.Send([]byte{}) // start reconnecting
+	} else {
+		log.Println("[info] Server", addr, "connected")
+	}
+	return logger
+}
+
+func (e *Endpoints) resolve() ([]string, error) {
+	ips, err := e.lookup(e.host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses for " + e.host)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, e.port)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func (e *Endpoints) resolveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.stopCh:
+			return
+		}
+		addrs, err := e.resolve()
+		if err != nil {
+			log.Println("[warning] Couldn't resolve server. keep current endpoints.", err)
+			continue
+		}
+		e.update(addrs)
+	}
+}
+
+// update adds endpoints for new addresses, and drains endpoints of addresses which disappeared.
+func (e *Endpoints) update(addrs []string) {
+	current := make(map[string]bool)
+	for _, addr := range e.Addresses() {
+		current[addr] = true
+	}
+	resolved := make(map[string]bool)
+	var added []*fluent.Fluent
+	for _, addr := range addrs {
+		resolved[addr] = true
+		if !current[addr] {
+			log.Printf("[info] Server %s: add endpoint %s", e.Server, addr)
+			added = append(added, e.connect(addr))
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.stopCh:
+		// shutdown while connecting
+		for _, logger := range added {
+			logger.Shutdown()
+		}
+		return
+	default:
+	}
+	var endpoints []*fluent.Fluent
+	for _, logger := range e.endpoints {
+		if resolved[logger.Server] {
+			endpoints = append(endpoints, logger)
+		} else {
+			log.Printf("[info] Server %s: drain endpoint %s", e.Server, logger.Server)
+			e.draining = append(e.draining, logger)
+		}
+	}
+	endpoints = append(endpoints, added...)
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Server < endpoints[j].Server })
+	e.endpoints = endpoints
+}
+
+// Addresses returns addresses of endpoints.
+func (e *Endpoints) Addresses() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	addrs := make([]string, len(e.endpoints))
+	for i, logger := range e.endpoints {
+		addrs[i] = logger.Server
+	}
+	return addrs
+}
+
+// Send sends buffer to one of endpoints.
+func (e *Endpoints) Send(buffer []byte) error {
+	return e.send(func(logger *fluent.Fluent) error {
+		return logger.Send(buffer)
+	})
+}
+
+// SendWithAck sends buffer to one of endpoints, and waits for the ack response.
+func (e *Endpoints) SendWithAck(buffer []byte, chunk string, timeout time.Duration) error {
+	return e.send(func(logger *fluent.Fluent) error {
+		return logger.SendWithAck(buffer, chunk, timeout)
+	})
+}
+
+// send tries endpoints by round robin until fn succeeds.
+// Drained endpoints are closed here, so connections are never closed while sending.
+func (e *Endpoints) send(fn func(*fluent.Fluent) error) error {
+	e.mu.Lock()
+	draining := e.draining
+	e.draining = nil
+	endpoints := e.endpoints
+	start := e.next
+	e.next++
+	e.mu.Unlock()
+
+	for _, logger := range draining {
+		logger.Shutdown()
+	}
+	var err error
+	for n := 0; n < len(endpoints); n++ {
+		logger := endpoints[(start+n)%len(endpoints)]
+		if logger.IsReconnecting() {
+			continue
+		}
+		if err = fn(logger); err == nil {
+			if logger.Expired() {
+				logger.RefreshConnection()
+			}
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("Can't send messages, all endpoints of " + e.Server + " are reconnecting")
+	}
+	return err
+}
+
+// Heartbeat connects to endpoints in order, and returns nil if any of them accepts the connection.
+func (e *Endpoints) Heartbeat(timeout time.Duration) error {
+	e.mu.Lock()
+	endpoints := e.endpoints
+	e.mu.Unlock()
+	var err error
+	for _, logger := range endpoints {
+		if err = logger.Heartbeat(timeout); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// IsReconnecting returns true if all endpoints are reconnecting.
+func (e *Endpoints) IsReconnecting() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, logger := range e.endpoints {
+		if !logger.IsReconnecting() {
+			return false
+		}
+	}
+	return true
+}
+
+// Alive returns true if any endpoint is connected.
+func (e *Endpoints) Alive() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, logger := range e.endpoints {
+		if logger.Alive() {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Endpoints) LastErrorString() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.endpoints) == 1 {
+		return e.endpoints[0].LastErrorString()
+	}
+	var errs []string
+	for _, logger := range e.endpoints {
+		if s := logger.LastErrorString(); s != "" {
+			errs = append(errs, logger.Server+": "+s)
+		}
+	}
+	return strings.Join(errs, ", ")
+}
+
+// Shutdown stops resolving and closes all endpoints.
+func (e *Endpoints) Shutdown() {
+	e.stopOnce.Do(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		close(e.stopCh)
+		for _, logger := range e.endpoints {
+			logger.Shutdown()
+		}
+		for _, logger := range e.draining {
+			logger.Shutdown()
+		}
+		e.draining = nil
+	})
+}
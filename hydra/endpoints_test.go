@@ -0,0 +1,97 @@
+package hydra_test
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestForwardResolveEndpoints(t *testing.T) {
+	log.Println("---- TestForwardResolveEndpoints ----")
+	// two receivers on the same port of different addresses
+	receivers := make([]*hydra.Context, 2)
+	var port int
+	for i, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		c := hydra.NewContext()
+		inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+			Host:              host,
+			Port:              port,
+			MaxBufferMessages: 1000,
+		})
+		if err != nil {
+			t.Skip("couldn't listen", host, err)
+		}
+		_, p, _ := net.SplitHostPort(inForward.Addr.String())
+		port, _ = strconv.Atoi(p)
+		c.RunProcess(inForward)
+		defer c.Shutdown()
+		receivers[i] = c
+	}
+
+	var mu sync.Mutex
+	addrs := []string{"127.0.0.1"}
+	hydra.LookupHost = func(host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return addrs, nil
+	}
+	defer func() { hydra.LookupHost = net.LookupHost }()
+	setAddrs := func(a ...string) {
+		mu.Lock()
+		addrs = a
+		mu.Unlock()
+		time.Sleep(500 * time.Millisecond) // wait for resolving
+	}
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{
+		{
+			Host:            "aggregator.example.com",
+			Port:            port,
+			ResolveInterval: hydra.Duration{Duration: 100 * time.Millisecond},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	recieved := func() []int {
+		counts := make([]int, len(receivers))
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case <-receivers[0].MessageCh:
+				counts[0]++
+			case <-receivers[1].MessageCh:
+				counts[1]++
+			case <-timeout:
+				return counts
+			}
+		}
+	}
+
+	// scale out
+	setAddrs("127.0.0.1", "127.0.0.2")
+	for i := 0; i < 10; i++ {
+		c.MessageCh <- prepareRecordSet()
+	}
+	if counts := recieved(); counts[0] == 0 || counts[1] == 0 || counts[0]+counts[1] != 10 {
+		t.Errorf("record sets must be distributed to all endpoints. %v", counts)
+	}
+
+	// 127.0.0.1 disappeared from DNS
+	setAddrs("127.0.0.2")
+	for i := 0; i < 10; i++ {
+		c.MessageCh <- prepareRecordSet()
+	}
+	if counts := recieved(); counts[0] != 0 || counts[1] != 10 {
+		t.Errorf("record sets must be sent only to resolved endpoints. %v", counts)
+	}
+}
@@ -34,6 +34,7 @@ type File struct {
 	Format         FileFormat
 	RecordModifier *RecordModifier
 	Regexp         *Regexp
+	ParseErrorTag  string
 }
 
 func openFile(path string, startPos int64) (*File, error) {
@@ -59,6 +60,7 @@ func openFile(path string, startPos int64) (*File, error) {
 		FormatNone,
 		nil,
 		nil,
+		"",
 	}
 
 	if startPos == SEEK_TAIL {
@@ -122,7 +124,14 @@ func (f *File) tailAndSend(messageCh chan *fluent.FluentRecordSet, monitorCh cha
 				copy(f.contBuf, f.readBuf[blockLen+1:n])
 			}
 		}
-		messageCh <- NewFluentRecordSet(f.Tag, f.FieldName, f.Format, f.RecordModifier, f.Regexp, sendBuf)
+		recordSet, errorSet, parseErrors := NewFluentRecordSetWithErrors(f.Tag, f.FieldName, f.ParseErrorTag, f.Format, f.RecordModifier, f.Regexp, sendBuf)
+		if len(recordSet.Records) > 0 {
+			messageCh <- recordSet
+		}
+		if errorSet != nil {
+			messageCh <- errorSet
+		}
+		f.FileStat.ParseErrors += parseErrors
 		monitorCh <- f.UpdateStat()
 	}
 }
@@ -106,6 +106,7 @@ func (c TimeConverter) Convert(v string) (time.Time, error) {
 type ConvertMap struct {
 	TypeMap      map[string]ConvertType
 	ConverterMap map[string]Converter
+	invalid      []string
 }
 
 type RecordModifier struct {
@@ -177,6 +178,9 @@ func NewConvertMap(config string) ConvertMap {
 	for _, subdef := range strings.Split(config, ",") {
 		def := strings.SplitN(subdef, ":", 2)
 		if len(def) < 2 {
+			if subdef != "" {
+				m.invalid = append(m.invalid, subdef)
+			}
 			continue
 		}
 		key := def[0]
@@ -190,12 +194,22 @@ func NewConvertMap(config string) ConvertMap {
 		case "float":
 			m.TypeMap[key] = ConvertTypeFloat
 			m.ConverterMap[key] = convertFloat
+		case "string":
 		default:
+			m.invalid = append(m.invalid, subdef)
 		}
 	}
 	return m
 }
 
+// Validate returns an error when the definition includes unknown types.
+func (c ConvertMap) Validate() error {
+	if len(c.invalid) > 0 {
+		return fmt.Errorf("unknown types %s (available: integer, float, bool, string)", strings.Join(c.invalid, ","))
+	}
+	return nil
+}
+
 func (c ConvertMap) ConvertTypes(data map[string]interface{}) {
 	for key, converter := range c.ConverterMap {
 		if _value, ok := data[key]; ok {
@@ -227,6 +241,23 @@ func (c ConvertMap) ConvertTypes(data map[string]interface{}) {
 	}
 }
 
+// Validate returns an error when t is not a valid layout for time.Parse.
+func (t TimeFormat) Validate() error {
+	if t == TimeFormatUnix {
+		return nil
+	}
+	layout := string(t)
+	t1 := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	t2 := time.Date(2012, time.November, 13, 14, 15, 16, 0, time.UTC)
+	if t1.Format(layout) == t2.Format(layout) {
+		return fmt.Errorf("time format %q has no time elements", layout)
+	}
+	if _, err := time.Parse(layout, t1.Format(layout)); err != nil {
+		return fmt.Errorf("time format %q is invalid: %s", layout, err)
+	}
+	return nil
+}
+
 func (t *TimeFormat) UnmarshalText(text []byte) error {
 	switch strings.ToLower(string(text)) {
 	case "apache":
@@ -0,0 +1,115 @@
+package hydra
+
+import (
+	"log"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	FilterFlushInterval = 1 * time.Second
+)
+
+// Filter modifies a FluentRecordSet between inputs and outputs.
+// Filter returns nil to drop the record set.
+type Filter interface {
+	Filter(*fluent.FluentRecordSet) *fluent.FluentRecordSet
+}
+
+// Flusher is a Filter which emits records by itself.
+// Flush is called every FilterFlushInterval, and called with force = true on shutdown.
+type Flusher interface {
+	Flush(now time.Time, force bool) []*fluent.FluentRecordSet
+}
+
+// FilterProcess recieve FluentRecordSet from inputs, apply filters and pass it to outputs.
+type FilterProcess struct {
+	filters   []Filter
+	inputCh   chan *fluent.FluentRecordSet
+	outputCh  chan *fluent.FluentRecordSet
+	replaceCh chan []Filter
+}
+
+func NewFilterProcess(filters []Filter) *FilterProcess {
+	return &FilterProcess{
+		filters:   filters,
+		replaceCh: make(chan []Filter),
+	}
+}
+
+// Replace replaces the running filters. Records held by old filters (aggregations) are flushed before replacing.
+func (p *FilterProcess) Replace(filters []Filter) {
+	p.replaceCh <- filters
+}
+
+// NewFilters creates filters defined in config.
+func NewFilters(config *Config) ([]Filter, error) {
+	filters := make([]Filter, 0)
+	for _, cr := range config.Redactions {
+		r, err := NewRedactor(cr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, r)
+	}
+	for _, ca := range config.Aggregations {
+		a, err := NewAggregator(ca)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, a)
+	}
+	return filters, nil
+}
+
+func (p *FilterProcess) Run(c *Context) {
+	c.OutputProcess.Add(1)
+	defer c.OutputProcess.Done()
+	p.inputCh = c.MessageCh
+	p.outputCh = c.OutputCh
+
+	c.StartProcess.Done()
+
+	ticker := time.NewTicker(FilterFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case rs, ok := <-p.inputCh:
+			if !ok {
+				p.flush(time.Now(), true)
+				log.Println("[info] shutdown filters")
+				close(p.outputCh)
+				return
+			}
+			if rs = p.apply(rs); rs != nil {
+				p.outputCh <- rs
+			}
+		case now := <-ticker.C:
+			p.flush(now, false)
+		case filters := <-p.replaceCh:
+			p.flush(time.Now(), true)
+			p.filters = filters
+			log.Printf("[info] %d filters reloaded", len(filters))
+		}
+	}
+}
+
+func (p *FilterProcess) flush(now time.Time, force bool) {
+	for _, f := range p.filters {
+		if flusher, ok := f.(Flusher); ok {
+			for _, rs := range flusher.Flush(now, force) {
+				p.outputCh <- rs
+			}
+		}
+	}
+}
+
+func (p *FilterProcess) apply(rs *fluent.FluentRecordSet) *fluent.FluentRecordSet {
+	for _, f := range p.filters {
+		if rs = f.Filter(rs); rs == nil {
+			return nil
+		}
+	}
+	return rs
+}
@@ -0,0 +1,53 @@
+package hydra_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+type dropFilter struct {
+	tag string
+}
+
+func (f dropFilter) Filter(rs *fluent.FluentRecordSet) *fluent.FluentRecordSet {
+	if rs.Tag == f.tag {
+		return nil
+	}
+	return rs
+}
+
+func TestFilterProcess(t *testing.T) {
+	c := hydra.NewContext()
+	c.EnableFilters([]hydra.Filter{dropFilter{"drop"}})
+	if c.OutputCh == c.MessageCh {
+		t.Fatal("OutputCh must be separated from MessageCh")
+	}
+	go func() {
+		for _, tag := range []string{"drop", "pass", "drop", "pass"} {
+			c.MessageCh <- &fluent.FluentRecordSet{Tag: tag}
+		}
+		c.Shutdown()
+	}()
+	n := 0
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case rs, ok := <-c.OutputCh:
+			if !ok {
+				if n != 2 {
+					t.Errorf("passed %d record sets expected 2", n)
+				}
+				return
+			}
+			if rs.Tag != "pass" {
+				t.Errorf("unexpected tag %s", rs.Tag)
+			}
+			n++
+		case <-timeout:
+			t.Fatal("timeout")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package hydra_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestForwardHandshake(t *testing.T) {
+	log.Println("---- TestForwardHandshake ----")
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+		SharedKey:         "secret",
+		SelfHostname:      "aggregator",
+		Users: []*hydra.ConfigUser{
+			{Username: "hydra", Password: "pass"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	invalids := []*hydra.ConfigServer{
+		{SharedKey: "wrong", Username: "hydra", Password: "pass"},
+		{SharedKey: "secret", Username: "hydra", Password: "wrong"},
+		{SharedKey: "secret"},
+	}
+	for i, server := range invalids {
+		s := newConfigServer(inForward.Addr.String())
+		s.SharedKey, s.Username, s.Password = server.SharedKey, server.Username, server.Password
+		c := hydra.NewContext()
+		outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.RunProcess(outForward)
+		c.MessageCh <- prepareRecordSet()
+		select {
+		case <-receiver.MessageCh:
+			t.Errorf("records from an unauthenticated client #%d must be rejected", i)
+		case <-time.After(time.Second):
+		}
+		if pending := outForward.Stop(); len(pending) != 1 {
+			t.Errorf("records must be pending, got %d record sets", len(pending))
+		}
+		c.Shutdown()
+	}
+
+	server := newConfigServer(inForward.Addr.String())
+	server.SharedKey = "secret"
+	server.SelfHostname = "hydra-agent"
+	server.Username = "hydra"
+	server.Password = "pass"
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+	c.MessageCh <- prepareRecordSet()
+	select {
+	case rs := <-receiver.MessageCh:
+		if len(rs.Records) != len(TestMessageLines) {
+			t.Errorf("recieved %d records expected %d", len(rs.Records), len(TestMessageLines))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("records were not recieved after handshake")
+	}
+}
+
+func TestValidateHandshake(t *testing.T) {
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{
+			{Host: "127.0.0.1", Username: "hydra"},
+		},
+		Receiver: &hydra.ConfigReceiver{
+			Users: []*hydra.ConfigUser{{Password: "pass"}},
+		},
+	}
+	config.Restrict()
+	expected := []string{
+		"Servers[0]: SharedKey is required for Username",
+		"Receiver: SharedKey is required for Users",
+		"Receiver.Users[0]: Username is required",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Fatalf("%d problems expected, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+}
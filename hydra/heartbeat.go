@@ -0,0 +1,111 @@
+package hydra
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	HeartbeatTCP      = "tcp"
+	HeartbeatUDP      = "udp"
+	DetectorPhi       = "phi"
+	DetectorThreshold = "threshold"
+
+	heartbeatSampleSize = 100
+	minStdDeviation     = 100 * time.Millisecond
+)
+
+// FailureDetector decides whether a server is available by arrival times of heartbeats.
+// It implements the phi accrual failure detector, which assumes intervals of heartbeats follow a normal distribution.
+// If PhiThreshold is 0, a server is available until HardTimeout passed since the last heartbeat.
+// A server is not available until the first heartbeat arrives.
+type FailureDetector struct {
+	PhiThreshold float64
+	HardTimeout  time.Duration
+
+	last      time.Time
+	received  bool
+	intervals []float64 // seconds
+}
+
+func NewFailureDetector(phiThreshold float64, hardTimeout time.Duration, now time.Time) *FailureDetector {
+	return &FailureDetector{
+		PhiThreshold: phiThreshold,
+		HardTimeout:  hardTimeout,
+		last:         now,
+	}
+}
+
+// Heartbeat records a heartbeat arrived at now.
+func (d *FailureDetector) Heartbeat(now time.Time) {
+	if d.received {
+		d.intervals = append(d.intervals, now.Sub(d.last).Seconds())
+		if len(d.intervals) > heartbeatSampleSize {
+			d.intervals = d.intervals[1:]
+		}
+	}
+	d.last = now
+	d.received = true
+}
+
+// Phi returns the suspicion level that the server is down at now.
+// phi = 1 means the probability of a mistake is about 10%, phi = 2 means 1%, and so on.
+func (d *FailureDetector) Phi(now time.Time) float64 {
+	if len(d.intervals) == 0 {
+		return 0
+	}
+	var sum, sqsum float64
+	for _, v := range d.intervals {
+		sum += v
+		sqsum += v * v
+	}
+	n := float64(len(d.intervals))
+	mean := sum / n
+	std := math.Sqrt(math.Max(sqsum/n-mean*mean, 0))
+	if std < minStdDeviation.Seconds() {
+		std = minStdDeviation.Seconds()
+	}
+	elapsed := now.Sub(d.last).Seconds()
+	// probability that the next heartbeat arrives later than now
+	pLater := 0.5 * math.Erfc((elapsed-mean)/(std*math.Sqrt2))
+	return -math.Log10(pLater)
+}
+
+// Available returns true if the server seems available at now.
+func (d *FailureDetector) Available(now time.Time) bool {
+	if !d.received {
+		return false
+	}
+	if d.HardTimeout > 0 && now.Sub(d.last) > d.HardTimeout {
+		return false
+	}
+	return d.PhiThreshold <= 0 || d.Phi(now) <= d.PhiThreshold
+}
+
+// NewFailureDetector returns a FailureDetector by the config.
+func (ch *ConfigHeartbeat) NewFailureDetector(now time.Time) *FailureDetector {
+	threshold := ch.PhiThreshold
+	if ch.Detector == DetectorThreshold {
+		threshold = 0
+	}
+	return NewFailureDetector(threshold, ch.HardTimeout.Duration, now)
+}
+
+// sendHeartbeat checks the server of endpoints by TCP connect (with TLS and SharedKey handshakes) or UDP ping (which in_forward echoes).
+func sendHeartbeat(typ string, endpoints *Endpoints, timeout time.Duration) error {
+	if typ != HeartbeatUDP {
+		return endpoints.Heartbeat(timeout)
+	}
+	conn, err := net.DialTimeout("udp", endpoints.Server, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
@@ -0,0 +1,133 @@
+package hydra_test
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestFailureDetector(t *testing.T) {
+	start := time.Now()
+	d := hydra.NewFailureDetector(16, 10*time.Second, start)
+	now := start
+	for i := 0; i < 20; i++ {
+		now = now.Add(100 * time.Millisecond)
+		d.Heartbeat(now)
+	}
+	if phi := d.Phi(now.Add(100 * time.Millisecond)); phi > 1 {
+		t.Errorf("phi %f at the expected interval must be low", phi)
+	}
+	if !d.Available(now.Add(500 * time.Millisecond)) {
+		t.Error("must be available at 500ms after the last heartbeat")
+	}
+	if d.Available(now.Add(2 * time.Second)) {
+		t.Errorf("must not be available at 2s after the last heartbeat. phi %f", d.Phi(now.Add(2*time.Second)))
+	}
+
+	// threshold based
+	d = hydra.NewFailureDetector(0, time.Second, start)
+	if d.Available(start.Add(100 * time.Millisecond)) {
+		t.Error("must not be available before the first heartbeat")
+	}
+	d.Heartbeat(start.Add(200 * time.Millisecond))
+	if !d.Available(start.Add(1100 * time.Millisecond)) {
+		t.Error("must be available until HardTimeout")
+	}
+	if d.Available(start.Add(1300 * time.Millisecond)) {
+		t.Error("must not be available after HardTimeout")
+	}
+	d.Heartbeat(start.Add(1400 * time.Millisecond))
+	if !d.Available(start.Add(1500 * time.Millisecond)) {
+		t.Error("must be available again after heartbeat")
+	}
+}
+
+func TestForwardHeartbeat(t *testing.T) {
+	log.Println("---- TestForwardHeartbeat ----")
+	// a hung server accepts connections but never processes records, and doesn't respond to UDP heartbeats
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+	go func() {
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{
+		newConfigServer(hung.Addr().String()),
+		newConfigServer(inForward.Addr.String()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.Heartbeat = &hydra.ConfigHeartbeat{
+		Type:         hydra.HeartbeatUDP,
+		Interval:     hydra.Duration{Duration: 100 * time.Millisecond},
+		Detector:     hydra.DetectorPhi,
+		PhiThreshold: 16,
+		HardTimeout:  hydra.Duration{Duration: 500 * time.Millisecond},
+	}
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	time.Sleep(time.Second)
+	c.MessageCh <- prepareRecordSet()
+	select {
+	case rs := <-receiver.MessageCh:
+		if len(rs.Records) != len(TestMessageLines) {
+			t.Errorf("recieved %d records expected %d", len(rs.Records), len(TestMessageLines))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("records must be sent to the server alive by heartbeat")
+	}
+}
+
+func TestValidateHeartbeat(t *testing.T) {
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{
+			{Host: "127.0.0.1"},
+		},
+		Heartbeat: &hydra.ConfigHeartbeat{
+			Type:     "icmp",
+			Detector: "magic",
+		},
+	}
+	config.Restrict()
+	expected := []string{
+		"Heartbeat: unknown Type icmp",
+		"Heartbeat: unknown Detector magic",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Fatalf("%d problems expected, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+}
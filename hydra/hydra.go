@@ -3,6 +3,8 @@ package hydra
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"runtime"
 	"strings"
@@ -19,6 +21,7 @@ const (
 	LTSVColSeparatorStr     = "\t"
 	LTSVDataSeparatorStr    = ":"
 	StdinFilename           = "-"
+	ParseErrorKey           = "error"
 )
 
 var (
@@ -29,6 +32,20 @@ type Process interface {
 	Run(*Context)
 }
 
+// Output is a process which sends record sets of a server group.
+// Stop stops it and returns record sets which are not sent yet.
+type Output interface {
+	Process
+	Stop() []*fluent.FluentRecordSet
+}
+
+// runningOutput is an Output running for the group, which reads record sets from messageCh.
+type runningOutput struct {
+	Output
+	group     string
+	messageCh chan *fluent.FluentRecordSet
+}
+
 type Signal struct {
 	message string
 }
@@ -50,69 +67,124 @@ func NewSignal(message string) Signal {
 
 type Context struct {
 	MessageCh     chan *fluent.FluentRecordSet
+	OutputCh      chan *fluent.FluentRecordSet
 	MonitorCh     chan Stat
 	ControlCh     chan interface{}
 	InputProcess  sync.WaitGroup
 	OutputProcess sync.WaitGroup
 	StartProcess  sync.WaitGroup
+
+	// running processes for reloading
+	config        *Config
+	monitor       *Monitor
+	filterProcess *FilterProcess
+	router        *Router
+	dispatchers   []*Dispatcher
+	outputs       []*runningOutput
+	watcher       *Watcher
+	tails         map[string]*InTail
+	inForward     *InForward
+	reloadMu      sync.Mutex
 }
 
 func NewContext() *Context {
+	messageCh := make(chan *fluent.FluentRecordSet, MessageChannelBufferLen)
 	return &Context{
-		MessageCh: make(chan *fluent.FluentRecordSet, MessageChannelBufferLen),
+		MessageCh: messageCh,
+		OutputCh:  messageCh, // inputs are connected to outputs directly until filters are enabled
 		MonitorCh: make(chan Stat, MonitorChannelBufferLen),
 		ControlCh: make(chan interface{}),
+		tails:     make(map[string]*InTail),
 	}
 }
 
+// EnableFilters inserts the filters between inputs and outputs. It must be called before running outputs.
+func (c *Context) EnableFilters(filters []Filter) {
+	if len(filters) == 0 {
+		return
+	}
+	c.OutputCh = make(chan *fluent.FluentRecordSet, MessageChannelBufferLen)
+	c.filterProcess = NewFilterProcess(filters)
+	c.RunProcess(c.filterProcess)
+}
+
 func (c *Context) RunProcess(p Process) {
 	c.StartProcess.Add(1)
 	go p.Run(c)
 }
 
 func NewFluentRecordSet(tag, key string, format FileFormat, mod *RecordModifier, reg *Regexp, buffer []byte) *fluent.FluentRecordSet {
+	recordSet, _, _ := NewFluentRecordSetWithErrors(tag, key, "", format, mod, reg, buffer)
+	return recordSet
+}
+
+// NewFluentRecordSetWithErrors works like NewFluentRecordSet, and also counts lines which couldn't be parsed.
+// When errorTag is not empty, those lines are not included in recordSet but
+// returned as errorSet tagged errorTag, with the raw line under key and the reason under ParseErrorKey.
+func NewFluentRecordSetWithErrors(tag, key, errorTag string, format FileFormat, mod *RecordModifier, reg *Regexp, buffer []byte) (recordSet *fluent.FluentRecordSet, errorSet *fluent.FluentRecordSet, parseErrors int64) {
 	t := time.Now()
 	messages := bytes.Split(buffer, LineSeparator)
 	records := make([]fluent.FluentRecordType, 0, len(messages))
+	var errorRecords []fluent.FluentRecordType
 	for _, msg := range messages {
+		var (
+			r   *fluent.TinyFluentRecord
+			err error
+		)
 		switch format {
 		default:
-			r := &fluent.TinyFluentMessage{
+			records = append(records, &fluent.TinyFluentMessage{
 				Timestamp: t,
 				FieldName: key,
 				Message:   msg,
-			}
-			records = append(records, r)
+			})
+			continue
 		case FormatLTSV:
-			r := NewFluentRecordLTSV(key, msg)
-			r.Timestamp = t
-			if mod != nil {
-				mod.Modify(r)
-			}
-			records = append(records, r)
+			r, err = parseLTSV(key, msg)
 		case FormatJSON:
-			r := NewFluentRecordJSON(key, msg)
-			r.Timestamp = t
-			if mod != nil {
-				mod.Modify(r)
-			}
-			records = append(records, r)
+			r, err = parseJSON(key, msg)
 		case FormatRegexp:
-			r := NewFluentRecordRegexp(key, msg, reg)
-			r.Timestamp = t
-			if mod != nil {
-				mod.Modify(r)
+			r, err = parseRegexp(key, msg, reg)
+		}
+		r.Timestamp = t
+		if err != nil {
+			parseErrors++
+			if errorTag != "" {
+				errorRecords = append(errorRecords, &fluent.TinyFluentRecord{
+					Timestamp: t,
+					Data: map[string]interface{}{
+						key:           string(msg),
+						ParseErrorKey: err.Error(),
+					},
+				})
+				continue
 			}
-			records = append(records, r)
 		}
+		if mod != nil {
+			mod.Modify(r)
+		}
+		records = append(records, r)
 	}
-	return &fluent.FluentRecordSet{
+	recordSet = &fluent.FluentRecordSet{
 		Tag:     tag,
 		Records: records,
 	}
+	if len(errorRecords) > 0 {
+		errorSet = &fluent.FluentRecordSet{
+			Tag:     errorTag,
+			Records: errorRecords,
+		}
+	}
+	return
 }
 
 func NewFluentRecordLTSV(key string, line []byte) *fluent.TinyFluentRecord {
+	r, _ := parseLTSV(key, line)
+	return r
+}
+
+func parseLTSV(key string, line []byte) (*fluent.TinyFluentRecord, error) {
+	var err error
 	s := string(line)
 	data := make(map[string]interface{})
 	for _, col := range strings.Split(s, LTSVColSeparatorStr) {
@@ -126,25 +198,38 @@ func NewFluentRecordLTSV(key string, line []byte) *fluent.TinyFluentRecord {
 		} else {
 			// invalid LTSV format.
 			data[key] = s
+			err = fmt.Errorf("invalid LTSV column: %q", col)
 		}
 	}
-	return &fluent.TinyFluentRecord{Data: data}
+	return &fluent.TinyFluentRecord{Data: data}, err
 }
 
 func NewFluentRecordJSON(key string, line []byte) *fluent.TinyFluentRecord {
+	r, _ := parseJSON(key, line)
+	return r
+}
+
+func parseJSON(key string, line []byte) (*fluent.TinyFluentRecord, error) {
 	data := make(map[string]interface{})
 	err := json.Unmarshal(line, &data)
 	if err != nil {
 		data[key] = string(line)
 	}
-	return &fluent.TinyFluentRecord{Data: data}
+	return &fluent.TinyFluentRecord{Data: data}, err
 }
 
 func NewFluentRecordRegexp(key string, line []byte, r *Regexp) *fluent.TinyFluentRecord {
+	record, _ := parseRegexp(key, line, r)
+	return record
+}
+
+func parseRegexp(key string, line []byte, r *Regexp) (*fluent.TinyFluentRecord, error) {
+	var err error
 	s := string(line)
 	data := make(map[string]interface{})
 	if match := r.FindStringSubmatch(s); match == nil {
 		data[key] = s
+		err = errors.New("regexp not matched")
 	} else {
 		for i, name := range r.SubexpNames() {
 			if i != 0 {
@@ -152,12 +237,58 @@ func NewFluentRecordRegexp(key string, line []byte, r *Regexp) *fluent.TinyFluen
 			}
 		}
 	}
-	return &fluent.TinyFluentRecord{Data: data}
+	return &fluent.TinyFluentRecord{Data: data}, err
 }
 
-func Run(config *Config) *Context {
+// Run starts all processes of config. It fails when filters can't be built,
+// not to send records without redaction.
+func Run(config *Config) (*Context, error) {
+	filters, err := NewFilters(config)
+	if err != nil {
+		return nil, err
+	}
 	c := NewContext()
+	c.config = config
+	applyGlobalConfig(config)
+
+	// start monitor server
+	monitor, err := NewMonitor(config)
+	if err != nil {
+		log.Println("[error] Couldn't start monitor server.", err)
+	} else {
+		c.monitor = monitor
+		c.RunProcess(monitor)
+	}
 
+	// start filters
+	c.EnableFilters(filters)
+
+	// start router && out_forward
+	c.startOutputs(config, nil)
+
+	// start watcher && in_tail
+	watcher, err := NewWatcher()
+	if err != nil {
+		log.Println("[error]", err)
+	}
+	c.watcher = watcher
+	for _, configLogfile := range config.Logs {
+		c.startInTail(configLogfile, nil)
+	}
+	c.startWatcher()
+
+	// start in_forward
+	if config.Receiver != nil {
+		if runtime.GOMAXPROCS(0) < 2 {
+			log.Println("[warning] When using Receiver, recommend to set GOMAXPROCS >= 2.")
+		}
+		c.startInForward(config.Receiver, nil)
+	}
+	c.StartProcess.Wait()
+	return c, nil
+}
+
+func applyGlobalConfig(config *Config) {
 	if config.SubSecondTime {
 		fluent.EnableEventTime = true
 		log.Println("[info] SubSecondTime enabled. (for Fluentd 0.14 or later only!)")
@@ -167,61 +298,283 @@ func Run(config *Config) *Context {
 		ReadBufferSize = config.ReadBufferSize
 		log.Println("[info] set ReadBufferSize", ReadBufferSize)
 	}
+}
 
-	// start monitor server
-	monitor, err := NewMonitor(config)
-	if err != nil {
-		log.Println("[error] Couldn't start monitor server.", err)
-	} else {
-		c.RunProcess(monitor)
+// startOutputs starts a router and out_forward for each server group.
+// Record sets in undelivered are sent to the same group at first, or routed again if the group is removed.
+func (c *Context) startOutputs(config *Config, undelivered map[string][]*fluent.FluentRecordSet) {
+	router := NewRouter(config)
+	statIndex := 0
+	groups := make(map[string]bool)
+	for _, group := range config.OutputGroups() {
+		groups[group.Name] = true
+		switch {
+		case group.File != nil:
+			c.startOutFile(group, router.Output(group.Name), undelivered[group.Name])
+		case group.HTTP != nil:
+			outHTTP := NewOutHTTP(group.HTTP)
+			log.Printf("[info] out_http (%s) enabled for server group %s", group.HTTP.Format, group.Name)
+			c.startOutHTTP(config, group, outHTTP, router.Output(group.Name), statIndex, undelivered[group.Name])
+		case group.Elasticsearch != nil:
+			outHTTP := NewOutElasticsearch(group.Elasticsearch)
+			log.Printf("[info] out_elasticsearch enabled for server group %s index %s", group.Name, group.Elasticsearch.Index)
+			c.startOutHTTP(config, group, outHTTP, router.Output(group.Name), statIndex, undelivered[group.Name])
+		case group.Loki != nil:
+			outHTTP := NewOutLoki(group.Loki)
+			log.Printf("[info] out_loki (%s) enabled for server group %s", group.Loki.Format, group.Name)
+			c.startOutHTTP(config, group, outHTTP, router.Output(group.Name), statIndex, undelivered[group.Name])
+		default:
+			c.startOutForward(config, group, router.Output(group.Name), statIndex, undelivered[group.Name])
+		}
+		statIndex += group.numServers()
 	}
-
-	// start out_forward
-	outForward, err := NewOutForward(config.Servers)
-	if err != nil {
-		log.Println("[error]", err)
-	} else {
-		outForward.RoundRobin = config.ServerRoundRobin
-		if outForward.RoundRobin {
-			log.Println("[info] ServerRoundRobin enabled")
+	var rest []*fluent.FluentRecordSet
+	for name, sets := range undelivered {
+		if !groups[name] {
+			rest = append(rest, sets...)
 		}
-		c.RunProcess(outForward)
 	}
+	router.TakeOver(rest)
+	c.router = router
+	c.RunProcess(router)
+}
 
-	// start watcher && in_tail
-	if len(config.Logs) > 0 {
-		watcher, err := NewWatcher()
+func (c *Context) startOutForward(config *Config, group *ConfigServerGroup, messageCh chan *fluent.FluentRecordSet, statIndex int, pending []*fluent.FluentRecordSet) {
+	workers := group.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var dispatcher *Dispatcher
+	pendings := [][]*fluent.FluentRecordSet{pending}
+	if workers > 1 {
+		dispatcher = NewDispatcher(group.Name, messageCh, workers)
+		dispatcher.OrderByTag = group.OrderByTag
+		pendings = dispatcher.Split(pending)
+	}
+	outForwards := make([]*OutForward, workers)
+	for i := range outForwards {
+		outForward, err := c.newOutForward(config, group, i, workers)
 		if err != nil {
 			log.Println("[error]", err)
+			for _, f := range outForwards[:i] {
+				f.shutdownLoggers()
+			}
+			return
+		}
+		outForward.statIndex = statIndex
+		outForward.messageCh = messageCh
+		if dispatcher != nil {
+			outForward.messageCh = dispatcher.Output(i)
 		}
-		for _, configLogfile := range config.Logs {
-			tail, err := NewInTail(configLogfile, watcher)
+		outForward.TakeOver(pendings[i])
+		outForwards[i] = outForward
+	}
+	if buffer := config.Buffer; buffer != nil && outForwards[0].buffer != nil {
+		for _, dir := range buffer.orphanWorkerPaths(group.Name, workers) {
+			log.Println("[info] move buffer of removed worker", dir)
+			err := moveBuffer(dir, func(tag string) *DiskBuffer {
+				if dispatcher == nil {
+					return outForwards[0].buffer
+				}
+				return outForwards[dispatcher.Worker(tag)].buffer
+			})
 			if err != nil {
-				log.Println("[error]", err)
-			} else {
-				c.RunProcess(tail)
+				log.Println("[error] Couldn't move buffer.", err)
 			}
 		}
-		c.RunProcess(watcher)
 	}
 
-	// start in_forward
-	if config.Receiver != nil {
-		if runtime.GOMAXPROCS(0) < 2 {
-			log.Println("[warning] When using Receiver, recommend to set GOMAXPROCS >= 2.")
+	if outForwards[0].buffer != nil {
+		log.Println("[info] Buffer enabled for server group", group.Name, config.Buffer.GroupPath(group.Name))
+	}
+	if group.RoundRobin {
+		log.Println("[info] RoundRobin enabled for server group", group.Name)
+	}
+	if group.HashKey != "" {
+		log.Printf("[info] Consistent hashing by %s enabled for server group %s", group.HashKey, group.Name)
+	}
+	if group.RequireAckResponse {
+		log.Println("[info] RequireAckResponse enabled for server group", group.Name)
+	}
+	if group.Heartbeat != nil {
+		log.Printf("[info] Heartbeat (%s) enabled for server group %s", group.Heartbeat.Type, group.Name)
+	}
+	if group.Secondary != nil {
+		log.Printf("[info] Secondary (%s) enabled for server group %s %s", group.Secondary.Format, group.Name, group.Secondary.Path)
+	}
+	if dispatcher != nil {
+		log.Printf("[info] %d workers enabled for server group %s (OrderByTag: %t)", workers, group.Name, group.OrderByTag)
+		c.dispatchers = append(c.dispatchers, dispatcher)
+		c.RunProcess(dispatcher)
+	}
+	for _, outForward := range outForwards {
+		c.runOutput(outForward, group.Name, outForward.messageCh)
+	}
+}
+
+func (c *Context) startOutFile(group *ConfigServerGroup, messageCh chan *fluent.FluentRecordSet, pending []*fluent.FluentRecordSet) {
+	outFile := NewOutFile(group.File, group.Name, messageCh)
+	outFile.TakeOver(pending)
+	log.Printf("[info] out_file (%s) enabled for server group %s %s", group.File.Format, group.Name, group.File.Path)
+	if group.Secondary != nil {
+		secondary, err := NewSecondaryFile(group.Secondary, group.Name)
+		if err != nil {
+			log.Println("[error] Couldn't open secondary.", err)
+		} else {
+			log.Printf("[info] Secondary (%s) enabled for server group %s %s", group.Secondary.Format, group.Name, group.Secondary.Path)
+			outFile.Secondary = secondary
 		}
-		inForward, err := NewInForward(config.Receiver)
+	}
+	c.runOutput(outFile, group.Name, messageCh)
+}
+
+// startOutHTTP starts outHTTP (out_http or an output based on it) for the group.
+func (c *Context) startOutHTTP(config *Config, group *ConfigServerGroup, outHTTP *OutHTTP, messageCh chan *fluent.FluentRecordSet, statIndex int, pending []*fluent.FluentRecordSet) {
+	outHTTP.Batcher = NewBatcher(config.ChunkLimitSize, config.ChunkLimitRecords, config.FlushInterval.Duration)
+	outHTTP.RoundRobin = group.RoundRobin
+	outHTTP.group = group.Name
+	outHTTP.statIndex = statIndex
+	outHTTP.messageCh = messageCh
+	outHTTP.TakeOver(pending)
+	if group.Secondary != nil {
+		secondary, err := NewSecondaryFile(group.Secondary, group.Name)
 		if err != nil {
-			log.Println("[error]", err)
+			log.Println("[error] Couldn't open secondary.", err)
 		} else {
-			c.RunProcess(inForward)
+			log.Printf("[info] Secondary (%s) enabled for server group %s %s", group.Secondary.Format, group.Name, group.Secondary.Path)
+			outHTTP.Secondary = secondary
 		}
 	}
-	c.StartProcess.Wait()
-	return c
+	c.runOutput(outHTTP, group.Name, messageCh)
+}
+
+func (c *Context) runOutput(output Output, group string, messageCh chan *fluent.FluentRecordSet) {
+	c.outputs = append(c.outputs, &runningOutput{Output: output, group: group, messageCh: messageCh})
+	c.RunProcess(output)
+}
+
+// newOutForward returns an out_forward for the i-th worker of the group, which has its own connections and buffer.
+func (c *Context) newOutForward(config *Config, group *ConfigServerGroup, i, workers int) (*OutForward, error) {
+	outForward, err := NewOutForward(group.Servers)
+	if err != nil {
+		return nil, err
+	}
+	outForward.Batcher = NewBatcher(config.ChunkLimitSize, config.ChunkLimitRecords, config.FlushInterval.Duration)
+	if buffer := config.Buffer; buffer != nil {
+		if err := outForward.EnableBuffer(buffer.WorkerPath(group.Name, i), buffer.TotalLimitSize/int64(workers)); err != nil {
+			log.Println("[error] Couldn't open buffer.", err)
+		}
+	}
+	outForward.RoundRobin = group.RoundRobin
+	outForward.HashKey = group.HashKey
+	if group.RequireAckResponse {
+		outForward.RequireAckResponse = true
+		outForward.AckResponseTimeout = group.AckResponseTimeout.Duration
+	}
+	outForward.Heartbeat = group.Heartbeat
+	if group.Secondary != nil {
+		name := group.Name
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", group.Name, i)
+		}
+		secondary, err := NewSecondaryFile(group.Secondary, name)
+		if err != nil {
+			log.Println("[error] Couldn't open secondary.", err)
+		} else {
+			outForward.Secondary = secondary
+		}
+	}
+	outForward.group = group.Name
+	outForward.worker = i
+	return outForward, nil
+}
+
+// stopOutputs stops the router and all outputs, and returns record sets which are not sent yet by group names.
+func (c *Context) stopOutputs() map[string][]*fluent.FluentRecordSet {
+	var routed map[string][]*fluent.FluentRecordSet
+	if c.router != nil {
+		routed = c.router.Stop()
+	}
+	dispatched := make(map[string][]*fluent.FluentRecordSet)
+	for _, d := range c.dispatchers {
+		dispatched[d.group] = d.Stop()
+	}
+	undelivered := make(map[string][]*fluent.FluentRecordSet)
+	for _, o := range c.outputs {
+		sets := o.Stop()
+	DRAIN:
+		for {
+			select {
+			case rs := <-o.messageCh:
+				sets = append(sets, rs)
+			default:
+				break DRAIN
+			}
+		}
+		undelivered[o.group] = append(undelivered[o.group], sets...)
+	}
+	// record sets held by dispatchers and the router are newer than ones held by workers
+	for group := range undelivered {
+		undelivered[group] = append(undelivered[group], dispatched[group]...)
+		undelivered[group] = append(undelivered[group], routed[group]...)
+	}
+	c.router = nil
+	c.dispatchers = nil
+	c.outputs = nil
+	return undelivered
+}
+
+func (c *Context) startInTail(config *ConfigLogfile, stopped *InTail) {
+	key, err := tailKey(config)
+	if err != nil {
+		log.Println("[error]", err)
+		return
+	}
+	if _, ok := c.tails[key]; ok {
+		log.Println("[warning] duplicated log file", key, "ignored")
+		return
+	}
+	tail, err := NewInTail(config, c.watcher)
+	if err != nil {
+		log.Println("[error]", err)
+		return
+	}
+	if stopped != nil {
+		tail.Resume(stopped)
+	}
+	c.tails[key] = tail
+	c.RunProcess(tail)
+}
+
+func tailKey(config *ConfigLogfile) (string, error) {
+	if config.IsStdin() {
+		return StdinFilename, nil
+	}
+	return Rel2Abs(config.File)
+}
+
+func (c *Context) startWatcher() {
+	if c.watcher != nil && !c.watcher.IsRunning() {
+		c.RunProcess(c.watcher)
+	}
+}
+
+func (c *Context) startInForward(config *ConfigReceiver, stopped *InForward) {
+	inForward, err := NewInForward(config)
+	if err != nil {
+		log.Println("[error]", err)
+		return
+	}
+	if stopped != nil {
+		inForward.TakeOver(stopped)
+	}
+	c.inForward = inForward
+	c.RunProcess(inForward)
 }
 
 func (c *Context) Shutdown() {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
 	close(c.ControlCh)
 	c.InputProcess.Wait()
 	close(c.MessageCh)
@@ -56,3 +56,48 @@ func BenchmarkNewFluentRecordSetJSON(b *testing.B) {
 		_ = hydra.NewFluentRecordSet("dummy", "message", hydra.FormatJSON, nil, nil, buf)
 	}
 }
+
+func TestNewFluentRecordSetWithErrors(t *testing.T) {
+	buf := []byte(createRecordsetSampleJSON(2) + "\ninvalid JSON line")
+	rs, es, n := hydra.NewFluentRecordSetWithErrors("dummy", "message", "", hydra.FormatJSON, nil, nil, buf)
+	if n != 1 {
+		t.Errorf("invalid parse errors: %d", n)
+	}
+	if len(rs.Records) != 3 {
+		t.Errorf("invalid record length: %d", len(rs.Records))
+	}
+	if es != nil {
+		t.Errorf("error set must be nil: %#v", es)
+	}
+
+	rs, es, n = hydra.NewFluentRecordSetWithErrors("dummy", "message", "dummy.parse_error", hydra.FormatJSON, nil, nil, buf)
+	if n != 1 {
+		t.Errorf("invalid parse errors: %d", n)
+	}
+	if len(rs.Records) != 2 {
+		t.Errorf("invalid record length: %d", len(rs.Records))
+	}
+	if es == nil || es.Tag != "dummy.parse_error" || len(es.Records) != 1 {
+		t.Fatalf("invalid error set: %#v", es)
+	}
+	if v, _ := es.Records[0].GetData("message"); v != "invalid JSON line" {
+		t.Errorf("invalid raw line: %#v", v)
+	}
+	if v, ok := es.Records[0].GetData(hydra.ParseErrorKey); !ok || v == "" {
+		t.Errorf("error reason not found: %#v", es.Records[0])
+	}
+}
+
+func TestNewFluentRecordSetWithErrorsLTSV(t *testing.T) {
+	buf := []byte("foo:1\tbar:2\nfoo\tbar:baz\n")
+	_, es, n := hydra.NewFluentRecordSetWithErrors("dummy", "message", "dummy.parse_error", hydra.FormatLTSV, nil, nil, buf)
+	if n != 1 {
+		t.Errorf("invalid parse errors: %d", n)
+	}
+	if es == nil || len(es.Records) != 1 {
+		t.Fatalf("invalid error set: %#v", es)
+	}
+	if v, _ := es.Records[0].GetData("message"); v != "foo\tbar:baz" {
+		t.Errorf("invalid raw line: %#v", v)
+	}
+}
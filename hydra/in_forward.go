@@ -1,6 +1,7 @@
 package hydra
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -12,37 +13,79 @@ import (
 )
 
 const (
-	FlashInterval = 200 * time.Millisecond
+	FlashInterval    = 200 * time.Millisecond
+	handshakeTimeout = 10 * time.Second
+
+	enqueueRetryInterval = 10 * time.Millisecond
 )
 
 type InForward struct {
 	index        int
 	listener     net.Listener
+	udp          net.PacketConn // responds to heartbeats of out_forward
 	Addr         net.Addr
 	messageCh    chan *fluent.FluentRecordSet
 	monitorCh    chan Stat
 	messageQueue *MessageQueue
+	auth         *fluent.ServerAuth
+	stopCh       chan interface{}
+	done         chan interface{}
 }
 
 func NewInForward(config *ConfigReceiver) (*InForward, error) {
 	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		log.Println("[error]", err)
+		return nil, err
+	}
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Println("[error]", err)
 		return nil, err
 	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		log.Println("[info] Receiver TLS enabled")
+	}
 	log.Println("[info] Receiver listing", l.Addr())
+	udp, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		log.Println("[warning] Couldn't listen UDP for heartbeat", err)
+		udp = nil
+	}
 	f := &InForward{
 		listener:     l,
+		udp:          udp,
 		Addr:         l.Addr(),
 		messageQueue: NewMessageQueue(config.MaxBufferMessages),
+		auth:         config.ServerAuth(),
+		stopCh:       make(chan interface{}),
+		done:         make(chan interface{}),
 	}
 	return f, nil
 }
 
+// Stop closes the listener and waits for finishing accept loop.
+// Buffered messages are still fed to outputs until the queue becomes empty.
+func (f *InForward) Stop() {
+	close(f.stopCh)
+	<-f.done
+}
+
+// TakeOver makes f to share the message queue of stopped InForward.
+func (f *InForward) TakeOver(stopped *InForward) {
+	q := stopped.messageQueue
+	q.lock()
+	q.maxMessages = f.messageQueue.maxMessages
+	q.unlock()
+	f.messageQueue = q
+}
+
 func (f *InForward) Run(c *Context) {
 	c.InputProcess.Add(1)
 	defer c.InputProcess.Done()
+	defer close(f.done)
 	f.messageCh = c.MessageCh
 	f.monitorCh = c.MonitorCh
 
@@ -54,9 +97,18 @@ func (f *InForward) Run(c *Context) {
 	}
 
 	go f.feed()
+	if f.udp != nil {
+		go f.respondHeartbeat()
+	}
 	go func() {
-		<-c.ControlCh
+		select {
+		case <-c.ControlCh:
+		case <-f.stopCh:
+		}
 		f.listener.Close()
+		if f.udp != nil {
+			f.udp.Close()
+		}
 	}()
 	for {
 		conn, err := f.listener.Accept()
@@ -82,6 +134,11 @@ func (f *InForward) feed() {
 		if rs, ok := f.messageQueue.Dequeue(); ok {
 			f.messageCh <- rs
 		} else {
+			select {
+			case <-f.stopCh:
+				return
+			default:
+			}
 			<-time.After(FlashInterval)
 			f.monitorCh <- &ReceiverStat{
 				Buffered: int64(f.messageQueue.Len()),
@@ -90,6 +147,18 @@ func (f *InForward) feed() {
 	}
 }
 
+// respondHeartbeat echoes UDP heartbeats back to senders until the socket is closed.
+func (f *InForward) respondHeartbeat() {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := f.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		f.udp.WriteTo(buf[:n], addr)
+	}
+}
+
 func (f *InForward) handleConn(conn net.Conn, c *Context) {
 	c.InputProcess.Add(1)
 	defer c.InputProcess.Done()
@@ -99,6 +168,13 @@ func (f *InForward) handleConn(conn net.Conn, c *Context) {
 		}
 	}()
 
+	if f.auth != nil {
+		if err := fluent.ServerHandshake(conn, f.auth, handshakeTimeout); err != nil {
+			log.Println("[warning] Handshake failed", err, conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+	}
 	for {
 		select {
 		case <-c.ControlCh:
@@ -106,7 +182,7 @@ func (f *InForward) handleConn(conn net.Conn, c *Context) {
 			return
 		default:
 		}
-		recordSets, err := fluent.DecodeEntries(conn)
+		recordSets, option, err := fluent.DecodeEntriesWithOption(conn)
 		if err == io.EOF {
 			conn.Close()
 			return
@@ -119,7 +195,15 @@ func (f *InForward) handleConn(conn net.Conn, c *Context) {
 		d := int64(0)
 		for _, recordSet := range recordSets {
 			rs := &recordSet
-			d += f.messageQueue.Enqueue(rs)
+			if option.Chunk != "" {
+				// acked chunks must not be disposed, so wait for room in the queue
+				if !f.enqueueKept(rs, c) {
+					conn.Close()
+					return
+				}
+			} else {
+				d += f.messageQueue.Enqueue(rs)
+			}
 			m += int64(len(rs.Records))
 		}
 		f.monitorCh <- &ReceiverStat{
@@ -127,5 +211,43 @@ func (f *InForward) handleConn(conn net.Conn, c *Context) {
 			Disposed: d,
 			Buffered: int64(f.messageQueue.Len()),
 		}
+		if option.Chunk != "" {
+			if err := fluent.WriteAck(conn, option.Chunk); err != nil {
+				log.Println("[error] Write ack failed", err, conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// enqueueKept adds rs to the queue, waiting until the queue has room.
+// It returns false when in_forward is stopped while waiting.
+func (f *InForward) enqueueKept(rs *fluent.FluentRecordSet, c *Context) bool {
+	for !f.messageQueue.EnqueueKept(rs) {
+		select {
+		case <-c.ControlCh:
+			return false
+		case <-f.stopCh:
+			return false
+		case <-time.After(enqueueRetryInterval):
+		}
+	}
+	return true
+}
+
+// ServerAuth returns the authentication config for the handshake. It returns nil if SharedKey is not set.
+func (cr *ConfigReceiver) ServerAuth() *fluent.ServerAuth {
+	if cr.SharedKey == "" {
+		return nil
+	}
+	auth := &fluent.ServerAuth{
+		SharedKey:    cr.SharedKey,
+		SelfHostname: cr.SelfHostname,
+		Users:        make(map[string]string, len(cr.Users)),
+	}
+	for _, u := range cr.Users {
+		auth.Users[u.Username] = u.Password
 	}
+	return auth
 }
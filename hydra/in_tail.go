@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/fujiwara/fluent-agent-hydra/fluent"
@@ -28,13 +29,27 @@ type InTail struct {
 	format         FileFormat
 	recordModifier *RecordModifier
 	regexp         *Regexp
+	parseErrorTag  string
 	position       int64
+	fileStat       *FileStat
+	config         *ConfigLogfile
+	watcher        *Watcher
+	resumePosition int64
+	stopCh         chan interface{}
+	done           chan interface{}
 }
 
 type Watcher struct {
 	watcher      *fsnotify.Watcher
 	watchingDir  map[string]bool
-	watchingFile map[string]chan fsnotify.Event
+	watchingFile map[string]*watchingFile
+	running      bool
+	mu           sync.Mutex
+}
+
+type watchingFile struct {
+	eventCh chan fsnotify.Event
+	closed  chan interface{}
 }
 
 func NewWatcher() (*Watcher, error) {
@@ -46,7 +61,7 @@ func NewWatcher() (*Watcher, error) {
 	w := &Watcher{
 		watcher:      watcher,
 		watchingDir:  make(map[string]bool),
-		watchingFile: make(map[string]chan fsnotify.Event),
+		watchingFile: make(map[string]*watchingFile),
 	}
 	return w, nil
 }
@@ -54,20 +69,34 @@ func NewWatcher() (*Watcher, error) {
 func (w *Watcher) Run(c *Context) {
 	c.InputProcess.Add(1)
 	defer c.InputProcess.Done()
+	w.mu.Lock()
+	w.running = len(w.watchingFile) > 0
+	w.mu.Unlock()
 	c.StartProcess.Done()
 
-	if len(w.watchingFile) == 0 {
+	if !w.running {
 		// no need to watch
 		return
 	}
+	defer func() {
+		w.mu.Lock()
+		w.running = false
+		w.mu.Unlock()
+	}()
 	for {
 		select {
 		case <-c.ControlCh:
 			log.Println("[info] shutdown file watcher")
 			return
 		case ev := <-w.watcher.Events:
-			if eventCh, ok := w.watchingFile[ev.Name]; ok {
-				eventCh <- ev
+			w.mu.Lock()
+			wf, ok := w.watchingFile[ev.Name]
+			w.mu.Unlock()
+			if ok {
+				select {
+				case wf.eventCh <- ev:
+				case <-wf.closed:
+				}
 			}
 		case err := <-w.watcher.Errors:
 			log.Println("[warning] watcher error", err)
@@ -75,23 +104,41 @@ func (w *Watcher) Run(c *Context) {
 	}
 }
 
+// IsRunning returns true while the watcher is watching some files.
+func (w *Watcher) IsRunning() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.running
+}
+
 func (w *Watcher) WatchFile(filename string) (chan fsnotify.Event, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	parent := filepath.Dir(filename)
 	log.Println("[info] watching events of directory", parent)
-	if _, ok := w.watchingDir[parent]; ok { // already watching
-		ch := make(chan fsnotify.Event)
-		w.watchingFile[filename] = ch
-		return ch, nil
-	} else {
+	if _, ok := w.watchingDir[parent]; !ok {
 		err := w.watcher.Add(parent)
 		if err != nil {
 			log.Println("[error] Couldn't watch event of", parent, err)
 			return nil, err
 		}
 		w.watchingDir[parent] = true
-		ch := make(chan fsnotify.Event)
-		w.watchingFile[filename] = ch
-		return ch, nil
+	}
+	wf := &watchingFile{
+		eventCh: make(chan fsnotify.Event),
+		closed:  make(chan interface{}),
+	}
+	w.watchingFile[filename] = wf
+	return wf.eventCh, nil
+}
+
+// UnwatchFile stops to pass events of the file.
+func (w *Watcher) UnwatchFile(filename string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wf, ok := w.watchingFile[filename]; ok {
+		close(wf.closed)
+		delete(w.watchingFile, filename)
 	}
 }
 
@@ -121,6 +168,12 @@ func NewInTail(config *ConfigLogfile, watcher *Watcher) (*InTail, error) {
 			fieldName:      config.FieldName,
 			format:         config.Format,
 			recordModifier: modifier,
+			regexp:         config.Regexp,
+			parseErrorTag:  config.ParseErrorTag,
+			fileStat:       &FileStat{},
+			config:         config,
+			stopCh:         make(chan interface{}),
+			done:           make(chan interface{}),
 		}, nil
 	}
 
@@ -141,13 +194,36 @@ func NewInTail(config *ConfigLogfile, watcher *Watcher) (*InTail, error) {
 		format:         config.Format,
 		recordModifier: modifier,
 		regexp:         config.Regexp,
+		parseErrorTag:  config.ParseErrorTag,
+		fileStat:       &FileStat{},
+		config:         config,
+		watcher:        watcher,
+		resumePosition: SEEK_TAIL,
+		stopCh:         make(chan interface{}),
+		done:           make(chan interface{}),
 	}, nil
 }
 
+// Resume makes the tail to start reading from the position where t stopped at, instead of the end of file.
+func (t *InTail) Resume(stopped *InTail) {
+	t.resumePosition = stopped.resumePosition
+	t.fileStat.ParseErrors = stopped.fileStat.ParseErrors
+}
+
+// Stop stops following the file and waits for finishing it.
+func (t *InTail) Stop() {
+	close(t.stopCh)
+	if t.watcher != nil {
+		t.watcher.UnwatchFile(t.filename)
+	}
+	<-t.done
+}
+
 // InTail follow the tail of file and post BulkMessage to channel.
 func (t *InTail) Run(c *Context) {
 	c.InputProcess.Add(1)
 	defer c.InputProcess.Done()
+	defer close(t.done)
 
 	t.messageCh = c.MessageCh
 	t.monitorCh = c.MonitorCh
@@ -167,7 +243,7 @@ func (t *InTail) Run(c *Context) {
 	}
 
 	log.Println("[info] Trying trail file", t.filename)
-	f, err := t.newTrailFile(SEEK_TAIL, c)
+	f, err := t.newTrailFile(t.resumePosition, c)
 	if err != nil {
 		if _, ok := err.(Signal); ok {
 			log.Println("[info]", err)
@@ -182,6 +258,9 @@ func (t *InTail) Run(c *Context) {
 			if err != nil {
 				if _, ok := err.(Signal); ok {
 					log.Println("[info]", err)
+					// a partial line in contBuf will be read again on resume
+					t.resumePosition = f.Position - int64(len(f.contBuf))
+					f.Close()
 					return
 				} else {
 					log.Println("[warning]", err)
@@ -214,24 +293,31 @@ func (t *InTail) newTrailFile(startPos int64, c *Context) (*File, error) {
 			f.Format = t.format
 			f.RecordModifier = t.recordModifier
 			f.Regexp = t.regexp
+			f.ParseErrorTag = t.parseErrorTag
+			// parse errors are counted through rotations
+			f.FileStat = t.fileStat
 			log.Println("[info] Trailing file:", f.Path, "tag:", f.Tag, "format:", t.format)
 			t.monitorCh <- f.UpdateStat()
 			return f, nil
 		}
 		t.monitorCh <- &FileStat{
-			Tag:      t.tag,
-			File:     t.filename,
-			Position: int64(-1),
-			Error:    monitorError(err),
+			Tag:         t.tag,
+			File:        t.filename,
+			Position:    int64(-1),
+			Error:       monitorError(err),
+			ParseErrors: t.fileStat.ParseErrors,
 		}
 		if first {
 			log.Println("[warning]", err, "Retrying...")
 		}
 		first = false
 		seekTo = SEEK_HEAD
+		t.resumePosition = SEEK_HEAD
 		select {
 		case <-c.ControlCh:
 			return nil, Signal{"shutdown in_tail: " + t.filename}
+		case <-t.stopCh:
+			return nil, Signal{"stop in_tail: " + t.filename}
 		case <-time.NewTimer(OpenRetryInterval).C:
 		}
 	}
@@ -241,6 +327,8 @@ func (t *InTail) watchFileEvent(f *File, c *Context) error {
 	select {
 	case <-c.ControlCh:
 		return Signal{"shutdown in_tail: " + f.Path}
+	case <-t.stopCh:
+		return Signal{"stop in_tail: " + f.Path}
 	case ev := <-t.eventCh:
 		if ev.Op&fsnotify.Write == fsnotify.Write {
 			break
@@ -287,11 +375,19 @@ func (t *InTail) TailStdin(c *Context) error {
 	for scanner.Scan() {
 		b := scanner.Bytes()
 		t.position += int64(len(b) + 1)
-		t.messageCh <- NewFluentRecordSet(t.tag, t.fieldName, t.format, t.recordModifier, t.regexp, b)
+		recordSet, errorSet, parseErrors := NewFluentRecordSetWithErrors(t.tag, t.fieldName, t.parseErrorTag, t.format, t.recordModifier, t.regexp, b)
+		if len(recordSet.Records) > 0 {
+			t.messageCh <- recordSet
+		}
+		if errorSet != nil {
+			t.messageCh <- errorSet
+		}
+		t.fileStat.ParseErrors += parseErrors
 		t.monitorCh <- &FileStat{
-			File:     StdinFilename,
-			Position: t.position,
-			Tag:      t.tag,
+			File:        StdinFilename,
+			Position:    t.position,
+			Tag:         t.tag,
+			ParseErrors: t.fileStat.ParseErrors,
 		}
 	}
 	var msg string
@@ -301,10 +397,11 @@ func (t *InTail) TailStdin(c *Context) error {
 		msg = "closed"
 	}
 	t.monitorCh <- &FileStat{
-		File:     StdinFilename,
-		Position: t.position,
-		Tag:      t.tag,
-		Error:    msg,
+		File:        StdinFilename,
+		Position:    t.position,
+		Tag:         t.tag,
+		Error:       msg,
+		ParseErrors: t.fileStat.ParseErrors,
 	}
 	return NewSignal("shutdown in_tail: STDIN")
 }
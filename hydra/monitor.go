@@ -18,11 +18,13 @@ const (
 )
 
 type Stats struct {
-	Sent     map[string]*SentStat `json:"sent"`
-	Files    map[string]*FileStat `json:"files"`
-	Servers  []*ServerStat        `json:"servers"`
-	Receiver *ReceiverStat        `json:"receiver"`
-	mu       sync.Mutex
+	Sent      map[string]*SentStat      `json:"sent"`
+	Secondary map[string]*SecondaryStat `json:"secondary,omitempty"`
+	Streams   map[string]*StreamStat    `json:"streams,omitempty"`
+	Files     map[string]*FileStat      `json:"files"`
+	Servers   []*ServerStat             `json:"servers"`
+	Receiver  *ReceiverStat             `json:"receiver"`
+	mu        sync.Mutex
 }
 
 type Stat interface {
@@ -30,10 +32,28 @@ type Stat interface {
 }
 
 type ServerStat struct {
-	Index   int    `json:"-"`
-	Address string `json:"address"`
-	Alive   bool   `json:"alive"`
-	Error   string `json:"error"`
+	Index      int      `json:"-"`
+	Group      string   `json:"group,omitempty"`
+	Address    string   `json:"address"`
+	Endpoints  []string `json:"endpoints,omitempty"` // resolved addresses
+	Alive      bool     `json:"alive"`
+	Error      string   `json:"error"`
+	AckLatency float64  `json:"ack_latency"`        // seconds of the last ack response
+	Resends    int64    `json:"resends"`            // chunks resent to another server because of no ack
+	Rejected   int64    `json:"rejected,omitempty"` // records rejected by the HTTP endpoint and dropped
+	Health     string   `json:"health,omitempty"`   // health status reported by the HTTP endpoint
+
+	Worker      int               `json:"-"`
+	Connections []*ConnectionStat `json:"connections,omitempty"` // for each sender worker
+}
+
+// ConnectionStat is the throughput of the connection from a sender worker to a server.
+type ConnectionStat struct {
+	Alive          bool    `json:"alive"`
+	Messages       int64   `json:"messages"`
+	Bytes          int64   `json:"bytes"`
+	MessagesPerSec float64 `json:"messages_per_sec"`
+	BytesPerSec    float64 `json:"bytes_per_sec"`
 }
 
 type SentStat struct {
@@ -43,11 +63,25 @@ type SentStat struct {
 	Sents    int64  `json:"sents"`
 }
 
+// SecondaryStat counts records written to secondary files by tags.
+type SecondaryStat struct {
+	Tag      string `json:"-"`
+	Messages int64  `json:"messages"`
+}
+
+// StreamStat counts records sent to a stream of Loki by the labels of the stream.
+type StreamStat struct {
+	Labels   string `json:"-"`
+	Messages int64  `json:"messages"`
+	Rejected int64  `json:"rejected"` // rejected by Loki as out of order (or too old)
+}
+
 type FileStat struct {
-	Tag      string `json:"tag"`
-	File     string `json:"-"`
-	Position int64  `json:"position"`
-	Error    string `json:"error"`
+	Tag         string `json:"tag"`
+	File        string `json:"-"`
+	Position    int64  `json:"position"`
+	Error       string `json:"error"`
+	ParseErrors int64  `json:"parse_errors"`
 }
 
 type ReceiverStat struct {
@@ -70,7 +104,50 @@ func (s *FileStat) ApplyTo(ss *Stats) {
 func (s *ServerStat) ApplyTo(ss *Stats) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
-	ss.Servers[s.Index] = s
+	if s.Index >= len(ss.Servers) {
+		ss.Servers = append(ss.Servers, make([]*ServerStat, s.Index-len(ss.Servers)+1)...)
+	}
+	if len(s.Connections) == 0 {
+		ss.Servers[s.Index] = s
+		return
+	}
+	// merge connections of workers. the server is alive if any connection is alive
+	var conns []*ConnectionStat
+	if prev := ss.Servers[s.Index]; prev != nil && prev.Group == s.Group && prev.Address == s.Address {
+		conns = append(conns, prev.Connections...)
+	}
+	for len(conns) <= s.Worker {
+		conns = append(conns, &ConnectionStat{})
+	}
+	conns[s.Worker] = s.Connections[0]
+	merged := *s
+	merged.Connections = conns
+	for _, conn := range conns {
+		merged.Alive = merged.Alive || conn.Alive
+	}
+	ss.Servers[s.Index] = &merged
+}
+
+// serversResetStat resizes server stats when servers are reloaded.
+type serversResetStat struct {
+	servers int
+}
+
+func (s *serversResetStat) ApplyTo(ss *Stats) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.Servers = make([]*ServerStat, s.servers)
+}
+
+// fileRemovedStat removes a file stat when the file is not followed anymore.
+type fileRemovedStat struct {
+	file string
+}
+
+func (s *fileRemovedStat) ApplyTo(ss *Stats) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.Files, s.file)
 }
 
 func (s *SentStat) ApplyTo(ss *Stats) {
@@ -85,6 +162,27 @@ func (s *SentStat) ApplyTo(ss *Stats) {
 	}
 }
 
+func (s *SecondaryStat) ApplyTo(ss *Stats) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _s, ok := ss.Secondary[s.Tag]; ok {
+		_s.Messages += s.Messages
+	} else {
+		ss.Secondary[s.Tag] = s
+	}
+}
+
+func (s *StreamStat) ApplyTo(ss *Stats) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _s, ok := ss.Streams[s.Labels]; ok {
+		_s.Messages += s.Messages
+		_s.Rejected += s.Rejected
+	} else {
+		ss.Streams[s.Labels] = s
+	}
+}
+
 func (s *ReceiverStat) ApplyTo(ss *Stats) {
 	if ss.Receiver == nil {
 		ss.Receiver = s
@@ -101,6 +199,9 @@ func (s *ReceiverStat) ApplyTo(ss *Stats) {
 	rs.Messages += s.Messages
 	rs.Disposed += s.Disposed
 	rs.Buffered = s.Buffered
+	if s.MaxBufferMessages > 0 {
+		rs.MaxBufferMessages = s.MaxBufferMessages
+	}
 }
 
 func (ss *Stats) WriteJSON(w http.ResponseWriter) {
@@ -110,6 +211,17 @@ func (ss *Stats) WriteJSON(w http.ResponseWriter) {
 	encoder.Encode(ss)
 }
 
+// sentMessages returns the total number of messages sent.
+func (ss *Stats) sentMessages() int64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var n int64
+	for _, s := range ss.Sent {
+		n += s.Messages
+	}
+	return n
+}
+
 func (ss *Stats) Run(ch chan Stat) {
 	for {
 		s := <-ch
@@ -123,29 +235,67 @@ type Monitor struct {
 	Addr      net.Addr
 	listener  net.Listener
 	monitorCh chan Stat
+	mux       *http.ServeMux
+	config    *ConfigMonitor
+	mu        sync.Mutex
 }
 
 func NewMonitor(config *Config) (*Monitor, error) {
 	stats := &Stats{
-		Sent:    make(map[string]*SentStat),
-		Files:   make(map[string]*FileStat),
-		Servers: make([]*ServerStat, len(config.Servers)),
+		Sent:      make(map[string]*SentStat),
+		Secondary: make(map[string]*SecondaryStat),
+		Streams:   make(map[string]*StreamStat),
+		Files:     make(map[string]*FileStat),
+		Servers:   make([]*ServerStat, config.numServers()),
 	}
 	monitor := &Monitor{
 		stats: stats,
+		mux:   http.NewServeMux(),
 	}
-	if config.Monitor == nil {
-		return monitor, nil
+	if err := monitor.listen(config.Monitor); err != nil {
+		return nil, err
 	}
-	monitorAddress := fmt.Sprintf("%s:%d", config.Monitor.Host, config.Monitor.Port)
+	return monitor, nil
+}
+
+func (m *Monitor) listen(config *ConfigMonitor) error {
+	m.config = config
+	if config == nil {
+		return nil
+	}
+	monitorAddress := fmt.Sprintf("%s:%d", config.Host, config.Port)
 	listener, err := net.Listen("tcp", monitorAddress)
 	if err != nil {
 		log.Println("[error]", err)
-		return nil, err
+		return err
 	}
-	monitor.listener = listener
-	monitor.Addr = listener.Addr()
-	return monitor, nil
+	m.listener = listener
+	m.Addr = listener.Addr()
+	return nil
+}
+
+func (m *Monitor) serve() {
+	if m.listener == nil {
+		return
+	}
+	go http.Serve(m.listener, m.mux)
+	log.Printf("[info] Monitor server listening http://%s/\n", m.listener.Addr())
+}
+
+// Relisten closes the current listener and starts to serve on the new address.
+func (m *Monitor) Relisten(config *ConfigMonitor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listener != nil {
+		m.listener.Close()
+		m.listener = nil
+		m.Addr = nil
+	}
+	if err := m.listen(config); err != nil {
+		return err
+	}
+	m.serve()
+	return nil
 }
 
 func (m *Monitor) Run(c *Context) {
@@ -153,19 +303,29 @@ func (m *Monitor) Run(c *Context) {
 	defer c.OutputProcess.Done()
 	go m.stats.Run(c.MonitorCh)
 
-	c.StartProcess.Done()
-
-	if m.listener == nil {
-		return
-	}
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	m.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		m.stats.WriteJSON(w)
 	})
-	http.HandleFunc("/system", stats_api.Handler)
+	m.mux.HandleFunc("/system", stats_api.Handler)
+	m.mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// closing the listener by reloading doesn't break this connection
+		if err := c.ReloadConfigFile(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "reloaded")
+	})
 
-	go http.Serve(m.listener, nil)
-	log.Printf("[info] Monitor server listening http://%s/\n", m.listener.Addr())
+	m.mu.Lock()
+	m.serve()
+	m.mu.Unlock()
+
+	c.StartProcess.Done()
 }
 
 func monitorError(err error) string {
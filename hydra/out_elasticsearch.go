@@ -0,0 +1,177 @@
+package hydra
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	DefaultElasticsearchIndex   = "fluentd-%Y.%m.%d"
+	DefaultElasticsearchTimeKey = "@timestamp"
+
+	elasticsearchBulkPath   = "/_bulk"
+	elasticsearchHealthPath = "/_cluster/health"
+)
+
+// NewOutElasticsearch returns an output which writes record sets by the bulk API of Elasticsearch (or OpenSearch).
+// Documents failed by 429 or 5xx in a bulk response are sent again, and other failed documents are dropped.
+func NewOutElasticsearch(config *ConfigOutElasticsearch) *OutHTTP {
+	return newOutHTTP("out_elasticsearch", config.httpConfig(), &esProtocol{
+		index:   config.Index,
+		idKey:   config.IDKey,
+		tagKey:  config.TagKey,
+		timeKey: config.TimeKey,
+	})
+}
+
+// httpConfig returns the config of OutHTTP which posts to the bulk API of URLs.
+func (ce *ConfigOutElasticsearch) httpConfig() *ConfigOutHTTP {
+	urls := make([]string, len(ce.URLs))
+	for i, u := range ce.URLs {
+		urls[i] = strings.TrimSuffix(u, "/") + elasticsearchBulkPath
+	}
+	headers := make(map[string]string, len(ce.Headers)+1)
+	if ce.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(ce.Username + ":" + ce.Password))
+		headers["Authorization"] = "Basic " + auth
+	}
+	for key, value := range ce.Headers {
+		headers[key] = value
+	}
+	return &ConfigOutHTTP{
+		URLs:         urls,
+		Compress:     ce.Compress,
+		Headers:      headers,
+		Timeout:      ce.Timeout,
+		RetryWait:    ce.RetryWait,
+		RetryWaitMax: ce.RetryWaitMax,
+	}
+}
+
+// esProtocol makes requests of the bulk API.
+type esProtocol struct {
+	index   string
+	idKey   string
+	tagKey  string
+	timeKey string
+}
+
+type esAction struct {
+	Index esActionMeta `json:"index"`
+}
+
+type esActionMeta struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id,omitempty"`
+}
+
+type esBulkResponse struct {
+	Errors bool                     `json:"errors"`
+	Items  []map[string]*esBulkItem `json:"items"`
+}
+
+type esBulkItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (p *esProtocol) encode(rs *fluent.FluentRecordSet) ([]byte, string, error) {
+	decoded, err := decodeRecordSet(rs)
+	if err != nil {
+		return nil, "", err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, record := range decoded.Records {
+		r := record.(*fluent.TinyFluentRecord)
+		// index names must be lowercase
+		meta := esActionMeta{Index: strings.ToLower(expandTagTime(p.index, rs.Tag, r.Timestamp.UTC()))}
+		if p.idKey != "" {
+			if id, ok := r.Data[p.idKey]; ok {
+				meta.ID = fmt.Sprint(id)
+			}
+		}
+		doc := make(map[string]interface{}, len(r.Data)+2)
+		for key, value := range r.Data {
+			doc[key] = value
+		}
+		doc[p.timeKey] = r.Timestamp.Format(time.RFC3339Nano)
+		if p.tagKey != "" {
+			doc[p.tagKey] = rs.Tag
+		}
+		if err := enc.Encode(esAction{Index: meta}); err != nil {
+			return nil, "", err
+		}
+		if err := enc.Encode(doc); err != nil {
+			return nil, "", err
+		}
+	}
+	return b.Bytes(), "application/x-ndjson", nil
+}
+
+// accepted checks results of documents in the bulk response.
+// Documents failed temporarily (429 or 5xx) are returned to retry, and others failed are rejected.
+func (p *esProtocol) accepted(rs *fluent.FluentRecordSet, body []byte) (*fluent.FluentRecordSet, int, error) {
+	var resp esBulkResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, 0, fmt.Errorf("Couldn't parse the bulk response. %s", err)
+	}
+	if !resp.Errors {
+		return nil, 0, nil
+	}
+	if len(resp.Items) != len(rs.Records) {
+		return nil, 0, fmt.Errorf("the bulk response has %d items for %d documents", len(resp.Items), len(rs.Records))
+	}
+	retry := &fluent.FluentRecordSet{Tag: rs.Tag}
+	rejected := 0
+	var reason json.RawMessage
+	for i, item := range resp.Items {
+		for _, result := range item { // {"<action>": result}
+			switch {
+			case result.Status < 300:
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				retry.Records = append(retry.Records, rs.Records[i])
+			default:
+				rejected++
+				if reason == nil {
+					reason = result.Error
+				}
+			}
+		}
+	}
+	if rejected > 0 {
+		log.Printf("[warning] out_elasticsearch rejected %d documents of tag:%s. %s", rejected, rs.Tag, reason)
+	}
+	if len(retry.Records) > 0 {
+		log.Printf("[warning] out_elasticsearch retry %d documents of tag:%s", len(retry.Records), rs.Tag)
+		return retry, rejected, nil
+	}
+	return nil, rejected, nil
+}
+
+// health returns the status of the cluster health ("green", "yellow" or "red").
+func (p *esProtocol) health(get func(url string) (*http.Response, error), url string) (string, error) {
+	resp, err := get(strings.TrimSuffix(url, elasticsearchBulkPath) + elasticsearchHealthPath)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return "", err
+	}
+	return health.Status, nil
+}
@@ -0,0 +1,193 @@
+package hydra_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+type esDocument struct {
+	index  string
+	id     string
+	source map[string]interface{}
+}
+
+// esStandIn is an Elasticsearch stand-in which fails documents of the first bulk request.
+// With truncated, it responds to the first bulk request without items instead.
+type esStandIn struct {
+	mu        sync.Mutex
+	requests  int
+	bulkSizes []int
+	documents []esDocument
+	auth      string
+	truncated bool
+}
+
+func (es *esStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.auth = r.Header.Get("Authorization")
+	switch r.URL.Path {
+	case "/_cluster/health":
+		fmt.Fprint(w, `{"cluster_name":"test","status":"green"}`)
+		return
+	case "/_bulk":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	es.requests++
+	var items []interface{}
+	failed := false
+	scanner := bufio.NewScanner(r.Body)
+	for i := 0; scanner.Scan(); i++ {
+		var action map[string]map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+			http.Error(w, "invalid bulk request", http.StatusBadRequest)
+			return
+		}
+		var source map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &source)
+		status := http.StatusCreated
+		if es.requests == 1 && es.truncated {
+			items = append(items, nil)
+			continue
+		} else if es.requests == 1 && i == 0 {
+			status = http.StatusTooManyRequests
+		} else if es.requests == 1 && i == 1 {
+			status = http.StatusBadRequest
+		}
+		result := map[string]interface{}{"status": status}
+		if status == http.StatusCreated {
+			es.documents = append(es.documents, esDocument{action["index"]["_index"], action["index"]["_id"], source})
+		} else {
+			failed = true
+			result["error"] = map[string]string{"type": "error", "reason": http.StatusText(status)}
+		}
+		items = append(items, map[string]interface{}{"index": result})
+	}
+	es.bulkSizes = append(es.bulkSizes, len(items))
+	if es.requests == 1 && es.truncated {
+		fmt.Fprint(w, `{"took":1,"errors":true,"items":[]}`)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": failed, "items": items})
+}
+
+// sentMessages returns the number of messages in SentStat reported until the ServerStat of the endpoint.
+func sentMessages(t *testing.T, c *hydra.Context) (int64, *hydra.ServerStat) {
+	var sent int64
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-c.MonitorCh:
+			switch s := s.(type) {
+			case *hydra.SentStat:
+				sent += s.Messages
+			case *hydra.ServerStat:
+				return sent, s
+			}
+		case <-timeout:
+			t.Fatal("no stats of the endpoint are reported")
+		}
+	}
+}
+
+func TestOutElasticsearch(t *testing.T) {
+	es := &esStandIn{}
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	config := &hydra.ConfigOutElasticsearch{
+		URLs:      []string{ts.URL + "/"},
+		Index:     "Logs-{tag}-%Y.%m.%d",
+		IDKey:     TestFieldName,
+		TagKey:    "tag",
+		Username:  "elastic",
+		Password:  "secret",
+		RetryWait: hydra.Duration{Duration: 10 * time.Millisecond},
+	}
+	config.Restrict(nil)
+	c := hydra.NewContext()
+	c.RunProcess(hydra.NewOutElasticsearch(config))
+	c.StartProcess.Wait()
+	c.MessageCh <- prepareRecordSet()
+
+	// wait for the health report of the endpoint
+	sent, stat := sentMessages(t, c)
+	c.Shutdown()
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	// the 1st document is retried, and the 2nd one is rejected
+	if len(es.bulkSizes) != 2 || es.bulkSizes[0] != 3 || es.bulkSizes[1] != 1 {
+		t.Errorf("unexpected bulk requests %v expected [3 1]", es.bulkSizes)
+	}
+	if len(es.documents) != 2 {
+		t.Fatalf("%d documents indexed expected 2", len(es.documents))
+	}
+	index := "logs-test-" + time.Now().UTC().Format("2006.01.02")
+	for i, expected := range []string{TestMessageLines[2], TestMessageLines[0]} {
+		doc := es.documents[i]
+		if doc.index != index {
+			t.Errorf("index %s expected %s", doc.index, index)
+		}
+		if doc.id != expected || doc.source[TestFieldName] != expected {
+			t.Errorf("document %s %v expected %s", doc.id, doc.source, expected)
+		}
+		if doc.source["tag"] != TestTag {
+			t.Errorf("tag %v expected %s", doc.source["tag"], TestTag)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(doc.source["@timestamp"])); err != nil {
+			t.Errorf("invalid @timestamp %v", doc.source["@timestamp"])
+		}
+	}
+	if es.auth != "Basic ZWxhc3RpYzpzZWNyZXQ=" {
+		t.Errorf("unexpected Authorization header %s", es.auth)
+	}
+	if stat.Health != "green" || stat.Rejected != 1 || !stat.Alive {
+		t.Errorf("unexpected stat of the endpoint %#v", stat)
+	}
+	if sent != 2 {
+		t.Errorf("%d messages are reported as sent expected 2", sent)
+	}
+}
+
+func TestOutElasticsearchTruncatedResponse(t *testing.T) {
+	es := &esStandIn{truncated: true}
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	config := &hydra.ConfigOutElasticsearch{
+		URLs:      []string{ts.URL},
+		RetryWait: hydra.Duration{Duration: 10 * time.Millisecond},
+	}
+	config.Restrict(nil)
+	c := hydra.NewContext()
+	c.RunProcess(hydra.NewOutElasticsearch(config))
+	c.StartProcess.Wait()
+	c.MessageCh <- prepareRecordSet()
+
+	sent, _ := sentMessages(t, c)
+	c.Shutdown()
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	// results of documents are unknown, so the whole batch is sent again
+	if len(es.bulkSizes) != 2 || es.bulkSizes[0] != 3 || es.bulkSizes[1] != 3 {
+		t.Errorf("unexpected bulk requests %v expected [3 3]", es.bulkSizes)
+	}
+	if len(es.documents) != 3 {
+		t.Errorf("%d documents indexed expected 3", len(es.documents))
+	}
+	if sent != 3 {
+		t.Errorf("%d messages are reported as sent expected 3", sent)
+	}
+}
@@ -0,0 +1,497 @@
+package hydra
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/ltsv"
+)
+
+const (
+	OutFileJSON    = "json"
+	OutFileLTSV    = "ltsv"
+	OutFileMsgpack = "msgpack"
+
+	outFileCheckInterval     = 1 * time.Second
+	outFileRetentionInterval = 1 * time.Minute
+)
+
+// OutFile writes record sets into local files (like fluentd's out_file).
+// Paths are expanded from the template by tags and the current time, and files are rotated when
+// the expanded path changes, or by size and interval. Closed files are compressed and removed by retention.
+type OutFile struct {
+	// Secondary receives record sets instead of retrying when files can't be written for Secondary.RetryTimeout.
+	Secondary *SecondaryFile
+
+	config      *ConfigOutFile
+	group       string
+	messageCh   chan *fluent.FluentRecordSet
+	monitorCh   chan Stat
+	files       map[string]*outFileEntry // by path
+	tags        map[string]bool          // tags written, for retention by tags
+	pending     []*fluent.FluentRecordSet
+	failedSince time.Time
+	closedCh    chan string
+	closerEnd   chan interface{}
+	stopCh      chan interface{}
+	done        chan interface{}
+}
+
+type outFileEntry struct {
+	tag    string
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewOutFile(config *ConfigOutFile, group string, messageCh chan *fluent.FluentRecordSet) *OutFile {
+	return &OutFile{
+		config:    config,
+		group:     group,
+		messageCh: messageCh,
+		files:     make(map[string]*outFileEntry),
+		tags:      make(map[string]bool),
+		closedCh:  make(chan string, 16),
+		closerEnd: make(chan interface{}),
+		stopCh:    make(chan interface{}),
+		done:      make(chan interface{}),
+	}
+}
+
+// TakeOver makes f to write the pending record sets of stopped output at first.
+func (f *OutFile) TakeOver(pending []*fluent.FluentRecordSet) {
+	f.pending = pending
+}
+
+// Stop stops writing and waits for closing all files.
+// It returns record sets which couldn't be written yet.
+func (f *OutFile) Stop() []*fluent.FluentRecordSet {
+	close(f.stopCh)
+	<-f.done
+	return f.pending
+}
+
+func (f *OutFile) Run(c *Context) {
+	c.OutputProcess.Add(1)
+	defer c.OutputProcess.Done()
+	defer close(f.done)
+	f.monitorCh = c.MonitorCh
+
+	c.StartProcess.Done()
+
+	go f.closer()
+	defer func() {
+		f.closeAll()
+		close(f.closedCh)
+		<-f.closerEnd
+	}()
+	if f.Secondary != nil {
+		defer func() {
+			if err := f.Secondary.Close(); err != nil {
+				log.Println("[warning] Couldn't close secondary file.", err)
+			}
+		}()
+	}
+
+	f.writePending(time.Now())
+
+	ticker := time.NewTicker(outFileCheckInterval)
+	defer ticker.Stop()
+	retention := time.NewTicker(outFileRetentionInterval)
+	defer retention.Stop()
+	f.retain(time.Now())
+	for {
+		var messageCh chan *fluent.FluentRecordSet
+		if len(f.pending) == 0 {
+			// inputs are not read while retrying, not to keep record sets on memory
+			messageCh = f.messageCh
+		}
+		select {
+		case rs, ok := <-messageCh:
+			if !ok {
+				log.Println("[info] shutdown out_file for server group", f.group)
+				return
+			}
+			f.pending = append(f.pending, rs)
+			f.writePending(time.Now())
+		case now := <-ticker.C:
+			f.writePending(now)
+			f.rotate(now)
+		case now := <-retention.C:
+			f.retain(now)
+		case <-f.stopCh:
+			log.Println("[info] stop out_file for server group", f.group)
+			return
+		}
+	}
+}
+
+// writePending writes pending record sets in order. When a record set couldn't be written,
+// it is kept to retry by the next call, or written to Secondary after Secondary.RetryTimeout.
+func (f *OutFile) writePending(now time.Time) {
+	for len(f.pending) > 0 {
+		rs := f.pending[0]
+		err := f.write(rs, now)
+		if err == nil {
+			f.pending = f.pending[1:]
+			f.failedSince = time.Time{}
+			continue
+		}
+		if f.failedSince.IsZero() {
+			log.Printf("[error] Couldn't write %d messages tag:%s. retry after %s. %s", len(rs.Records), rs.Tag, outFileCheckInterval, err)
+			f.failedSince = now
+		}
+		if f.Secondary == nil || now.Sub(f.failedSince) < f.Secondary.RetryTimeout {
+			return
+		}
+		if err := f.Secondary.Write(rs); err != nil {
+			log.Println("[error] Couldn't write secondary file.", err)
+			return
+		}
+		f.monitorCh <- &SecondaryStat{
+			Tag:      rs.Tag,
+			Messages: int64(len(rs.Records)),
+		}
+		f.pending = f.pending[1:]
+	}
+}
+
+// write writes rs into the file of the tag. Record sets which can't be encoded are dropped.
+func (f *OutFile) write(rs *fluent.FluentRecordSet, now time.Time) error {
+	data, err := f.encode(rs)
+	if err != nil {
+		log.Println("[error] Couldn't encode records.", err)
+		return nil
+	}
+	path := f.config.expandPath(rs.Tag, now)
+	e, ok := f.files[path]
+	if !ok {
+		if e, err = f.open(rs.Tag, path, now); err != nil {
+			return err
+		}
+	}
+	if _, err := e.file.Write(data); err != nil {
+		// the file may have a partial line, so it is rotated
+		f.close(e, true)
+		return err
+	}
+	e.size += int64(len(data))
+	f.tags[outFileTag(rs.Tag)] = true
+	f.monitorCh <- &SentStat{
+		Tag:      rs.Tag,
+		Messages: int64(len(rs.Records)),
+		Bytes:    int64(len(data)),
+		Sents:    1,
+	}
+	if f.config.RotateSize > 0 && e.size >= f.config.RotateSize {
+		f.close(e, true)
+		f.retain(now)
+	}
+	return nil
+}
+
+func (f *OutFile) encode(rs *fluent.FluentRecordSet) ([]byte, error) {
+	if f.config.Format == OutFileMsgpack {
+		return rs.PackAsPackedForward()
+	}
+	decoded, err := decodeRecordSet(rs)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	lenc := ltsv.NewEncoder(&b)
+	for _, record := range decoded.Records {
+		r := record.(*fluent.TinyFluentRecord)
+		// columns compatible with dump files of fluent-http-tailf, which can be replayed
+		if f.config.IncludeTime {
+			b.WriteString(r.Timestamp.Format(time.RFC3339))
+			b.WriteByte('\t')
+		}
+		if f.config.IncludeTag {
+			b.WriteString(rs.Tag)
+			b.WriteByte('\t')
+		}
+		if f.config.Format == OutFileLTSV {
+			err = lenc.Encode(r.Data)
+		} else {
+			err = enc.Encode(r.Data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func (f *OutFile) open(tag, path string, now time.Time) (*outFileEntry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	e := &outFileEntry{tag: tag, path: path, file: file, size: st.Size(), opened: now}
+	f.files[path] = e
+	return e, nil
+}
+
+// rotate closes files which paths are changed by the time, or opened longer than RotateInterval.
+func (f *OutFile) rotate(now time.Time) {
+	closed := false
+	for _, e := range f.files {
+		if f.config.expandPath(e.tag, now) != e.path {
+			f.close(e, false)
+			closed = true
+		} else if f.config.RotateInterval.Duration > 0 && now.Sub(e.opened) >= f.config.RotateInterval.Duration {
+			f.close(e, true)
+			closed = true
+		}
+	}
+	if closed {
+		f.retain(now)
+	}
+}
+
+func (f *OutFile) closeAll() {
+	for _, e := range f.files {
+		f.close(e, false)
+	}
+}
+
+// close closes the file. Rotated files are renamed to "<path>.<N>", because the path is still used.
+// Files are compressed by the closer if Compress is enabled.
+func (f *OutFile) close(e *outFileEntry, rotated bool) {
+	delete(f.files, e.path)
+	if err := e.file.Close(); err != nil {
+		log.Println("[warning]", err)
+	}
+	path := e.path
+	if rotated || f.config.Compress != "" && exists(path+".gz") {
+		path = rotatedPath(e.path)
+		if err := os.Rename(e.path, path); err != nil {
+			log.Println("[error] Couldn't rotate file.", err)
+			return
+		}
+	}
+	if f.config.Compress != "" {
+		f.closedCh <- path
+	}
+}
+
+// rotatedPath returns "<path>.<N>" which doesn't conflict with existing files, including compressed ones.
+func rotatedPath(path string) string {
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s.%d", path, i)
+		if !exists(p) && !exists(p+".gz") {
+			return p
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// closer compresses closed files.
+func (f *OutFile) closer() {
+	defer close(f.closerEnd)
+	for path := range f.closedCh {
+		if err := gzipFile(path); err != nil {
+			log.Println("[error] Couldn't compress file.", err)
+		}
+	}
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz" + bufferTmpSuffix
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(dst)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// retain removes files written by Path which are older than MaxAge, or out of the newest MaxFiles of each tag.
+// Files being written are not removed.
+func (f *OutFile) retain(now time.Time) {
+	if f.config.MaxAge.Duration <= 0 && f.config.MaxFiles <= 0 {
+		return
+	}
+	files, err := f.closedFiles()
+	if err != nil {
+		log.Println("[error]", err)
+		return
+	}
+	if f.config.MaxAge.Duration > 0 {
+		var rest []outFileInfo
+		for _, file := range files {
+			if now.Sub(file.modTime) > f.config.MaxAge.Duration {
+				f.remove(file.path)
+			} else {
+				rest = append(rest, file)
+			}
+		}
+		files = rest
+	}
+	if f.config.MaxFiles <= 0 {
+		return
+	}
+	if !strings.Contains(f.config.Path, "{tag}") {
+		f.removeOld(files, f.config.pathRegexp(""))
+		return
+	}
+	// files of tags not written yet (since started) are not counted to MaxFiles
+	for tag := range f.tags {
+		f.removeOld(files, f.config.pathRegexp(tag))
+	}
+}
+
+type outFileInfo struct {
+	path    string
+	modTime time.Time
+}
+
+// closedFiles returns files matched to the path template which are not being written, from the newest.
+func (f *OutFile) closedFiles() ([]outFileInfo, error) {
+	paths, err := filepath.Glob(f.config.globPath())
+	if err != nil {
+		return nil, err
+	}
+	var files []outFileInfo
+	for _, path := range paths {
+		if _, ok := f.files[path]; ok {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil || st.IsDir() || strings.HasSuffix(path, bufferTmpSuffix) {
+			continue
+		}
+		files = append(files, outFileInfo{path, st.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	return files, nil
+}
+
+// removeOld removes files matched to re out of the newest MaxFiles.
+func (f *OutFile) removeOld(files []outFileInfo, re *regexp.Regexp) {
+	n := 0
+	for _, file := range files {
+		if !re.MatchString(file.path) {
+			continue
+		}
+		if n++; n > f.config.MaxFiles {
+			f.remove(file.path)
+		}
+	}
+}
+
+func (f *OutFile) remove(path string) {
+	log.Println("[info] remove old file", path)
+	if err := os.Remove(path); err != nil {
+		log.Println("[warning]", err)
+	}
+}
+
+// expandPath expands {tag} and %Y, %m, %d, %H, %M, %S of the time in Path.
+func (cf *ConfigOutFile) expandPath(tag string, t time.Time) string {
+	return expandTagTime(cf.Path, outFileTag(tag), t)
+}
+
+// outFileTag returns tag which can be used as a part of paths.
+// Path separators are replaced with "_", and so are "." and ".." not to change directories.
+func outFileTag(tag string) string {
+	tag = strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(tag)
+	if strings.Trim(tag, ".") == "" {
+		tag = strings.Repeat("_", len(tag))
+	}
+	if tag == "" {
+		tag = "_"
+	}
+	return tag
+}
+
+// expandTagTime expands {tag} and %Y, %m, %d, %H, %M, %S of t in s.
+func expandTagTime(s, tag string, t time.Time) string {
+	return strings.NewReplacer(
+		"{tag}", tag,
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+	).Replace(s)
+}
+
+// pathRegexp returns the regexp matched to files of the tag written by Path, including rotated and compressed ones.
+// If tag is empty, files of any tags are matched.
+func (cf *ConfigOutFile) pathRegexp(tag string) *regexp.Regexp {
+	tagPattern := ".*"
+	if tag != "" {
+		tagPattern = regexp.QuoteMeta(tag)
+	}
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta("{tag}"), tagPattern,
+		"%Y", `\d{4}`,
+		"%m", `\d{2}`,
+		"%d", `\d{2}`,
+		"%H", `\d{2}`,
+		"%M", `\d{2}`,
+		"%S", `\d{2}`,
+	).Replace(regexp.QuoteMeta(cf.Path))
+	return regexp.MustCompile(`^` + pattern + `(\.\d+)?(\.gz)?$`)
+}
+
+// globPath returns the glob pattern matched to all files written by Path, including rotated and compressed ones.
+func (cf *ConfigOutFile) globPath() string {
+	return strings.NewReplacer(
+		"{tag}", "*",
+		"%Y", "*",
+		"%m", "*",
+		"%d", "*",
+		"%H", "*",
+		"%M", "*",
+		"%S", "*",
+	).Replace(cf.Path) + "*"
+}
@@ -0,0 +1,277 @@
+package hydra_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func runOutFile(t *testing.T, config *hydra.ConfigOutFile, sets ...*fluent.FluentRecordSet) {
+	config.Restrict(nil)
+	c := hydra.NewContext()
+	c.RunProcess(hydra.NewOutFile(config, "default", c.MessageCh))
+	c.StartProcess.Wait()
+	for _, rs := range sets {
+		c.MessageCh <- rs
+	}
+	c.Shutdown()
+}
+
+func readLines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestOutFile(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	config := &hydra.ConfigOutFile{
+		Path:       filepath.Join(dir, "{tag}", "%Y%m%d.log"),
+		IncludeTag: true,
+	}
+	var sets []*fluent.FluentRecordSet
+	for _, tag := range []string{"a", "b", "a"} {
+		rs := prepareRecordSet()
+		rs.Tag = tag
+		sets = append(sets, rs)
+	}
+	runOutFile(t, config, sets...)
+
+	today := time.Now().Format("20060102")
+	for _, e := range []struct {
+		tag   string
+		lines int
+	}{{"a", 2 * len(TestMessageLines)}, {"b", len(TestMessageLines)}} {
+		lines := readLines(t, filepath.Join(dir, e.tag, today+".log"))
+		if len(lines) != e.lines {
+			t.Errorf("%s: %d lines expected %d", e.tag, len(lines), e.lines)
+			continue
+		}
+		for i, line := range lines {
+			expected := e.tag + "\t" + `{"message":"` + TestMessageLines[i%len(TestMessageLines)] + `"}`
+			if line != expected {
+				t.Errorf("%s: line %s expected %s", e.tag, line, expected)
+			}
+		}
+	}
+}
+
+func TestOutFileLTSV(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "{tag}.log")
+	runOutFile(t, &hydra.ConfigOutFile{Path: path, Format: hydra.OutFileLTSV}, prepareRecordSet())
+
+	lines := readLines(t, filepath.Join(dir, TestTag+".log"))
+	if len(lines) != len(TestMessageLines) {
+		t.Fatalf("%d lines expected %d", len(lines), len(TestMessageLines))
+	}
+	for i, line := range lines {
+		if expected := TestFieldName + ":" + TestMessageLines[i]; line != expected {
+			t.Errorf("line %s expected %s", line, expected)
+		}
+	}
+}
+
+func TestOutFileRotateCompress(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	config := &hydra.ConfigOutFile{
+		Path:        filepath.Join(dir, "{tag}.log"),
+		IncludeTime: true,
+		RotateSize:  1,
+		Compress:    "gzip",
+	}
+	n := 3
+	var sets []*fluent.FluentRecordSet
+	for i := 0; i < n; i++ {
+		sets = append(sets, prepareRecordSet())
+	}
+	runOutFile(t, config, sets...)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != n {
+		t.Fatalf("%d files expected %d (rotated by size): %v", len(files), n, files)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".gz") {
+			t.Errorf("%s is not compressed", file)
+			continue
+		}
+		lines := readLines(t, file)
+		if len(lines) != len(TestMessageLines) {
+			t.Errorf("%s: %d lines expected %d", file, len(lines), len(TestMessageLines))
+		}
+		for _, line := range lines {
+			ts := strings.SplitN(line, "\t", 2)[0]
+			if _, err := time.Parse(time.RFC3339, ts); err != nil {
+				t.Errorf("%s: line doesn't start with time: %s", file, line)
+			}
+		}
+	}
+}
+
+func TestOutFileRetention(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "old.log")
+	ioutil.WriteFile(old, []byte("{}\n"), 0644)
+	past := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	config := &hydra.ConfigOutFile{
+		Path:       filepath.Join(dir, "{tag}.log"),
+		RotateSize: 1,
+		MaxAge:     hydra.Duration{Duration: 24 * time.Hour},
+		MaxFiles:   2,
+	}
+	var sets []*fluent.FluentRecordSet
+	for i := 0; i < 5; i++ {
+		sets = append(sets, prepareRecordSet())
+	}
+	runOutFile(t, config, sets...)
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("%s older than MaxAge must be removed", old)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 2 {
+		t.Errorf("%d files expected 2 (MaxFiles): %v", len(files), files)
+	}
+}
+
+func TestOutFileTagPath(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "logs")
+	var sets []*fluent.FluentRecordSet
+	for _, tag := range []string{"..", ".", "a/../../b"} {
+		rs := prepareRecordSet()
+		rs.Tag = tag
+		sets = append(sets, rs)
+	}
+	runOutFile(t, &hydra.ConfigOutFile{Path: filepath.Join(base, "{tag}", "out.log")}, sets...)
+
+	for _, name := range []string{"__", "_", "a_.._.._b"} {
+		if lines := readLines(t, filepath.Join(base, name, "out.log")); len(lines) != len(TestMessageLines) {
+			t.Errorf("%s: %d lines expected %d", name, len(lines), len(TestMessageLines))
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("files must not be written out of %s: %v", base, files)
+	}
+}
+
+func TestOutFileRetentionByTag(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	config := &hydra.ConfigOutFile{
+		Path:       filepath.Join(dir, "{tag}.log"),
+		RotateSize: 1,
+		MaxFiles:   2,
+	}
+	var sets []*fluent.FluentRecordSet
+	for _, tag := range []string{"a", "a", "a", "a", "ab", "a"} {
+		rs := prepareRecordSet()
+		rs.Tag = tag
+		sets = append(sets, rs)
+	}
+	runOutFile(t, config, sets...)
+
+	for _, e := range []struct {
+		pattern string
+		files   int
+	}{{"a.log*", 2}, {"ab.log*", 1}} {
+		if files, _ := filepath.Glob(filepath.Join(dir, e.pattern)); len(files) != e.files {
+			t.Errorf("%d files expected %d (MaxFiles by tag): %v", len(files), e.files, files)
+		}
+	}
+}
+
+func TestOutFileWriteError(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	// the path can't be opened as a file until the directory is removed
+	path := filepath.Join(dir, TestTag+".log")
+	os.Mkdir(path, 0755)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		os.Remove(path)
+	}()
+	runOutFile(t, &hydra.ConfigOutFile{Path: filepath.Join(dir, "{tag}.log")}, prepareRecordSet())
+
+	if lines := readLines(t, path); len(lines) != len(TestMessageLines) {
+		t.Errorf("%d lines expected %d (written by retry)", len(lines), len(TestMessageLines))
+	}
+}
+
+func TestOutFileSecondary(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-file")
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, TestTag+".log"), 0755)
+	config := &hydra.ConfigOutFile{Path: filepath.Join(dir, "{tag}.log")}
+	config.Restrict(nil)
+	secondary := &hydra.ConfigSecondary{
+		Path:         filepath.Join(dir, "secondary"),
+		RetryTimeout: hydra.Duration{Duration: time.Millisecond},
+	}
+	secondary.Restrict(nil)
+
+	c := hydra.NewContext()
+	outFile := hydra.NewOutFile(config, "default", c.MessageCh)
+	s, err := hydra.NewSecondaryFile(secondary, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outFile.Secondary = s
+	c.RunProcess(outFile)
+	c.StartProcess.Wait()
+	c.MessageCh <- prepareRecordSet()
+	c.Shutdown()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "secondary", "*"))
+	if len(files) != 1 {
+		t.Fatalf("%d secondary files expected 1: %v", len(files), files)
+	}
+	n := 0
+	hydra.ReadSecondaryFile(files[0], func(rs *fluent.FluentRecordSet) error {
+		n += len(rs.Records)
+		return nil
+	})
+	if n != len(TestMessageLines) {
+		t.Errorf("%d records in secondary expected %d", n, len(TestMessageLines))
+	}
+}
@@ -1,53 +1,184 @@
 package hydra
 
 import (
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/fujiwara/fluent-agent-hydra/fluent"
 )
 
 type OutForward struct {
-	loggers    []*fluent.Fluent
+	loggers    []*Endpoints
+	compress   []string // compression for each logger
+	standby    []bool
+	wrr        *weightedRoundRobin
+	ring       *hashRing
 	messageCh  chan *fluent.FluentRecordSet
 	monitorCh  chan Stat
 	sent       int64
 	RoundRobin bool
+
+	// Batcher coalesces and splits record sets before sending.
+	Batcher *Batcher
+
+	// RequireAckResponse makes f to send chunks with the chunk option and wait for ack responses.
+	RequireAckResponse bool
+	AckResponseTimeout time.Duration
+
+	// Heartbeat enables heartbeats to servers. Servers marked down are not used to send.
+	Heartbeat *ConfigHeartbeat
+
+	// Secondary receives record sets instead of retrying when all servers are unavailable for Secondary.RetryTimeout.
+	Secondary *SecondaryFile
+
+	// HashKey sends records which have the same value of the field (or the same tag for HashKeyTag)
+	// to the same server by consistent hashing.
+	HashKey string
+
+	pending   []*fluent.FluentRecordSet
+	group     string
+	worker    int // index of the sender worker in the group
+	statIndex int // index of the first server in stats
+	ackStats  []ackStat
+	sentStats []sentCounter
+	detectors []*FailureDetector
+	down      []bool
+	mu        sync.Mutex
+	stopCh    chan interface{}
+	done      chan interface{}
+
+	buffer      *DiskBuffer
+	held        *fluent.FluentRecordSet // couldn't be written to buffer because it is full
+	inputClosed bool
+	unavailable bool
+	downSince   time.Time // when all servers became unavailable
+}
+
+type ackStat struct {
+	latency time.Duration
+	resends int64
+}
+
+// sentCounter counts records sent to a server by the worker.
+type sentCounter struct {
+	messages int64
+	bytes    int64
 }
 
 const (
 	serverHealthCheckInterval = 3 * time.Second
-	maxKeepAliveSentCount     = 100
 )
 
 // OutForward ... recieve FluentRecordSet from channel, and send it to passed loggers until success.
 func NewOutForward(configServers []*ConfigServer) (*OutForward, error) {
-	loggers := make([]*fluent.Fluent, len(configServers))
+	loggers := make([]*Endpoints, len(configServers))
+	compress := make([]string, len(configServers))
+	standby := make([]bool, len(configServers))
+	weights := make([]int, len(configServers))
 	for i, server := range configServers {
-		logger, err := fluent.New(fluent.Config{Server: server.Address()})
+		compress[i] = server.Compress
+		standby[i] = server.standby()
+		weights[i] = server.weight()
+		if weights[i] <= 0 {
+			weights[i] = DefaultServerWeight
+		}
+		tlsConfig, err := server.TLSConfig()
 		if err != nil {
-			log.Println("[warning]", err)
-		} else {
-			log.Println("[info] Server", server.Address(), "connected")
+			return nil, fmt.Errorf("Server %s: %s", server.Address(), err)
 		}
-		loggers[i] = logger
-		logger.Send([]byte{})
+		loggers[i] = NewEndpoints(fluent.Config{
+			Server:              server.Address(),
+			Timeout:             server.WriteTimeout.Duration,
+			ConnectTimeout:      server.ConnectTimeout.Duration,
+			RetryWait:           int(server.RetryWait.Duration / time.Millisecond),
+			MaxRetry:            server.MaxRetry,
+			RetryWaitMax:        server.RetryWaitMax.Duration,
+			RetryJitter:         server.RetryJitter,
+			ReconnectAfterSends: server.ReconnectAfterSends,
+			ReconnectInterval:   server.ReconnectInterval.Duration,
+			KeepAlive:           server.TCPKeepAlive.Duration,
+			TLSConfig:           tlsConfig,
+			SharedKey:           server.SharedKey,
+			SelfHostname:        server.SelfHostname,
+			Username:            server.Username,
+			Password:            server.Password,
+		}, server.ResolveInterval.Duration)
 	}
 	return &OutForward{
-		loggers: loggers,
-		sent:    0,
+		loggers:            loggers,
+		compress:           compress,
+		standby:            standby,
+		wrr:                newWeightedRoundRobin(weights),
+		ring:               newHashRing(configServers, weights),
+		sent:               0,
+		AckResponseTimeout: DefaultAckResponseTimeout,
+		Batcher:            NewBatcher(0, 0, 0),
+		ackStats:           make([]ackStat, len(loggers)),
+		sentStats:          make([]sentCounter, len(loggers)),
+		stopCh:             make(chan interface{}),
+		done:               make(chan interface{}),
 	}, nil
 }
 
+// EnableBuffer makes f to store record sets into the disk buffer in dir while all servers are unavailable.
+func (f *OutForward) EnableBuffer(dir string, limit int64) error {
+	b, err := NewDiskBuffer(dir, limit)
+	if err != nil {
+		return err
+	}
+	f.buffer = b
+	return nil
+}
+
+// Stop stops forwarding and waits for finishing it.
+// Record sets which couldn't be sent yet are returned to hand over to the next OutForward.
+func (f *OutForward) Stop() []*fluent.FluentRecordSet {
+	close(f.stopCh)
+	<-f.done
+	if f.held != nil {
+		f.pending = append(f.pending, f.held)
+		f.held = nil
+	}
+	f.pending = append(f.pending, f.Batcher.Drain()...)
+	return f.pending
+}
+
+// TakeOver makes f to send the pending record sets of stopped OutForward at first.
+func (f *OutForward) TakeOver(pending []*fluent.FluentRecordSet) {
+	f.pending = pending
+}
+
 func (f *OutForward) Run(c *Context) {
 	c.OutputProcess.Add(1)
 	defer c.OutputProcess.Done()
-	f.messageCh = c.MessageCh
+	defer close(f.done)
+	if f.messageCh == nil {
+		f.messageCh = c.OutputCh
+	}
 	f.monitorCh = c.MonitorCh
 
 	c.StartProcess.Done()
 
-	for i, _ := range f.loggers {
+	if f.Secondary != nil {
+		defer func() {
+			if err := f.Secondary.Close(); err != nil {
+				log.Println("[warning] Couldn't close secondary file.", err)
+			}
+		}()
+	}
+	if f.Heartbeat != nil {
+		now := time.Now()
+		f.detectors = make([]*FailureDetector, len(f.loggers))
+		f.down = make([]bool, len(f.loggers))
+		for i := range f.loggers {
+			f.detectors[i] = f.Heartbeat.NewFailureDetector(now)
+			f.down[i] = true // until the first heartbeat
+			go f.heartbeat(i)
+		}
+	}
+	for i := range f.loggers {
 		go f.checkServerHealth(i)
 	}
 
@@ -64,72 +195,434 @@ func (f *OutForward) Run(c *Context) {
 	}
 }
 
-func (f *OutForward) outForwardRecieve() error {
-	recordSet, ok := <-f.messageCh
-	if !ok {
-		for _, logger := range f.loggers {
-			logger.Shutdown()
-		}
-		return Signal{"shutdown out_forward"}
+func (f *OutForward) shutdownLoggers() {
+	for _, logger := range f.loggers {
+		logger.Shutdown()
 	}
-	first := true
-	packed, err := recordSet.PackAsPackedForward()
+}
+
+func (f *OutForward) outForwardRecieve() error {
+	recordSet, fromBuffer, err := f.next()
 	if err != nil {
 		return err
 	}
-	nLoggers := int64(len(f.loggers))
-	for {
-		var loggers []*fluent.Fluent
-		if f.RoundRobin {
-			index := f.sent % nLoggers
-			loggers = f.loggers[index:nLoggers]
-			loggers = append(loggers, f.loggers[0:index]...)
-		} else {
-			loggers = f.loggers
+	if f.HashKey != "" {
+		return f.sendHashed(recordSet, fromBuffer)
+	}
+	p := f.newPacker(recordSet)
+	for _, i := range f.candidates() {
+		if !f.available(i) {
+			continue
 		}
-	LOGGER:
-		for _, logger := range loggers {
-			if logger.IsReconnecting() {
-				continue LOGGER
-			}
-			err := logger.Send(packed)
-			if err != nil {
-				log.Println("[error]", err)
-				continue LOGGER
+		sent, err := f.sendTo(i, p)
+		if err != nil {
+			f.consume(fromBuffer)
+			return err
+		}
+		if sent {
+			f.consume(fromBuffer)
+			return nil // success
+		}
+	}
+	// all loggers seems down...
+	return f.waitServers(recordSet, fromBuffer)
+}
+
+func (f *OutForward) newPacker(recordSet *fluent.FluentRecordSet) *packer {
+	option := fluent.Option{}
+	if f.RequireAckResponse {
+		option.Chunk = fluent.NewChunkID()
+	}
+	return &packer{recordSet: recordSet, option: option}
+}
+
+func (f *OutForward) available(i int) bool {
+	return !f.loggers[i].IsReconnecting() && !f.isDown(i)
+}
+
+// sendTo sends the record set of p to the i-th server. It returns an error only when the record set couldn't be packed.
+func (f *OutForward) sendTo(i int, p *packer) (bool, error) {
+	packed, err := p.pack(f.compress[i])
+	if err != nil {
+		return false, err
+	}
+	if err := f.send(i, packed, p.option.Chunk); err != nil {
+		log.Println("[error]", err)
+		return false, nil
+	}
+	f.monitorCh <- &SentStat{
+		Tag:      p.recordSet.Tag,
+		Messages: int64(len(p.recordSet.Records)),
+		Bytes:    int64(len(packed)),
+		Sents:    1,
+	}
+	f.mu.Lock()
+	f.sentStats[i].messages += int64(len(p.recordSet.Records))
+	f.sentStats[i].bytes += int64(len(packed))
+	f.mu.Unlock()
+	f.sent++
+	if f.unavailable {
+		log.Println("[info] Servers are available again")
+		f.unavailable = false
+		if f.Secondary != nil {
+			if err := f.Secondary.Close(); err != nil {
+				log.Println("[warning] Couldn't close secondary file.", err)
 			}
-			f.monitorCh <- &SentStat{
+		}
+	}
+	return true, nil
+}
+
+// waitServers waits for reconnecting servers while all servers are unavailable.
+// The record set is sent again (from the head of buffer if enabled) after that.
+// When servers are unavailable longer than the retry timeout of Secondary, the record set is written to Secondary instead.
+func (f *OutForward) waitServers(recordSet *fluent.FluentRecordSet, fromBuffer bool) error {
+	if !f.unavailable {
+		log.Printf(
+			"[warning] All servers are unavailable. pending %d messages tag:%s",
+			len(recordSet.Records),
+			recordSet.Tag,
+		)
+		f.unavailable = true
+		f.downSince = time.Now()
+	}
+	if f.Secondary != nil && time.Since(f.downSince) >= f.Secondary.RetryTimeout {
+		if err := f.Secondary.Write(recordSet); err != nil {
+			log.Println("[error] Couldn't write secondary file.", err)
+		} else {
+			f.monitorCh <- &SecondaryStat{
 				Tag:      recordSet.Tag,
 				Messages: int64(len(recordSet.Records)),
-				Bytes:    int64(len(packed)),
-				Sents:    1,
 			}
-			f.sent++
-			if logger.Sent%maxKeepAliveSentCount == 0 {
-				logger.RefreshConnection()
+			f.consume(fromBuffer)
+			return nil
+		}
+	}
+	if f.buffer != nil {
+		// keep reading inputs into buffer while waiting
+		f.spoolPending()
+	}
+	return f.wait()
+}
+
+// sendHashed splits the record set by the consistent hash of HashKey, and sends each part to the server on the ring.
+// Records which couldn't be sent are hashed again to the next available server on the ring.
+func (f *OutForward) sendHashed(recordSet *fluent.FluentRecordSet, fromBuffer bool) error {
+	if len(recordSet.Records) == 0 {
+		f.consume(fromBuffer)
+		return nil
+	}
+	for {
+		parts := f.split(recordSet)
+		if parts == nil {
+			return f.waitServers(recordSet, fromBuffer)
+		}
+		var rest []fluent.FluentRecordType
+		for _, part := range parts {
+			sent, err := f.sendTo(part.server, f.newPacker(part.recordSet))
+			if err != nil {
+				f.consume(fromBuffer)
+				return err
+			}
+			if !sent {
+				rest = append(rest, part.recordSet.Records...)
 			}
+		}
+		if len(rest) == 0 {
+			f.consume(fromBuffer)
 			return nil // success
 		}
-		// all loggers seems down...
-		if first {
-			log.Printf(
-				"[warning] All servers are unavailable. pending %d messages tag:%s",
-				len(recordSet.Records),
-				recordSet.Tag,
-			)
-			first = false
+		recordSet = &fluent.FluentRecordSet{Tag: recordSet.Tag, Records: rest}
+		// not to send parts which were already sent again
+		if !fromBuffer {
+			f.pending[0] = recordSet
+		} else if err := f.buffer.ReplaceHead(recordSet); err != nil {
+			log.Println("[warning] Couldn't write the rest of buffer chunk. sent records may be sent again.", err)
 		}
-		time.Sleep(1 * time.Second) // waiting for any logger will be reconnected
 	}
 }
 
+// next returns a record set to send. Pending record sets are sent at first, and then buffered ones.
+// While the buffer is not empty, record sets from inputs are appended to buffer to keep the order.
+func (f *OutForward) next() (*fluent.FluentRecordSet, bool, error) {
+	f.Batcher.Flush(time.Now(), f.inputClosed)
+	if f.buffer != nil && (f.buffer.Len() > 0 || f.held != nil) {
+		f.spoolPending()
+		f.spoolInputs()
+	}
+	for {
+		if len(f.pending) > 0 {
+			return f.pending[0], false, nil
+		}
+		if f.buffer != nil {
+			if rs := f.buffer.Peek(); rs != nil {
+				return rs, true, nil
+			}
+		}
+		if rs := f.Batcher.Next(); rs != nil {
+			f.pending = append(f.pending, rs)
+			continue
+		}
+		if f.inputClosed {
+			f.shutdownLoggers()
+			return nil, false, Signal{"shutdown out_forward"}
+		}
+		var (
+			timer   *time.Timer
+			flushCh <-chan time.Time
+		)
+		if deadline, ok := f.Batcher.Deadline(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			flushCh = timer.C
+		}
+		select {
+		case rs, ok := <-f.messageCh:
+			if !ok {
+				f.inputClosed = true
+				f.Batcher.Flush(time.Now(), true)
+				continue
+			}
+			f.Batcher.Add(rs)
+		case now := <-flushCh:
+			f.Batcher.Flush(now, false)
+		case <-f.stopCh:
+			f.shutdownLoggers()
+			return nil, false, Signal{"stop out_forward"}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// consume removes the record set which was sent (or couldn't be packed).
+func (f *OutForward) consume(fromBuffer bool) {
+	if fromBuffer {
+		f.buffer.Pop()
+	} else {
+		f.pending = f.pending[1:]
+	}
+}
+
+// wait waits for reconnecting servers. With buffer, inputs are written into buffer while waiting.
+func (f *OutForward) wait() error {
+	timer := time.NewTimer(1 * time.Second) // waiting for any logger will be reconnected
+	defer timer.Stop()
+	for {
+		if f.buffer != nil && f.inputClosed {
+			// all of inputs were stored into buffer
+			f.Batcher.Flush(time.Now(), true)
+			f.spoolPending()
+			f.spoolInputs()
+			if len(f.pending) > 0 || f.held != nil || len(f.Batcher.Drain()) > 0 {
+				log.Println("[warning] some record sets couldn't be written to buffer and are lost")
+			}
+			f.shutdownLoggers()
+			return Signal{"shutdown out_forward. buffered messages will be sent after restart"}
+		}
+		var inputCh chan *fluent.FluentRecordSet
+		if f.buffer != nil && f.held == nil {
+			inputCh = f.messageCh
+		}
+		select {
+		case <-timer.C:
+			return nil
+		case rs, ok := <-inputCh:
+			if !ok {
+				f.inputClosed = true
+				continue
+			}
+			f.Batcher.Add(rs)
+			// spoolInputs may find inputs closed
+			f.spoolInputs()
+		case <-f.stopCh:
+			f.shutdownLoggers()
+			return Signal{"stop out_forward"}
+		}
+	}
+}
+
+// spoolPending moves pending record sets into buffer.
+func (f *OutForward) spoolPending() {
+	for len(f.pending) > 0 && f.held == nil {
+		if err := f.buffer.Push(f.pending[0]); err != nil {
+			if err != ErrBufferFull {
+				log.Println("[error] Couldn't write buffer", err)
+			}
+			return
+		}
+		f.pending = f.pending[1:]
+	}
+}
+
+// spoolInputs moves record sets which are ready in inputs into buffer (through Batcher) without blocking.
+func (f *OutForward) spoolInputs() {
+	if f.held != nil {
+		f.push(nil)
+	}
+	for f.held == nil {
+		if rs := f.Batcher.Next(); rs != nil {
+			f.push(rs)
+			continue
+		}
+		if f.inputClosed {
+			return
+		}
+		select {
+		case rs, ok := <-f.messageCh:
+			if !ok {
+				f.inputClosed = true
+				f.Batcher.Flush(time.Now(), true)
+				continue
+			}
+			f.Batcher.Add(rs)
+		default:
+			return
+		}
+	}
+}
+
+// push writes rs (or the held one when rs is nil) into buffer.
+// When buffer is full, rs is held and reading inputs is paused until buffer has a room.
+func (f *OutForward) push(rs *fluent.FluentRecordSet) {
+	if rs == nil {
+		rs = f.held
+	}
+	if err := f.buffer.Push(rs); err != nil {
+		if f.held == nil {
+			log.Println("[warning] Couldn't write buffer. stop reading inputs.", err)
+		}
+		f.held = rs
+		return
+	}
+	f.held = nil
+}
+
+// send sends packed to the i-th server. When RequireAckResponse is enabled, it waits for the ack of the chunk.
+func (f *OutForward) send(i int, packed []byte, chunk string) error {
+	logger := f.loggers[i]
+	if !f.RequireAckResponse {
+		return logger.Send(packed)
+	}
+	start := time.Now()
+	err := logger.SendWithAck(packed, chunk, f.AckResponseTimeout)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := err.(*fluent.AckError); ok {
+		// the chunk will be resent to another server
+		f.ackStats[i].resends++
+	} else if err == nil {
+		f.ackStats[i].latency = time.Since(start)
+	}
+	return err
+}
+
 func (f *OutForward) checkServerHealth(i int) {
-	c := time.Tick(serverHealthCheckInterval)
-	for _ = range c {
+	ticker := time.NewTicker(serverHealthCheckInterval)
+	defer ticker.Stop()
+	var prev sentCounter
+	last := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-f.stopCh:
+			return
+		}
+		f.mu.Lock()
+		as := f.ackStats[i]
+		sc := f.sentStats[i]
+		f.mu.Unlock()
+		elapsed := now.Sub(last).Seconds()
+		alive := f.loggers[i].Alive() && !f.isDown(i)
 		f.monitorCh <- &ServerStat{
-			Index:   i,
-			Address: f.loggers[i].Server,
-			Alive:   f.loggers[i].Alive(),
-			Error:   f.loggers[i].LastErrorString(),
+			Index:      f.statIndex + i,
+			Group:      f.group,
+			Address:    f.loggers[i].Server,
+			Endpoints:  f.loggers[i].Addresses(),
+			Alive:      alive,
+			Error:      f.loggers[i].LastErrorString(),
+			AckLatency: as.latency.Seconds(),
+			Resends:    as.resends,
+			Worker:     f.worker,
+			Connections: []*ConnectionStat{
+				{
+					Alive:          alive,
+					Messages:       sc.messages,
+					Bytes:          sc.bytes,
+					MessagesPerSec: float64(sc.messages-prev.messages) / elapsed,
+					BytesPerSec:    float64(sc.bytes-prev.bytes) / elapsed,
+				},
+			},
 		}
+		prev, last = sc, now
+	}
+}
+
+// heartbeat sends heartbeats to the i-th server, and marks it down or up by the failure detector.
+// The first heartbeat is sent immediately, because the server is down until it arrives.
+func (f *OutForward) heartbeat(i int) {
+	interval := f.Heartbeat.Interval.Duration
+	addr := f.loggers[i].Server
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ticker.C:
+			case <-f.stopCh:
+				return
+			case <-f.done:
+				return
+			}
+		}
+		err := sendHeartbeat(f.Heartbeat.Type, f.loggers[i], interval)
+		now := time.Now()
+		f.mu.Lock()
+		if err == nil {
+			f.detectors[i].Heartbeat(now)
+		}
+		available := f.detectors[i].Available(now)
+		changed := available == f.down[i]
+		f.down[i] = !available
+		f.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if available {
+			log.Printf("[info] Server %s is available by heartbeat", addr)
+		} else {
+			log.Printf("[warning] Server %s is marked down by heartbeat. %v", addr, err)
+		}
+	}
+}
+
+func (f *OutForward) isDown(i int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return i < len(f.down) && f.down[i]
+}
+
+// packer packs a record set lazily for each compression of servers.
+type packer struct {
+	recordSet *fluent.FluentRecordSet
+	option    fluent.Option
+	packed    map[string][]byte
+}
+
+func (p *packer) pack(compress string) ([]byte, error) {
+	if packed, ok := p.packed[compress]; ok {
+		return packed, nil
+	}
+	option := p.option
+	option.Compressed = compress
+	packed, err := p.recordSet.PackAsPackedForwardWithOption(option)
+	if err != nil {
+		return nil, err
+	}
+	if p.packed == nil {
+		p.packed = make(map[string][]byte, 1)
 	}
+	p.packed[compress] = packed
+	return packed, nil
 }
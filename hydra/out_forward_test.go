@@ -2,8 +2,11 @@ package hydra_test
 
 import (
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -197,3 +200,198 @@ func handleConn(conn net.Conn, t *testing.T, counter *int64) {
 		}
 	}
 }
+
+func TestForwardAckResend(t *testing.T) {
+	log.Println("---- TestForwardAckResend ----")
+	counter := int64(0)
+	// the mock server never responds ack
+	primaryAddr, primaryCloser := runMockServer(t, "", &counter)
+	defer close(primaryCloser)
+
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{
+		newConfigServer(primaryAddr),
+		newConfigServer(inForward.Addr.String()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.RequireAckResponse = true
+	outForward.AckResponseTimeout = 500 * time.Millisecond
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	c.MessageCh <- prepareRecordSet()
+	select {
+	case rs := <-receiver.MessageCh:
+		if len(rs.Records) != len(TestMessageLines) {
+			t.Errorf("resent records %d expected %d", len(rs.Records), len(TestMessageLines))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("records were not resent to the secondary server")
+	}
+
+	timeout := time.After(5 * time.Second)
+	var primary, secondary *hydra.ServerStat
+	for primary == nil || secondary == nil {
+		select {
+		case stat := <-c.MonitorCh:
+			if s, ok := stat.(*hydra.ServerStat); ok {
+				if s.Index == 0 {
+					primary = s
+				} else {
+					secondary = s
+				}
+			}
+		case <-timeout:
+			t.Fatal("server stats were not reported")
+		}
+	}
+	if primary.Resends != 1 {
+		t.Errorf("primary resends %d expected 1", primary.Resends)
+	}
+	if secondary.Resends != 0 || secondary.AckLatency <= 0 {
+		t.Errorf("unexpected secondary stat %#v", secondary)
+	}
+}
+
+func TestForwardBuffer(t *testing.T) {
+	log.Println("---- TestForwardBuffer ----")
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-buffer")
+	defer os.RemoveAll(dir)
+
+	// reserve an address, and leave the server down
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{newConfigServer(addr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outForward.EnableBuffer(dir, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+
+	for i := 0; i < hydra.MessageChannelBufferLen+10; i++ {
+		select {
+		case c.MessageCh <- prepareRecordSet():
+		case <-time.After(3 * time.Second):
+			t.Fatal("inputs are blocked while servers are down")
+		}
+	}
+	// shutdown while servers are down. all record sets are kept in buffer
+	c.Shutdown()
+	chunks, _ := filepath.Glob(filepath.Join(dir, "*.chunk"))
+	if len(chunks) != hydra.MessageChannelBufferLen+10 {
+		t.Errorf("%d chunks expected, got %d", hydra.MessageChannelBufferLen+10, len(chunks))
+	}
+
+	// restart with the server, buffered record sets are sent
+	counter := int64(0)
+	_, closer := runMockServer(t, addr, &counter)
+	defer close(closer)
+	c = hydra.NewContext()
+	outForward, _ = hydra.NewOutForward([]*hydra.ConfigServer{newConfigServer(addr)})
+	outForward.EnableBuffer(dir, 1024*1024)
+	c.RunProcess(outForward)
+	c.MessageCh <- prepareRecordSet()
+	sleep(3)
+	expected := int64((hydra.MessageChannelBufferLen + 11) * len(TestMessageLines))
+	if n := atomic.LoadInt64(&counter); n != expected {
+		t.Errorf("recieved %d expected %d", n, expected)
+	}
+	chunks, _ = filepath.Glob(filepath.Join(dir, "*.chunk"))
+	if len(chunks) != 0 {
+		t.Errorf("buffer must be empty. %d chunks left", len(chunks))
+	}
+	c.Shutdown()
+}
+
+func TestForwardBatch(t *testing.T) {
+	log.Println("---- TestForwardBatch ----")
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{newConfigServer(inForward.Addr.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.Batcher = hydra.NewBatcher(0, 0, 500*time.Millisecond)
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	for i := 0; i < 5; i++ {
+		c.MessageCh <- prepareRecordSet()
+	}
+	select {
+	case rs := <-receiver.MessageCh:
+		if len(rs.Records) != 5*len(TestMessageLines) {
+			t.Errorf("record sets must be coalesced into a chunk. got %d records", len(rs.Records))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("chunk was not flushed")
+	}
+}
+
+func TestForwardCompress(t *testing.T) {
+	log.Println("---- TestForwardCompress ----")
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	server := newConfigServer(inForward.Addr.String())
+	server.Compress = "gzip"
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.RequireAckResponse = true
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+
+	c.MessageCh <- prepareRecordSet()
+	select {
+	case rs := <-receiver.MessageCh:
+		if len(rs.Records) != len(TestMessageLines) {
+			t.Errorf("recieved %d records expected %d", len(rs.Records), len(TestMessageLines))
+		}
+		for i, record := range rs.Records {
+			if msg, _ := record.GetData("message"); msg != TestMessageLines[i] {
+				t.Errorf("unexpected message %v expected %s", msg, TestMessageLines[i])
+			}
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("compressed records were not recieved")
+	}
+}
@@ -0,0 +1,624 @@
+package hydra
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	OutHTTPNDJSON = "ndjson"
+	OutHTTPJSON   = "json"
+
+	DefaultHTTPTimeout      = 10 * time.Second
+	DefaultHTTPRetryWait    = 500 * time.Millisecond
+	DefaultHTTPRetryWaitMax = 30 * time.Second
+
+	httpErrorBodyLimit    = 512       // bytes of response bodies included in errors
+	httpResponseBodyLimit = 64 * 1024 // bytes of error responses read
+)
+
+// httpProtocol makes request bodies of record sets, and checks responses for OutHTTP.
+type httpProtocol interface {
+	// encode returns the request body of rs and its content type.
+	encode(rs *fluent.FluentRecordSet) ([]byte, string, error)
+
+	// accepted is called with the body of a successful response.
+	// It returns records of rs which must be sent again (or nil), and the number of records rejected.
+	// An error means the results of records are unknown, and the whole of rs is sent again.
+	accepted(rs *fluent.FluentRecordSet, body []byte) (*fluent.FluentRecordSet, int, error)
+}
+
+// httpRejectionHandler is implemented by protocols which endpoints may accept a part of records in error responses.
+// rejected returns the number of records rejected, and true if the others were accepted.
+type httpRejectionHandler interface {
+	rejected(rs *fluent.FluentRecordSet, e *httpStatusError) (int, bool)
+}
+
+// httpStatReporter is implemented by protocols which report their own stats of record sets sent.
+// rejection is the error response of records partially rejected, or empty.
+type httpStatReporter interface {
+	stats(rs *fluent.FluentRecordSet, rejection string) []Stat
+}
+
+// httpHealthChecker is implemented by protocols which can get the health status of endpoints.
+// get sends a GET request with the headers of the output.
+type httpHealthChecker interface {
+	health(get func(url string) (*http.Response, error), url string) (string, error)
+}
+
+// OutHTTP sends record sets to HTTP endpoints by POST requests.
+// An endpoint which responds 5xx or 429 (or fails to connect) is retried after backoff, and the next endpoint is used meanwhile.
+// Requests rejected by other statuses are not retried, and the records are dropped.
+type OutHTTP struct {
+	RoundRobin bool
+
+	// Batcher coalesces and splits record sets before sending.
+	Batcher *Batcher
+
+	// Secondary receives record sets instead of retrying when all endpoints are unavailable for Secondary.RetryTimeout.
+	Secondary *SecondaryFile
+
+	name         string // name of the output in logs
+	protocol     httpProtocol
+	client       *http.Client
+	headers      map[string]string
+	compress     string
+	retryWait    time.Duration
+	retryWaitMax time.Duration
+	endpoints    []*httpEndpoint
+
+	messageCh   chan *fluent.FluentRecordSet
+	monitorCh   chan Stat
+	pending     []*fluent.FluentRecordSet
+	group       string
+	statIndex   int // index of the first endpoint in stats
+	sent        int64
+	inputClosed bool
+	unavailable bool
+	downSince   time.Time
+	mu          sync.Mutex
+	stopCh      chan interface{}
+	done        chan interface{}
+}
+
+type httpEndpoint struct {
+	url       string
+	failures  int // consecutive failures
+	retryAt   time.Time
+	lastError string
+	resends   int64 // requests sent again to another endpoint (or later) because of failures
+	rejected  int64
+	sent      sentCounter
+}
+
+// httpStatusError is an error response of HTTP requests.
+type httpStatusError struct {
+	status     int
+	body       string
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	body := e.body
+	if len(body) > httpErrorBodyLimit {
+		body = body[:httpErrorBodyLimit] + "..."
+	}
+	return fmt.Sprintf("HTTP status %d: %s", e.status, body)
+}
+
+func (e *httpStatusError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// NewOutHTTP returns an out_http which posts record sets as NDJSON or a JSON array.
+func NewOutHTTP(config *ConfigOutHTTP) *OutHTTP {
+	return newOutHTTP("out_http", config, &jsonProtocol{
+		format:  config.Format,
+		tagKey:  config.TagKey,
+		timeKey: config.TimeKey,
+	})
+}
+
+func newOutHTTP(name string, config *ConfigOutHTTP, protocol httpProtocol) *OutHTTP {
+	endpoints := make([]*httpEndpoint, len(config.URLs))
+	for i, u := range config.URLs {
+		endpoints[i] = &httpEndpoint{url: u}
+	}
+	return &OutHTTP{
+		Batcher:      NewBatcher(0, 0, 0),
+		name:         name,
+		protocol:     protocol,
+		client:       &http.Client{Timeout: config.Timeout.Duration},
+		headers:      config.Headers,
+		compress:     config.Compress,
+		retryWait:    config.RetryWait.Duration,
+		retryWaitMax: config.RetryWaitMax.Duration,
+		endpoints:    endpoints,
+		stopCh:       make(chan interface{}),
+		done:         make(chan interface{}),
+	}
+}
+
+// TakeOver makes h to send the pending record sets of stopped output at first.
+func (h *OutHTTP) TakeOver(pending []*fluent.FluentRecordSet) {
+	h.pending = pending
+}
+
+// Stop stops sending and waits for finishing it.
+// Record sets which couldn't be sent yet are returned to hand over to the next output.
+func (h *OutHTTP) Stop() []*fluent.FluentRecordSet {
+	close(h.stopCh)
+	<-h.done
+	return append(h.pending, h.Batcher.Drain()...)
+}
+
+func (h *OutHTTP) Run(c *Context) {
+	c.OutputProcess.Add(1)
+	defer c.OutputProcess.Done()
+	defer close(h.done)
+	if h.messageCh == nil {
+		h.messageCh = c.OutputCh
+	}
+	h.monitorCh = c.MonitorCh
+
+	c.StartProcess.Done()
+
+	if h.Secondary != nil {
+		defer func() {
+			if err := h.Secondary.Close(); err != nil {
+				log.Println("[warning] Couldn't close secondary file.", err)
+			}
+		}()
+	}
+	for i := range h.endpoints {
+		go h.checkEndpointHealth(i)
+	}
+	for {
+		rs, err := h.next()
+		if err == nil {
+			err = h.post(rs)
+		}
+		if err != nil {
+			if _, ok := err.(Signal); ok {
+				log.Println("[info]", err)
+				return
+			}
+			log.Println("[error]", err)
+		}
+	}
+}
+
+// next returns a record set to send. Pending record sets are sent at first.
+func (h *OutHTTP) next() (*fluent.FluentRecordSet, error) {
+	h.Batcher.Flush(time.Now(), h.inputClosed)
+	for {
+		if len(h.pending) > 0 {
+			return h.pending[0], nil
+		}
+		if rs := h.Batcher.Next(); rs != nil {
+			h.pending = append(h.pending, rs)
+			continue
+		}
+		if h.inputClosed {
+			return nil, Signal{"shutdown " + h.name}
+		}
+		var (
+			timer   *time.Timer
+			flushCh <-chan time.Time
+		)
+		if deadline, ok := h.Batcher.Deadline(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			flushCh = timer.C
+		}
+		select {
+		case rs, ok := <-h.messageCh:
+			if !ok {
+				h.inputClosed = true
+				h.Batcher.Flush(time.Now(), true)
+				continue
+			}
+			h.Batcher.Add(rs)
+		case now := <-flushCh:
+			h.Batcher.Flush(now, false)
+		case <-h.stopCh:
+			return nil, Signal{"stop " + h.name}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// post sends the first pending record set to available endpoints until it is accepted.
+func (h *OutHTTP) post(rs *fluent.FluentRecordSet) error {
+	for {
+		body, contentType, err := h.protocol.encode(rs)
+		if err != nil {
+			h.pending = h.pending[1:]
+			return fmt.Errorf("Couldn't encode records. %s", err)
+		}
+		if body, err = h.compressBody(body); err != nil {
+			h.pending = h.pending[1:]
+			return err
+		}
+		for _, i := range h.candidates() {
+			if !h.available(i, time.Now()) {
+				continue
+			}
+			respBody, err := h.request(i, body, contentType)
+			if e, ok := err.(*httpStatusError); ok && !e.retryable() {
+				h.pending = h.pending[1:]
+				if handler, ok := h.protocol.(httpRejectionHandler); ok {
+					if n, partial := handler.rejected(rs, e); partial {
+						h.succeed(i, rs, len(rs.Records)-n, len(body), e.body)
+						h.reject(i, n)
+						log.Printf("[warning] %s rejected %d of %d records of tag:%s. %s", h.endpoints[i].url, n, len(rs.Records), rs.Tag, err)
+						return nil
+					}
+				}
+				h.reject(i, len(rs.Records))
+				return fmt.Errorf("%s rejected %d records of tag:%s. %s", h.endpoints[i].url, len(rs.Records), rs.Tag, err)
+			} else if err != nil {
+				h.fail(i, err)
+				continue
+			}
+			retry, rejected, err := h.protocol.accepted(rs, respBody)
+			if err != nil {
+				// results of the records are unknown, so all of them are sent again
+				h.fail(i, err)
+				continue
+			}
+			accepted := len(rs.Records) - rejected
+			if retry != nil {
+				accepted -= len(retry.Records)
+			}
+			h.succeed(i, rs, accepted, len(body), "")
+			h.reject(i, rejected)
+			if retry == nil || len(retry.Records) == 0 {
+				h.pending = h.pending[1:]
+				return nil // success
+			}
+			// send only the rest again
+			rs = retry
+			h.pending[0] = rs
+			if err := h.waitRetry(i); err != nil {
+				return err
+			}
+			break
+		}
+		if h.allUnavailable(rs) {
+			if h.writeSecondary(rs) {
+				return nil
+			}
+			if err := h.wait(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (h *OutHTTP) compressBody(body []byte) ([]byte, error) {
+	if h.compress != fluent.CompressionGzip {
+		return body, nil
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// candidates returns indexes of endpoints in the order to try.
+func (h *OutHTTP) candidates() []int {
+	n := len(h.endpoints)
+	start := 0
+	if h.RoundRobin {
+		start = int(h.sent % int64(n))
+	}
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = (start + i) % n
+	}
+	return indexes
+}
+
+func (h *OutHTTP) available(i int, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !now.Before(h.endpoints[i].retryAt)
+}
+
+// request posts body to the i-th endpoint, and returns the body of the successful response.
+func (h *OutHTTP) request(i int, body []byte, contentType string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, h.endpoints[i].url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if h.compress != "" {
+		req.Header.Set("Content-Encoding", h.compress)
+	}
+	for key, value := range h.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		if len(respBody) > httpResponseBodyLimit {
+			respBody = respBody[:httpResponseBodyLimit]
+		}
+		e := &httpStatusError{status: resp.StatusCode, body: string(bytes.TrimSpace(respBody))}
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.retryAfter = time.Duration(sec) * time.Second
+		}
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return respBody, nil
+}
+
+func (h *OutHTTP) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range h.headers {
+		req.Header.Set(key, value)
+	}
+	return h.client.Do(req)
+}
+
+// fail marks the i-th endpoint failed, which is not used until the backoff passes.
+func (h *OutHTTP) fail(i int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.endpoints[i]
+	wait := h.backoff(e.failures)
+	if se, ok := err.(*httpStatusError); ok && se.retryAfter > wait {
+		wait = se.retryAfter
+	}
+	e.failures++
+	e.retryAt = time.Now().Add(wait)
+	e.lastError = err.Error()
+	e.resends++
+	log.Printf("[warning] %s %s failed. retry after %s. %s", h.name, e.url, wait, err)
+}
+
+// backoff returns retryWait * 1.5^failures capped by retryWaitMax.
+func (h *OutHTTP) backoff(failures int) time.Duration {
+	wait := time.Duration(float64(h.retryWait) * math.Pow(1.5, float64(failures)))
+	if h.retryWaitMax > 0 && (wait > h.retryWaitMax || wait <= 0) {
+		wait = h.retryWaitMax
+	}
+	return wait
+}
+
+// succeed records that the i-th endpoint accepted messages of rs by the request of size bytes.
+func (h *OutHTTP) succeed(i int, rs *fluent.FluentRecordSet, messages int, size int, rejection string) {
+	h.monitorCh <- &SentStat{
+		Tag:      rs.Tag,
+		Messages: int64(messages),
+		Bytes:    int64(size),
+		Sents:    1,
+	}
+	if reporter, ok := h.protocol.(httpStatReporter); ok {
+		for _, stat := range reporter.stats(rs, rejection) {
+			h.monitorCh <- stat
+		}
+	}
+	h.mu.Lock()
+	e := h.endpoints[i]
+	e.failures = 0
+	e.retryAt = time.Time{}
+	e.sent.messages += int64(messages)
+	e.sent.bytes += int64(size)
+	h.mu.Unlock()
+	h.sent++
+	if h.unavailable {
+		log.Printf("[info] %s endpoints are available again", h.name)
+		h.unavailable = false
+		if h.Secondary != nil {
+			if err := h.Secondary.Close(); err != nil {
+				log.Println("[warning] Couldn't close secondary file.", err)
+			}
+		}
+	}
+}
+
+func (h *OutHTTP) reject(i int, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.endpoints[i].rejected += int64(n)
+}
+
+// allUnavailable logs a warning when all endpoints became unavailable. It returns true when all endpoints are in backoff.
+func (h *OutHTTP) allUnavailable(rs *fluent.FluentRecordSet) bool {
+	now := time.Now()
+	for i := range h.endpoints {
+		if h.available(i, now) {
+			return false
+		}
+	}
+	if !h.unavailable {
+		log.Printf(
+			"[warning] All %s endpoints are unavailable. pending %d messages tag:%s",
+			h.name,
+			len(rs.Records),
+			rs.Tag,
+		)
+		h.unavailable = true
+		h.downSince = now
+	}
+	return true
+}
+
+// writeSecondary writes rs into Secondary when all endpoints are unavailable longer than the retry timeout of Secondary.
+// It returns true when rs was written.
+func (h *OutHTTP) writeSecondary(rs *fluent.FluentRecordSet) bool {
+	if h.Secondary == nil || time.Since(h.downSince) < h.Secondary.RetryTimeout {
+		return false
+	}
+	if err := h.Secondary.Write(rs); err != nil {
+		log.Println("[error] Couldn't write secondary file.", err)
+		return false
+	}
+	h.monitorCh <- &SecondaryStat{
+		Tag:      rs.Tag,
+		Messages: int64(len(rs.Records)),
+	}
+	h.pending = h.pending[1:]
+	return true
+}
+
+// wait waits until any endpoint becomes available.
+func (h *OutHTTP) wait() error {
+	h.mu.Lock()
+	var next time.Time
+	for _, e := range h.endpoints {
+		if next.IsZero() || e.retryAt.Before(next) {
+			next = e.retryAt
+		}
+	}
+	h.mu.Unlock()
+	return h.sleep(time.Until(next))
+}
+
+// waitRetry waits for the backoff before sending records which were not accepted by the i-th endpoint again.
+func (h *OutHTTP) waitRetry(i int) error {
+	h.mu.Lock()
+	e := h.endpoints[i]
+	wait := h.backoff(e.failures)
+	e.failures++
+	e.resends++
+	h.mu.Unlock()
+	return h.sleep(wait)
+}
+
+func (h *OutHTTP) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-h.stopCh:
+		return Signal{"stop " + h.name}
+	}
+}
+
+func (h *OutHTTP) checkEndpointHealth(i int) {
+	ticker := time.NewTicker(serverHealthCheckInterval)
+	defer ticker.Stop()
+	var prev sentCounter
+	last := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-h.stopCh:
+			return
+		case <-h.done:
+			return
+		}
+		var health string
+		if checker, ok := h.protocol.(httpHealthChecker); ok {
+			var err error
+			if health, err = checker.health(h.get, h.endpoints[i].url); err != nil {
+				health = "unknown"
+			}
+		}
+		h.mu.Lock()
+		e := *h.endpoints[i]
+		h.mu.Unlock()
+		elapsed := now.Sub(last).Seconds()
+		alive := !now.Before(e.retryAt)
+		h.monitorCh <- &ServerStat{
+			Index:    h.statIndex + i,
+			Group:    h.group,
+			Address:  e.url,
+			Alive:    alive,
+			Error:    e.lastError,
+			Resends:  e.resends,
+			Rejected: e.rejected,
+			Health:   health,
+			Connections: []*ConnectionStat{
+				{
+					Alive:          alive,
+					Messages:       e.sent.messages,
+					Bytes:          e.sent.bytes,
+					MessagesPerSec: float64(e.sent.messages-prev.messages) / elapsed,
+					BytesPerSec:    float64(e.sent.bytes-prev.bytes) / elapsed,
+				},
+			},
+		}
+		prev, last = e.sent, now
+	}
+}
+
+// jsonProtocol posts records as NDJSON or a JSON array.
+type jsonProtocol struct {
+	format  string
+	tagKey  string
+	timeKey string
+}
+
+func (p *jsonProtocol) encode(rs *fluent.FluentRecordSet) ([]byte, string, error) {
+	decoded, err := decodeRecordSet(rs)
+	if err != nil {
+		return nil, "", err
+	}
+	records := make([]map[string]interface{}, 0, len(decoded.Records))
+	for _, record := range decoded.Records {
+		r := record.(*fluent.TinyFluentRecord)
+		data := r.Data
+		if p.tagKey != "" || p.timeKey != "" {
+			data = make(map[string]interface{}, len(r.Data)+2)
+			for key, value := range r.Data {
+				data[key] = value
+			}
+			if p.tagKey != "" {
+				data[p.tagKey] = rs.Tag
+			}
+			if p.timeKey != "" {
+				data[p.timeKey] = r.Timestamp.Format(time.RFC3339Nano)
+			}
+		}
+		records = append(records, data)
+	}
+	if p.format == OutHTTPJSON {
+		b, err := json.Marshal(records)
+		return b, "application/json", err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, data := range records {
+		if err := enc.Encode(data); err != nil {
+			return nil, "", err
+		}
+	}
+	return b.Bytes(), "application/x-ndjson", nil
+}
+
+func (p *jsonProtocol) accepted(rs *fluent.FluentRecordSet, body []byte) (*fluent.FluentRecordSet, int, error) {
+	return nil, 0, nil
+}
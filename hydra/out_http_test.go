@@ -0,0 +1,239 @@
+package hydra_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+// httpCollector is an HTTP endpoint which collects posted records.
+type httpCollector struct {
+	mu       sync.Mutex
+	records  []map[string]interface{}
+	requests int64
+	status   func(n int64) int // status of the n-th request
+	header   http.Header
+}
+
+func (hc *httpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt64(&hc.requests, 1)
+	if hc.status != nil {
+		if status := hc.status(n); status != http.StatusOK {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "error", status)
+			return
+		}
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	var records []map[string]interface{}
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(body).Decode(&records); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			var record map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			records = append(records, record)
+		}
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.records = append(hc.records, records...)
+	hc.header = r.Header
+}
+
+func (hc *httpCollector) received() []map[string]interface{} {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.records
+}
+
+func runOutHTTP(t *testing.T, config *hydra.ConfigOutHTTP, n int) {
+	config.Restrict(nil)
+	c := hydra.NewContext()
+	c.RunProcess(hydra.NewOutHTTP(config))
+	c.StartProcess.Wait()
+	for i := 0; i < n; i++ {
+		c.MessageCh <- prepareRecordSet()
+	}
+	c.Shutdown()
+}
+
+func TestOutHTTP(t *testing.T) {
+	for _, format := range []string{hydra.OutHTTPNDJSON, hydra.OutHTTPJSON} {
+		hc := &httpCollector{}
+		ts := httptest.NewServer(hc)
+		defer ts.Close()
+
+		config := &hydra.ConfigOutHTTP{
+			URLs:     []string{ts.URL},
+			Format:   format,
+			Compress: "gzip",
+			Headers:  map[string]string{"Authorization": "Bearer secret"},
+			TagKey:   "tag",
+			TimeKey:  "time",
+		}
+		runOutHTTP(t, config, 3)
+
+		records := hc.received()
+		if len(records) != 3*len(TestMessageLines) {
+			t.Fatalf("%s: received %d records expected %d", format, len(records), 3*len(TestMessageLines))
+		}
+		for i, record := range records {
+			if record[TestFieldName] != TestMessageLines[i%len(TestMessageLines)] {
+				t.Errorf("%s: unexpected record %v", format, record)
+			}
+			if record["tag"] != TestTag {
+				t.Errorf("%s: tag %v expected %s", format, record["tag"], TestTag)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+				t.Errorf("%s: invalid time %v", format, record["time"])
+			}
+		}
+		if auth := hc.header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("%s: Authorization header %s is not sent", format, auth)
+		}
+	}
+}
+
+func TestOutHTTPFailover(t *testing.T) {
+	primary := &httpCollector{status: func(n int64) int { return http.StatusServiceUnavailable }}
+	ts1 := httptest.NewServer(primary)
+	defer ts1.Close()
+	secondary := &httpCollector{}
+	ts2 := httptest.NewServer(secondary)
+	defer ts2.Close()
+
+	config := &hydra.ConfigOutHTTP{
+		URLs:      []string{ts1.URL, ts2.URL},
+		RetryWait: hydra.Duration{Duration: time.Hour},
+	}
+	runOutHTTP(t, config, 3)
+
+	if n := len(secondary.received()); n != 3*len(TestMessageLines) {
+		t.Errorf("secondary received %d records expected %d", n, 3*len(TestMessageLines))
+	}
+	if n := atomic.LoadInt64(&primary.requests); n != 1 {
+		t.Errorf("primary received %d requests expected 1 (not retried until backoff)", n)
+	}
+}
+
+func TestOutHTTPRetry(t *testing.T) {
+	hc := &httpCollector{status: func(n int64) int {
+		switch n {
+		case 1:
+			return http.StatusInternalServerError
+		case 2:
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}}
+	ts := httptest.NewServer(hc)
+	defer ts.Close()
+
+	config := &hydra.ConfigOutHTTP{
+		URLs:      []string{ts.URL},
+		RetryWait: hydra.Duration{Duration: 10 * time.Millisecond},
+	}
+	runOutHTTP(t, config, 1)
+
+	if n := len(hc.received()); n != len(TestMessageLines) {
+		t.Errorf("received %d records expected %d", n, len(TestMessageLines))
+	}
+	if n := atomic.LoadInt64(&hc.requests); n != 3 {
+		t.Errorf("%d requests expected 3", n)
+	}
+}
+
+func TestOutHTTPRejected(t *testing.T) {
+	hc := &httpCollector{status: func(n int64) int {
+		if n == 1 {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}}
+	ts := httptest.NewServer(hc)
+	defer ts.Close()
+
+	runOutHTTP(t, &hydra.ConfigOutHTTP{URLs: []string{ts.URL}}, 2)
+
+	// the first record set is dropped without retrying
+	if n := len(hc.received()); n != len(TestMessageLines) {
+		t.Errorf("received %d records expected %d", n, len(TestMessageLines))
+	}
+	if n := atomic.LoadInt64(&hc.requests); n != 2 {
+		t.Errorf("%d requests expected 2", n)
+	}
+}
+
+func TestOutHTTPSecondary(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-out-http")
+	defer os.RemoveAll(dir)
+
+	hc := &httpCollector{status: func(n int64) int { return http.StatusServiceUnavailable }}
+	ts := httptest.NewServer(hc)
+	defer ts.Close()
+
+	config := &hydra.ConfigOutHTTP{
+		URLs:      []string{ts.URL},
+		RetryWait: hydra.Duration{Duration: 10 * time.Millisecond},
+	}
+	config.Restrict(nil)
+	secondary := &hydra.ConfigSecondary{
+		Path:         filepath.Join(dir, "secondary"),
+		RetryTimeout: hydra.Duration{Duration: time.Millisecond},
+	}
+	secondary.Restrict(nil)
+
+	c := hydra.NewContext()
+	outHTTP := hydra.NewOutHTTP(config)
+	s, err := hydra.NewSecondaryFile(secondary, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outHTTP.Secondary = s
+	c.RunProcess(outHTTP)
+	c.StartProcess.Wait()
+	c.MessageCh <- prepareRecordSet()
+	c.Shutdown()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "secondary", "*"))
+	if len(files) != 1 {
+		t.Fatalf("%d secondary files expected 1: %v", len(files), files)
+	}
+	n := 0
+	hydra.ReadSecondaryFile(files[0], func(rs *fluent.FluentRecordSet) error {
+		n += len(rs.Records)
+		return nil
+	})
+	if n != len(TestMessageLines) {
+		t.Errorf("%d records in secondary expected %d", n, len(TestMessageLines))
+	}
+}
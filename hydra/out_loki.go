@@ -0,0 +1,308 @@
+package hydra
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/golang/snappy"
+)
+
+const (
+	LokiJSON     = "json"
+	LokiProtobuf = "protobuf"
+
+	DefaultLokiTagLabel = "tag"
+
+	lokiPushPath = "/loki/api/v1/push"
+)
+
+var (
+	lokiLabelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	lokiIgnoredRegexp   = regexp.MustCompile(`ignored, reason: '[^']*' for stream: (\{.*\}),?$`)
+	lokiTotalRegexp     = regexp.MustCompile(`total ignored: (\d+) out of \d+(?: for stream: (\{.*\}))?`)
+)
+
+// NewOutLoki returns an output which pushes record sets to Grafana Loki.
+// Records are grouped into streams by the tag and label fields, and entries rejected as out of order are dropped.
+func NewOutLoki(config *ConfigOutLoki) *OutHTTP {
+	return newOutHTTP("out_loki", config.httpConfig(), &lokiProtocol{
+		format:   config.Format,
+		labels:   config.Labels,
+		tagLabel: config.TagLabel,
+		lineKey:  config.LineKey,
+	})
+}
+
+// httpConfig returns the config of OutHTTP which posts to the push API of URLs.
+func (cl *ConfigOutLoki) httpConfig() *ConfigOutHTTP {
+	urls := make([]string, len(cl.URLs))
+	for i, u := range cl.URLs {
+		urls[i] = strings.TrimSuffix(u, "/") + lokiPushPath
+	}
+	headers := make(map[string]string, len(cl.Headers)+2)
+	if cl.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(cl.Username + ":" + cl.Password))
+		headers["Authorization"] = "Basic " + auth
+	}
+	if cl.TenantID != "" {
+		headers["X-Scope-OrgID"] = cl.TenantID
+	}
+	for key, value := range cl.Headers {
+		headers[key] = value
+	}
+	return &ConfigOutHTTP{
+		URLs:         urls,
+		Compress:     cl.Compress,
+		Headers:      headers,
+		Timeout:      cl.Timeout,
+		RetryWait:    cl.RetryWait,
+		RetryWaitMax: cl.RetryWaitMax,
+	}
+}
+
+// lokiProtocol makes requests of the push API.
+type lokiProtocol struct {
+	format   string
+	labels   []string
+	tagLabel string
+	lineKey  string
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	key     string // labels in the form of Prometheus, like {tag="app", level="info"}
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStreamJSON `json:"streams"`
+}
+
+type lokiStreamJSON struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// streams groups records of rs into streams by labels. Entries are sorted by time in each stream.
+func (p *lokiProtocol) streams(rs *fluent.FluentRecordSet) ([]*lokiStream, error) {
+	decoded, err := decodeRecordSet(rs)
+	if err != nil {
+		return nil, err
+	}
+	var streams []*lokiStream
+	index := make(map[string]*lokiStream)
+	for _, record := range decoded.Records {
+		r := record.(*fluent.TinyFluentRecord)
+		labels := map[string]string{p.tagLabel: rs.Tag}
+		for _, field := range p.labels {
+			if value, ok := r.Data[field]; ok {
+				if v := fmt.Sprint(value); v != "" {
+					labels[lokiLabelName(field)] = v
+				}
+			}
+		}
+		key := lokiLabelsString(labels)
+		s, ok := index[key]
+		if !ok {
+			s = &lokiStream{labels: labels, key: key}
+			index[key] = s
+			streams = append(streams, s)
+		}
+		line, err := p.line(r)
+		if err != nil {
+			return nil, err
+		}
+		s.entries = append(s.entries, lokiEntry{ts: r.Timestamp, line: line})
+	}
+	for _, s := range streams {
+		entries := s.entries
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].ts.Before(entries[j].ts) })
+	}
+	return streams, nil
+}
+
+// line returns the value of lineKey, or JSON of the whole record.
+func (p *lokiProtocol) line(r *fluent.TinyFluentRecord) (string, error) {
+	if p.lineKey != "" {
+		if value, ok := r.Data[p.lineKey]; ok {
+			return fmt.Sprint(value), nil
+		}
+	}
+	b, err := json.Marshal(r.Data)
+	return string(b), err
+}
+
+func (p *lokiProtocol) encode(rs *fluent.FluentRecordSet) ([]byte, string, error) {
+	streams, err := p.streams(rs)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.format == LokiProtobuf {
+		return snappy.Encode(nil, lokiProtobuf(streams)), "application/x-protobuf", nil
+	}
+	req := lokiPushRequest{Streams: make([]lokiStreamJSON, len(streams))}
+	for i, s := range streams {
+		values := make([][2]string, len(s.entries))
+		for j, e := range s.entries {
+			values[j] = [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line}
+		}
+		req.Streams[i] = lokiStreamJSON{Stream: s.labels, Values: values}
+	}
+	b, err := json.Marshal(req)
+	return b, "application/json", err
+}
+
+func (p *lokiProtocol) accepted(rs *fluent.FluentRecordSet, body []byte) (*fluent.FluentRecordSet, int, error) {
+	return nil, 0, nil
+}
+
+// rejected returns the number of entries ignored by Loki as out of order (or too old).
+// Loki accepts the other entries in this case, so they must not be sent again.
+// When the error response can't be understood, the whole batch is rejected.
+func (p *lokiProtocol) rejected(rs *fluent.FluentRecordSet, e *httpStatusError) (int, bool) {
+	if e.status != 400 {
+		return 0, false
+	}
+	total, _, ok := parseLokiRejection(e.body)
+	return total, ok
+}
+
+// stats returns stats of streams, which count entries sent and rejected for each stream.
+func (p *lokiProtocol) stats(rs *fluent.FluentRecordSet, rejection string) []Stat {
+	streams, err := p.streams(rs)
+	if err != nil {
+		return nil
+	}
+	_, rejected, _ := parseLokiRejection(rejection)
+	stats := make([]Stat, 0, len(streams))
+	for _, s := range streams {
+		stats = append(stats, &StreamStat{
+			Labels:   s.key,
+			Messages: int64(len(s.entries) - rejected[s.key]),
+			Rejected: int64(rejected[s.key]),
+		})
+	}
+	return stats
+}
+
+// parseLokiRejection parses the error response of entries ignored by Loki, and returns the number of them in total and by streams.
+// ok is false unless all of them are found by streams.
+//
+// Loki 2.x responds for the last stream which has ignored entries, like
+//
+//	entry with timestamp 2023-11-14 22:13:25 +0000 UTC ignored, reason: 'entry out of order',
+//	user 'tenant1', total ignored: 1 out of 3 for stream: {level="info", tag="app"}
+//
+// and older versions respond for each entry, like
+//
+//	entry with timestamp 2023-11-14 22:13:25 +0000 UTC ignored, reason: 'entry out of order' for stream: {level="info", tag="app"},
+//	total ignored: 1 out of 3
+func parseLokiRejection(body string) (total int, streams map[string]int, ok bool) {
+	if !strings.Contains(body, "out of order") && !strings.Contains(body, "too far behind") {
+		return 0, nil, false
+	}
+	m := lokiTotalRegexp.FindStringSubmatch(body)
+	if m == nil {
+		return 0, nil, false
+	}
+	total, _ = strconv.Atoi(m[1])
+	streams = make(map[string]int)
+	if m[2] != "" {
+		streams[m[2]] = total
+		return total, streams, true
+	}
+	n := 0
+	for _, line := range strings.Split(body, "\n") {
+		if m := lokiIgnoredRegexp.FindStringSubmatch(line); m != nil {
+			streams[m[1]]++
+			n++
+		}
+	}
+	return total, streams, n == total
+}
+
+// lokiLabelName replaces characters which can't be used in label names with "_".
+func lokiLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// lokiLabelsString returns labels in the form of Prometheus (sorted by names), which Loki uses to identify streams.
+func lokiLabelsString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// lokiProtobuf encodes streams as logproto.PushRequest.
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream { string labels = 1; repeated Entry entries = 2; }
+//	Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//	Timestamp { int64 seconds = 1; int32 nanos = 2; }
+func lokiProtobuf(streams []*lokiStream) []byte {
+	var req []byte
+	for _, s := range streams {
+		stream := appendProtoBytes(nil, 1, []byte(s.key))
+		for _, e := range s.entries {
+			ts := appendProtoVarint(nil, 1, uint64(e.ts.Unix()))
+			ts = appendProtoVarint(ts, 2, uint64(e.ts.Nanosecond()))
+			entry := appendProtoBytes(nil, 1, ts)
+			entry = appendProtoBytes(entry, 2, []byte(e.line))
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, stream)
+	}
+	return req
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendProtoVarint appends a varint field (wire type 0).
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+// appendProtoBytes appends a length-delimited field (wire type 2).
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,384 @@
+package hydra_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+	"github.com/golang/snappy"
+)
+
+type lokiTestEntry struct {
+	ts   int64
+	line string
+}
+
+// lokiStandIn is a Loki stand-in which ignores entries older than the last one of the stream.
+// It responds to ignored entries like Loki 2.x, or by rejection if set.
+type lokiStandIn struct {
+	mu        sync.Mutex
+	requests  int
+	last      map[string]int64
+	entries   map[string][]lokiTestEntry
+	tenant    string
+	rejection string
+}
+
+func (l *lokiStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r.URL.Path != "/loki/api/v1/push" {
+		http.NotFound(w, r)
+		return
+	}
+	l.requests++
+	if l.requests == 1 {
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "Ingestion rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	l.tenant = r.Header.Get("X-Scope-OrgID")
+	body, _ := ioutil.ReadAll(r.Body)
+	var streams map[string][]lokiTestEntry
+	var err error
+	if r.Header.Get("Content-Type") == "application/x-protobuf" {
+		streams, err = decodeLokiProtobuf(body)
+	} else {
+		streams, err = decodeLokiJSON(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lastErr string
+	for labels, entries := range streams {
+		var ignored []string
+		for _, e := range entries {
+			if e.ts < l.last[labels] {
+				ignored = append(ignored, fmt.Sprintf(
+					"entry with timestamp %s ignored, reason: 'entry out of order',\n",
+					time.Unix(0, e.ts).UTC(),
+				))
+				continue
+			}
+			l.last[labels] = e.ts
+			l.entries[labels] = append(l.entries[labels], e)
+		}
+		if len(ignored) > 0 {
+			// Loki responds only for the last stream which has ignored entries
+			lastErr = strings.Join(ignored, "") + fmt.Sprintf(
+				"user '%s', total ignored: %d out of %d for stream: %s",
+				l.tenant, len(ignored), len(entries), labels,
+			)
+		}
+	}
+	if lastErr != "" {
+		if l.rejection != "" {
+			lastErr = l.rejection
+		}
+		http.Error(w, lastErr, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeLokiJSON(body []byte) (map[string][]lokiTestEntry, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	streams := make(map[string][]lokiTestEntry)
+	for _, s := range req.Streams {
+		var names []string
+		for name := range s.Stream {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var pairs []string
+		for _, name := range names {
+			pairs = append(pairs, name+"="+strconv.Quote(s.Stream[name]))
+		}
+		labels := "{" + strings.Join(pairs, ", ") + "}"
+		for _, v := range s.Values {
+			ts, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			streams[labels] = append(streams[labels], lokiTestEntry{ts, v[1]})
+		}
+	}
+	return streams, nil
+}
+
+type protoField struct {
+	num    uint64
+	varint uint64
+	bytes  []byte
+}
+
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid key")
+		}
+		b = b[n:]
+		f := protoField{num: key >> 3}
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid varint")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			f.varint = v
+		case 2:
+			if uint64(len(b)) < v {
+				return nil, fmt.Errorf("invalid length")
+			}
+			f.bytes, b = b[:v], b[v:]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func decodeLokiProtobuf(body []byte) (map[string][]lokiTestEntry, error) {
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseProto(decoded)
+	if err != nil {
+		return nil, err
+	}
+	streams := make(map[string][]lokiTestEntry)
+	for _, s := range req {
+		fields, err := parseProto(s.bytes)
+		if err != nil {
+			return nil, err
+		}
+		var labels string
+		for _, f := range fields {
+			switch f.num {
+			case 1:
+				labels = string(f.bytes)
+			case 2:
+				entry, err := parseProto(f.bytes)
+				if err != nil {
+					return nil, err
+				}
+				ts, err := parseProto(entry[0].bytes)
+				if err != nil {
+					return nil, err
+				}
+				e := lokiTestEntry{line: string(entry[1].bytes)}
+				for _, t := range ts {
+					if t.num == 1 {
+						e.ts += int64(t.varint) * int64(time.Second)
+					} else {
+						e.ts += int64(t.varint)
+					}
+				}
+				streams[labels] = append(streams[labels], e)
+			}
+		}
+	}
+	return streams, nil
+}
+
+func lokiRecordSet(base time.Time, records ...[3]string) *fluent.FluentRecordSet {
+	rs := &fluent.FluentRecordSet{Tag: "app"}
+	for _, r := range records {
+		sec, _ := strconv.Atoi(r[0])
+		rs.Records = append(rs.Records, &fluent.TinyFluentRecord{
+			Timestamp: base.Add(time.Duration(sec) * time.Second),
+			Data:      map[string]interface{}{"level": r[1], "message": r[2]},
+		})
+	}
+	return rs
+}
+
+func TestOutLoki(t *testing.T) {
+	for _, format := range []string{hydra.LokiJSON, hydra.LokiProtobuf} {
+		loki := &lokiStandIn{last: make(map[string]int64), entries: make(map[string][]lokiTestEntry)}
+		ts := httptest.NewServer(loki)
+		defer ts.Close()
+
+		config := &hydra.ConfigOutLoki{
+			URLs:      []string{ts.URL},
+			Labels:    []string{"level"},
+			Format:    format,
+			TenantID:  "tenant1",
+			RetryWait: hydra.Duration{Duration: 10 * time.Millisecond},
+		}
+		if format == hydra.LokiProtobuf {
+			config.LineKey = "message"
+		}
+		config.Restrict(nil)
+		c := hydra.NewContext()
+		c.RunProcess(hydra.NewOutLoki(config))
+		c.StartProcess.Wait()
+
+		base := time.Unix(1700000000, 0)
+		c.MessageCh <- lokiRecordSet(base, [3]string{"12", "info", "c"}, [3]string{"11", "error", "b"}, [3]string{"10", "info", "a"})
+		c.MessageCh <- lokiRecordSet(base, [3]string{"5", "info", "d"}, [3]string{"20", "info", "e"}, [3]string{"13", "error", "f"})
+		c.Shutdown()
+
+		stats := make(map[string]*hydra.StreamStat)
+	DRAIN:
+		for {
+			select {
+			case s := <-c.MonitorCh:
+				if ss, ok := s.(*hydra.StreamStat); ok {
+					if prev, ok := stats[ss.Labels]; ok {
+						prev.Messages += ss.Messages
+						prev.Rejected += ss.Rejected
+					} else {
+						stats[ss.Labels] = ss
+					}
+				}
+			default:
+				break DRAIN
+			}
+		}
+
+		loki.mu.Lock()
+		defer loki.mu.Unlock()
+		info, errors := `{level="info", tag="app"}`, `{level="error", tag="app"}`
+		expected := map[string][]string{info: {"a", "c", "e"}, errors: {"b", "f"}}
+		for labels, messages := range expected {
+			entries := loki.entries[labels]
+			if len(entries) != len(messages) {
+				t.Errorf("%s: %s has %d entries expected %d", format, labels, len(entries), len(messages))
+				continue
+			}
+			for i, e := range entries {
+				line := messages[i]
+				if format == hydra.LokiJSON {
+					var record map[string]interface{}
+					json.Unmarshal([]byte(e.line), &record)
+					line = fmt.Sprint(record["message"])
+				}
+				if line != messages[i] {
+					t.Errorf("%s: %s line %s expected %s", format, labels, e.line, messages[i])
+				}
+			}
+		}
+		if loki.tenant != "tenant1" {
+			t.Errorf("%s: tenant %s expected tenant1", format, loki.tenant)
+		}
+		if s := stats[info]; s == nil || s.Messages != 3 || s.Rejected != 1 {
+			t.Errorf("%s: unexpected stats of %s %#v", format, info, s)
+		}
+		if s := stats[errors]; s == nil || s.Messages != 2 || s.Rejected != 0 {
+			t.Errorf("%s: unexpected stats of %s %#v", format, errors, s)
+		}
+	}
+}
+
+func TestOutLokiRejections(t *testing.T) {
+	info, errors := `{level="info", tag="app"}`, `{level="error", tag="app"}`
+	tests := []struct {
+		rejection string
+		rejected  bool // entries ignored are found in the rejection, or the whole batch is rejected
+	}{
+		{
+			// Loki 2.x
+			rejection: "entry with timestamp 2023-11-14 22:13:25 +0000 UTC ignored, reason: 'entry too far behind, oldest acceptable timestamp is: 2023-11-14T23:00:00Z',\n" +
+				"user 'fake', total ignored: 1 out of 2 for stream: " + info,
+			rejected: true,
+		},
+		{
+			// older versions
+			rejection: "entry with timestamp 2023-11-14 22:13:25 +0000 UTC ignored, reason: 'entry out of order' for stream: " + info + ",\n" +
+				"total ignored: 1 out of 3",
+			rejected: true,
+		},
+		{
+			// unknown wording
+			rejection: "1 entry out of order for stream " + info,
+		},
+		{
+			// entries ignored can't be found by streams
+			rejection: "entry out of order\ntotal ignored: 1 out of 3",
+		},
+	}
+	for i, test := range tests {
+		loki := &lokiStandIn{
+			last:      make(map[string]int64),
+			entries:   make(map[string][]lokiTestEntry),
+			rejection: test.rejection,
+		}
+		ts := httptest.NewServer(loki)
+		defer ts.Close()
+
+		config := &hydra.ConfigOutLoki{
+			URLs:      []string{ts.URL},
+			Labels:    []string{"level"},
+			RetryWait: hydra.Duration{Duration: 10 * time.Millisecond},
+		}
+		config.Restrict(nil)
+		c := hydra.NewContext()
+		c.RunProcess(hydra.NewOutLoki(config))
+		c.StartProcess.Wait()
+
+		base := time.Unix(1700000000, 0)
+		c.MessageCh <- lokiRecordSet(base, [3]string{"10", "info", "a"}, [3]string{"11", "info", "b"})
+		c.MessageCh <- lokiRecordSet(base, [3]string{"5", "info", "c"}, [3]string{"20", "info", "d"}, [3]string{"13", "error", "e"})
+		c.Shutdown()
+
+		stats := make(map[string]hydra.StreamStat)
+		var sent int64
+	DRAIN:
+		for {
+			select {
+			case s := <-c.MonitorCh:
+				switch s := s.(type) {
+				case *hydra.StreamStat:
+					stat := stats[s.Labels]
+					stat.Messages += s.Messages
+					stat.Rejected += s.Rejected
+					stats[s.Labels] = stat
+				case *hydra.SentStat:
+					sent += s.Messages
+				}
+			default:
+				break DRAIN
+			}
+		}
+		expected := map[string]hydra.StreamStat{info: {Messages: 2}}
+		expectedSent := int64(2)
+		if test.rejected {
+			expected = map[string]hydra.StreamStat{info: {Messages: 3, Rejected: 1}, errors: {Messages: 1}}
+			expectedSent = 4
+		}
+		for labels, e := range expected {
+			if s := stats[labels]; s.Messages != e.Messages || s.Rejected != e.Rejected {
+				t.Errorf("[%d] unexpected stats of %s %#v expected %#v", i, labels, s, e)
+			}
+		}
+		if len(stats) != len(expected) || sent != expectedSent {
+			t.Errorf("[%d] unexpected stats %v and %d messages sent", i, stats, sent)
+		}
+	}
+}
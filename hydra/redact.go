@@ -0,0 +1,230 @@
+package hydra
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+type RedactMode int
+
+const (
+	RedactModeMask RedactMode = iota
+	RedactModePartial
+	RedactModeHash
+)
+
+const (
+	DefaultRedactMatch       = "**"
+	DefaultRedactPartialKeep = 4
+	RedactMaskChar           = "*"
+	RedactHashPrefix         = "hmac:"
+)
+
+// Built-in detectors. When a detector has a capture group, only the group is redacted.
+var RedactDetectors = map[string]*regexp.Regexp{
+	"email":       regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	"credit_card": regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+	"token":       regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)|\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+|\bAKIA[0-9A-Z]{16}\b`),
+}
+
+func (m *RedactMode) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "mask":
+		*m = RedactModeMask
+	case "partial":
+		*m = RedactModePartial
+	case "hash":
+		*m = RedactModeHash
+	default:
+		return fmt.Errorf("Invalid Mode %s", string(text))
+	}
+	return nil
+}
+
+// Redactor is a Filter which masks sensitive values in records.
+type Redactor struct {
+	matcher     *TagMatcher
+	fields      map[string]bool
+	regexps     []*regexp.Regexp
+	luhnCheck   map[*regexp.Regexp]bool
+	mode        RedactMode
+	partialKeep int
+	hashKey     []byte
+}
+
+func NewRedactor(config *ConfigRedaction) (*Redactor, error) {
+	matcher, err := NewTagMatcher(config.Match)
+	if err != nil {
+		return nil, err
+	}
+	r := &Redactor{
+		matcher:     matcher,
+		fields:      make(map[string]bool),
+		luhnCheck:   make(map[*regexp.Regexp]bool),
+		mode:        config.Mode,
+		partialKeep: DefaultRedactPartialKeep,
+		hashKey:     []byte(config.HashKey),
+	}
+	if config.PartialKeep != nil {
+		if *config.PartialKeep < 0 {
+			return nil, fmt.Errorf("redaction for %s has negative PartialKeep %d", matcher, *config.PartialKeep)
+		}
+		r.partialKeep = *config.PartialKeep
+	}
+	for _, field := range config.Fields {
+		r.fields[field] = true
+	}
+	for _, name := range config.Detectors {
+		re, ok := RedactDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction detector %s", name)
+		}
+		r.regexps = append(r.regexps, re)
+		if name == "credit_card" {
+			r.luhnCheck[re] = true
+		}
+	}
+	for _, re := range config.Regexps {
+		if re == nil || re.Regexp == nil {
+			continue
+		}
+		r.regexps = append(r.regexps, re.Regexp)
+	}
+	if len(r.fields) == 0 && len(r.regexps) == 0 {
+		return nil, fmt.Errorf("redaction for %s requires Fields, Detectors or Regexps", matcher)
+	}
+	if r.mode == RedactModeHash && len(r.hashKey) == 0 {
+		return nil, fmt.Errorf("redaction for %s requires HashKey in hash mode", matcher)
+	}
+	return r, nil
+}
+
+func (r *Redactor) Filter(rs *fluent.FluentRecordSet) *fluent.FluentRecordSet {
+	if !r.matcher.Match(rs.Tag) {
+		return rs
+	}
+	for _, record := range rs.Records {
+		switch record := record.(type) {
+		case *fluent.TinyFluentMessage:
+			if len(r.fields) > 0 && !r.fields[record.FieldName] {
+				continue
+			}
+			record.Message = []byte(r.redactString(string(record.Message)))
+		case *fluent.TinyFluentRecord:
+			r.redactMap(record.Data, len(r.fields) == 0)
+		case *fluent.FluentRecord:
+			r.redactMap(record.Data, len(r.fields) == 0)
+		}
+	}
+	return rs
+}
+
+func (r *Redactor) redactMap(data map[string]interface{}, all bool) {
+	for key, value := range data {
+		if all || r.fields[key] {
+			data[key] = r.redactValue(value)
+		}
+	}
+}
+
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.redactString(v)
+	case []byte:
+		return []byte(r.redactString(string(v)))
+	case map[string]interface{}:
+		r.redactMap(v, true)
+	case []interface{}:
+		for i := range v {
+			v[i] = r.redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// redactString redacts substrings matched by regexps. Without regexps, whole of s is redacted.
+func (r *Redactor) redactString(s string) string {
+	if len(r.regexps) == 0 {
+		return r.redact(s)
+	}
+	for _, re := range r.regexps {
+		s = r.redactMatches(re, s)
+	}
+	return s
+}
+
+func (r *Redactor) redactMatches(re *regexp.Regexp, s string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			// redact the first capture group only
+			start, end = m[2], m[3]
+		}
+		if r.luhnCheck[re] && !luhn(s[start:end]) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(r.redact(s[start:end]))
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func (r *Redactor) redact(s string) string {
+	switch r.mode {
+	case RedactModePartial:
+		runes := []rune(s)
+		if len(runes) <= r.partialKeep {
+			return strings.Repeat(RedactMaskChar, len(runes))
+		}
+		n := len(runes) - r.partialKeep
+		return strings.Repeat(RedactMaskChar, n) + string(runes[n:])
+	case RedactModeHash:
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(s))
+		return RedactHashPrefix + hex.EncodeToString(mac.Sum(nil))
+	default:
+		return strings.Repeat(RedactMaskChar, len([]rune(s)))
+	}
+}
+
+// luhn validates a credit card number by Luhn algorithm. Spaces and hyphens are ignored.
+func luhn(s string) bool {
+	sum := 0
+	double := false
+	digits := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+		n := int(c - '0')
+		if double {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+		double = !double
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
@@ -0,0 +1,134 @@
+package hydra_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func newRedactor(t *testing.T, config *hydra.ConfigRedaction) *hydra.Redactor {
+	config.Restrict(&hydra.Config{})
+	r, err := hydra.NewRedactor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newRedactRecordSet(tag string, data map[string]interface{}) *fluent.FluentRecordSet {
+	return &fluent.FluentRecordSet{
+		Tag: tag,
+		Records: []fluent.FluentRecordType{
+			&fluent.TinyFluentRecord{Timestamp: time.Now(), Data: data},
+		},
+	}
+}
+
+func TestRedactDetectors(t *testing.T) {
+	r := newRedactor(t, &hydra.ConfigRedaction{
+		Detectors: []string{"email", "credit_card", "token"},
+	})
+	rs := newRedactRecordSet("app", map[string]interface{}{
+		"message": "user foo@example.com paid by 4111 1111 1111 1111",
+		"order":   "1234567890123456", // not a valid card number
+		"auth":    "Bearer abcdef123456",
+		"nested":  map[string]interface{}{"mail": "bar@example.jp"},
+		"status":  float64(200),
+	})
+	r.Filter(rs)
+	d := rs.Records[0].GetAllData()
+	if s := d["message"]; s != "user *************** paid by *******************" {
+		t.Errorf("unexpected message %s", s)
+	}
+	if s := d["order"]; s != "1234567890123456" {
+		t.Errorf("order must not be redacted %s", s)
+	}
+	if s := d["auth"]; s != "Bearer ************" {
+		t.Errorf("unexpected auth %s", s)
+	}
+	if s := d["nested"].(map[string]interface{})["mail"]; s != "**************" {
+		t.Errorf("unexpected nested mail %s", s)
+	}
+	if s := d["status"]; s != float64(200) {
+		t.Errorf("status must not be changed %v", s)
+	}
+}
+
+func TestRedactFieldsPartial(t *testing.T) {
+	r := newRedactor(t, &hydra.ConfigRedaction{
+		Match:  "app.**",
+		Fields: []string{"card"},
+		Mode:   hydra.RedactModePartial,
+	})
+	rs := newRedactRecordSet("app.payment", map[string]interface{}{
+		"card": "4111111111111111",
+		"memo": "4111111111111111",
+	})
+	r.Filter(rs)
+	d := rs.Records[0].GetAllData()
+	if s := d["card"]; s != "************1111" {
+		t.Errorf("unexpected card %s", s)
+	}
+	if s := d["memo"]; s != "4111111111111111" {
+		t.Errorf("memo must not be redacted %s", s)
+	}
+
+	rs = newRedactRecordSet("other", map[string]interface{}{"card": "4111111111111111"})
+	r.Filter(rs)
+	if s := rs.Records[0].GetAllData()["card"]; s != "4111111111111111" {
+		t.Errorf("unmatched tag must not be redacted %s", s)
+	}
+}
+
+func TestRedactPartialKeepZero(t *testing.T) {
+	zero := 0
+	r := newRedactor(t, &hydra.ConfigRedaction{
+		Fields:      []string{"card"},
+		Mode:        hydra.RedactModePartial,
+		PartialKeep: &zero,
+	})
+	rs := newRedactRecordSet("app", map[string]interface{}{"card": "4111111111111111"})
+	r.Filter(rs)
+	if s := rs.Records[0].GetAllData()["card"]; s != "****************" {
+		t.Errorf("unexpected card %s", s)
+	}
+}
+
+func TestRedactHashMessage(t *testing.T) {
+	r := newRedactor(t, &hydra.ConfigRedaction{
+		Detectors: []string{"email"},
+		Mode:      hydra.RedactModeHash,
+		HashKey:   "secret",
+	})
+	rs := hydra.NewFluentRecordSet("app", "message", hydra.FormatNone, nil, nil, []byte("login foo@example.com\nlogout foo@example.com"))
+	r.Filter(rs)
+	m1, _ := rs.Records[0].GetData("message")
+	m2, _ := rs.Records[1].GetData("message")
+	h1 := strings.TrimPrefix(string(m1.([]byte)), "login ")
+	h2 := strings.TrimPrefix(string(m2.([]byte)), "logout ")
+	if !strings.HasPrefix(h1, hydra.RedactHashPrefix) || strings.Contains(h1, "example.com") {
+		t.Errorf("unexpected hashed message %s", m1)
+	}
+	if h1 != h2 {
+		t.Errorf("hashed values must be same %s %s", h1, h2)
+	}
+}
+
+func TestRedactInvalidConfig(t *testing.T) {
+	negative := -1
+	configs := []*hydra.ConfigRedaction{
+		{},
+		{Detectors: []string{"unknown"}},
+		{Fields: []string{"foo"}, Mode: hydra.RedactModeHash},
+		{Fields: []string{"foo"}, Mode: hydra.RedactModePartial, PartialKeep: &negative},
+	}
+	for _, config := range configs {
+		config.Restrict(&hydra.Config{})
+		if _, err := hydra.NewRedactor(config); err == nil {
+			t.Errorf("config must be invalid %#v", config)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package hydra
+
+import (
+	"errors"
+	"log"
+	"reflect"
+)
+
+// ReloadConfigFile reads the config file which the running config was loaded from, and reloads it.
+func (c *Context) ReloadConfigFile() error {
+	c.reloadMu.Lock()
+	filename := c.config.filename
+	c.reloadMu.Unlock()
+	if filename == "" {
+		return errors.New("config was not loaded from a file")
+	}
+	config, err := ReadConfig(filename)
+	if err != nil {
+		return err
+	}
+	return c.Reload(config)
+}
+
+// Reload applies config to the running processes.
+// Only processes affected by differences from the running config are restarted,
+// keeping positions of files and queued messages.
+// It fails without changing anything when filters of config can't be built.
+func (c *Context) Reload(config *Config) error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	select {
+	case <-c.ControlCh:
+		return errors.New("shutting down")
+	default:
+	}
+	old := c.config
+	// build filters at first not to send records without redaction by invalid config
+	filtersChanged := !reflect.DeepEqual(old.Redactions, config.Redactions) || !reflect.DeepEqual(old.Aggregations, config.Aggregations)
+	var filters []Filter
+	if filtersChanged {
+		var err error
+		if filters, err = NewFilters(config); err != nil {
+			return err
+		}
+	}
+	log.Println("[info] Reloading config")
+
+	// prevent InputProcess.Wait() from returning while restarting inputs
+	c.InputProcess.Add(1)
+	defer c.InputProcess.Done()
+
+	applyGlobalConfig(config)
+
+	if !reflect.DeepEqual(old.Monitor, config.Monitor) {
+		log.Println("[info] Restarting monitor server")
+		if c.monitor != nil {
+			if err := c.monitor.Relisten(config.Monitor); err != nil {
+				log.Println("[error] Couldn't restart monitor server.", err)
+			}
+		} else if monitor, err := NewMonitor(config); err != nil {
+			log.Println("[error] Couldn't start monitor server.", err)
+		} else {
+			c.monitor = monitor
+			c.RunProcess(monitor)
+		}
+	}
+
+	// filters are inserted between inputs and outputs by restarting outputs, if they were not enabled
+	insertFilters := filtersChanged && c.filterProcess == nil && len(filters) > 0
+	if filtersChanged && c.filterProcess != nil {
+		log.Println("[info] Reloading filters")
+		c.filterProcess.Replace(filters)
+	}
+
+	if insertFilters ||
+		!reflect.DeepEqual(old.OutputGroups(), config.OutputGroups()) ||
+		!reflect.DeepEqual(old.Routes, config.Routes) ||
+		!reflect.DeepEqual(old.Buffer, config.Buffer) ||
+		old.ChunkLimitSize != config.ChunkLimitSize ||
+		old.ChunkLimitRecords != config.ChunkLimitRecords ||
+		old.FlushInterval != config.FlushInterval ||
+		old.DefaultOutputGroup() != config.DefaultOutputGroup() {
+		log.Println("[info] Restarting router and out_forward")
+		undelivered := c.stopOutputs()
+		if insertFilters {
+			log.Println("[info] Starting filters")
+			c.EnableFilters(filters)
+		}
+		c.MonitorCh <- &serversResetStat{servers: config.numServers()}
+		c.startOutputs(config, undelivered)
+	}
+
+	c.reloadInTails(config)
+
+	if !reflect.DeepEqual(old.Receiver, config.Receiver) {
+		var stopped *InForward
+		if c.inForward != nil {
+			log.Println("[info] Stopping in_forward", c.inForward.Addr)
+			c.inForward.Stop()
+			stopped = c.inForward
+			c.inForward = nil
+		}
+		if config.Receiver != nil {
+			c.startInForward(config.Receiver, stopped)
+		}
+	}
+
+	c.StartProcess.Wait()
+	c.config = config
+	log.Println("[info] Reloading config completed")
+	return nil
+}
+
+func (c *Context) reloadInTails(config *Config) {
+	configs := make(map[string]*ConfigLogfile)
+	added := make([]*ConfigLogfile, 0)
+	for _, cl := range config.Logs {
+		key, err := tailKey(cl)
+		if err != nil {
+			log.Println("[error]", err)
+			continue
+		}
+		if _, ok := configs[key]; ok {
+			continue // duplicated
+		}
+		configs[key] = cl
+		if _, ok := c.tails[key]; !ok {
+			added = append(added, cl)
+		}
+	}
+	for key, tail := range c.tails {
+		cl, ok := configs[key]
+		if ok && reflect.DeepEqual(tail.config, cl) {
+			continue
+		}
+		if key == StdinFilename {
+			log.Println("[warning] in_tail for STDIN can't be reloaded. ignored")
+			continue
+		}
+		tail.Stop()
+		delete(c.tails, key)
+		if ok {
+			log.Println("[info] Restarting in_tail", key)
+			c.startInTail(cl, tail)
+		} else {
+			log.Println("[info] Stopped in_tail", key)
+			c.MonitorCh <- &fileRemovedStat{file: key}
+		}
+	}
+	for _, cl := range added {
+		c.startInTail(cl, nil)
+	}
+	c.startWatcher()
+}
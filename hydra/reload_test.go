@@ -0,0 +1,178 @@
+package hydra_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func appendLines(t *testing.T, filename string, lines ...string) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		f.WriteString(line + "\n")
+	}
+}
+
+func TestReload(t *testing.T) {
+	log.Println("---- TestReload ----")
+	tmpdir, _ := ioutil.TempDir(os.TempDir(), "hydra-test")
+	defer os.RemoveAll(tmpdir)
+	fileA := filepath.Join(tmpdir, "a.log")
+	fileB := filepath.Join(tmpdir, "b.log")
+	appendLines(t, fileA)
+	appendLines(t, fileB)
+
+	var counter1, counter2 int64
+	addr1, closer1 := runMockServer(t, "", &counter1)
+	defer close(closer1)
+	addr2, closer2 := runMockServer(t, "", &counter2)
+	defer close(closer2)
+
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{newConfigServer(addr1)},
+		Logs: []*hydra.ConfigLogfile{
+			{Tag: "a", File: fileA},
+		},
+	}
+	config.Restrict()
+	c, err := hydra.Run(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleep(1)
+
+	appendLines(t, fileA, "a1", "a2", "a3")
+	sleep(2)
+	if n := atomic.LoadInt64(&counter1); n != 3 {
+		t.Errorf("server1 recieved %d expected 3", n)
+	}
+
+	// add file B and replace the server
+	config = &hydra.Config{
+		Servers: []*hydra.ConfigServer{newConfigServer(addr2)},
+		Logs: []*hydra.ConfigLogfile{
+			{Tag: "a", File: fileA},
+			{Tag: "b", File: fileB},
+		},
+	}
+	config.Restrict()
+	if err := c.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	sleep(1)
+	appendLines(t, fileA, "a4", "a5")
+	appendLines(t, fileB, "b1", "b2")
+	sleep(2)
+	if n := atomic.LoadInt64(&counter1); n != 3 {
+		t.Errorf("server1 recieved %d expected 3", n)
+	}
+	if n := atomic.LoadInt64(&counter2); n != 4 {
+		t.Errorf("server2 recieved %d expected 4", n)
+	}
+
+	// remove file B, and restart A
+	config = &hydra.Config{
+		Servers: []*hydra.ConfigServer{newConfigServer(addr2)},
+		Logs: []*hydra.ConfigLogfile{
+			{Tag: "a", File: fileA, FieldName: "msg"},
+		},
+	}
+	config.Restrict()
+	appendLines(t, fileA, "a6") // may be read after restarting
+	if err := c.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, fileA, "a7")
+	appendLines(t, fileB, "b3")
+	sleep(2)
+	if n := atomic.LoadInt64(&counter2); n != 6 {
+		t.Errorf("server2 recieved %d expected 6", n)
+	}
+	c.Shutdown()
+}
+
+func TestReloadFilters(t *testing.T) {
+	log.Println("---- TestReloadFilters ----")
+	tmpdir, _ := ioutil.TempDir(os.TempDir(), "hydra-test")
+	defer os.RemoveAll(tmpdir)
+	file := filepath.Join(tmpdir, "a.log")
+	appendLines(t, file)
+
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	newConfig := func(redactions ...*hydra.ConfigRedaction) *hydra.Config {
+		config := &hydra.Config{
+			Servers:    []*hydra.ConfigServer{newConfigServer(inForward.Addr.String())},
+			Logs:       []*hydra.ConfigLogfile{{Tag: "a", File: file}},
+			Redactions: redactions,
+		}
+		config.Restrict()
+		return config
+	}
+	received := func(line string) string {
+		appendLines(t, file, line)
+		select {
+		case rs := <-receiver.MessageCh:
+			return fmt.Sprintf("%s", rs.Records[0].GetAllData()["message"])
+		case <-time.After(3 * time.Second):
+			t.Fatal("records were not recieved")
+		}
+		return ""
+	}
+
+	c, err := hydra.Run(newConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	sleep(1)
+	if s := received("login foo@example.com"); !strings.Contains(s, "foo@example.com") {
+		t.Errorf("unexpected message %s", s)
+	}
+
+	// filters are inserted
+	if err := c.Reload(newConfig(&hydra.ConfigRedaction{Detectors: []string{"email"}})); err != nil {
+		t.Fatal(err)
+	}
+	sleep(1)
+	if s := received("login bar@example.com"); s != "login ***************" {
+		t.Errorf("unexpected message %s", s)
+	}
+
+	// invalid filters are rejected, and the running filters are kept
+	if err := c.Reload(newConfig(&hydra.ConfigRedaction{Detectors: []string{"unknown"}})); err == nil {
+		t.Error("Reload must fail with an invalid redaction")
+	}
+	if s := received("login baz@example.com"); s != "login ***************" {
+		t.Errorf("unexpected message %s", s)
+	}
+
+	// filters are replaced
+	if err := c.Reload(newConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if s := received("logout foo@example.com"); s != "logout foo@example.com" {
+		t.Errorf("unexpected message %s", s)
+	}
+}
@@ -0,0 +1,279 @@
+package hydra
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	dumpFileTimeFormat  = "2006-01-02-15" // suffix of dump files of fluent-http-tailf
+	replayCheckInterval = 100 * time.Millisecond
+)
+
+var errReplayTimeout = errors.New("replay timed out")
+
+// ReplayOption is the option of Replay.
+type ReplayOption struct {
+	Rate             int           // max records per second. 0 is unlimited
+	ProgressInterval time.Duration // interval of progress reports. 0 disables them
+	Timeout          time.Duration // Replay fails when no records are sent for Timeout while records are pending. 0 waits forever
+}
+
+// Replay reads record sets from files, and sends them to the servers of config with the original tags and timestamps.
+// Files can be secondary files (msgpack or JSON lines), chunks of the disk buffer, and dump files of fluent-http-tailf.
+// Replay returns after all record sets are sent.
+// When no records are sent for option.Timeout, Replay gives up without waiting for outputs,
+// and returns an error which lists the files not replayed completely.
+func Replay(config *Config, paths []string, option ReplayOption) error {
+	config = replayConfig(config)
+	c := NewContext()
+	c.config = config
+	monitor, err := NewMonitor(config)
+	if err != nil {
+		return err
+	}
+	c.monitor = monitor
+	c.RunProcess(monitor)
+	c.startOutputs(config, nil)
+	c.StartProcess.Wait()
+
+	var read, files, expected int64
+	start := time.Now()
+	report := func() {
+		sent := monitor.stats.sentMessages()
+		elapsed := time.Since(start).Seconds()
+		log.Printf(
+			"[info] replay: %d/%d files, %d records read, %d records sent (%.1f records/s)",
+			atomic.LoadInt64(&files), len(paths), atomic.LoadInt64(&read), sent, float64(sent)/elapsed,
+		)
+	}
+	done := make(chan interface{})
+	if option.ProgressInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(option.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					report()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	aborted := make(chan interface{})
+	if option.Timeout > 0 {
+		go func() {
+			ticker := time.NewTicker(replayCheckInterval)
+			defer ticker.Stop()
+			var sent int64
+			progressed := time.Now()
+			for {
+				select {
+				case now := <-ticker.C:
+					if s := monitor.stats.sentMessages(); s != sent || s >= atomic.LoadInt64(&expected) {
+						sent, progressed = s, now
+					} else if now.Sub(progressed) >= option.Timeout {
+						close(aborted)
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// ends[i] is the number of messages expected to be sent after paths[i] (copies to multiple groups are counted)
+	ends := make([]int64, len(paths))
+	replayed := make([]bool, len(paths))
+	var failed []string
+	for i, path := range paths {
+		log.Println("[info] replay", path)
+		err := ReadReplayFile(path, func(rs *fluent.FluentRecordSet) error {
+			if option.Rate > 0 {
+				// wait until the rate of records read so far is under the limit
+				due := start.Add(time.Duration(float64(atomic.LoadInt64(&read)) / float64(option.Rate) * float64(time.Second)))
+				time.Sleep(time.Until(due))
+			}
+			n := int64(len(rs.Records))
+			copies := int64(len(c.router.Groups(rs.Tag)))
+			select {
+			case c.MessageCh <- rs:
+			case <-aborted:
+				return errReplayTimeout
+			}
+			atomic.AddInt64(&read, n)
+			atomic.AddInt64(&expected, n*copies)
+			return nil
+		})
+		ends[i] = atomic.LoadInt64(&expected)
+		if err == errReplayTimeout {
+			break
+		}
+		if err != nil {
+			log.Println("[error] Couldn't replay", path, err)
+			failed = append(failed, path)
+		} else {
+			replayed[i] = true
+		}
+		atomic.AddInt64(&files, 1)
+	}
+
+	// wait for sending all record sets
+	var timedOut bool
+	select {
+	case <-aborted:
+		timedOut = true
+	default:
+		shutdown := make(chan interface{})
+		go func() {
+			c.Shutdown()
+			close(shutdown)
+		}()
+		select {
+		case <-shutdown:
+		case <-aborted:
+			timedOut = true
+		}
+	}
+	close(done)
+	report()
+	if timedOut {
+		sent := monitor.stats.sentMessages()
+		var rest []string
+		for i, path := range paths {
+			if !replayed[i] || ends[i] > sent {
+				rest = append(rest, path)
+			}
+		}
+		return fmt.Errorf("%s. no records were sent for %s. %d files were not replayed completely: %s", errReplayTimeout, option.Timeout, len(rest), strings.Join(rest, ", "))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d files couldn't be replayed completely: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// replayConfig returns a copy of config only for outputs.
+// The monitor, buffer and secondary are disabled not to conflict with the running agent.
+func replayConfig(config *Config) *Config {
+	replay := *config
+	replay.Logs = nil
+	replay.Receiver = nil
+	replay.Monitor = nil
+	replay.Buffer = nil
+	replay.Secondary = nil
+	replay.ServerGroups = make([]*ConfigServerGroup, len(config.ServerGroups))
+	for i, group := range config.ServerGroups {
+		g := *group
+		g.Secondary = nil
+		replay.ServerGroups[i] = &g
+	}
+	return &replay
+}
+
+// ReadReplayFile reads record sets from the file, and calls fn for each of them.
+// msgpack (forward protocol) files are detected by the content, and JSON lines of secondary files by the extension.
+// Other files are read as dump files of fluent-http-tailf, which lines are "[time\t][tag\t]{JSON or LTSV}".
+func ReadReplayFile(path string, fn func(*fluent.FluentRecordSet) error) error {
+	name := strings.TrimSuffix(path, secondaryWritingSuffix)
+	if strings.HasSuffix(name, ".jsonl") {
+		return ReadSecondaryFile(path, fn)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	head, err := r.Peek(1)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if isMsgpackArray(head[0]) {
+		return readMsgpack(r, fn)
+	}
+	return readDumpLines(name, r, fn)
+}
+
+// isMsgpackArray returns true if b is the first byte of msgpack arrays.
+func isMsgpackArray(b byte) bool {
+	return (b >= 0x90 && b <= 0x9f) || b == 0xdc || b == 0xdd
+}
+
+// readDumpLines reads lines of dump files.
+// The tag and time are taken from the name "<tag>.<YYYY-MM-DD-HH>" of the file unless lines include them.
+func readDumpLines(path string, r io.Reader, fn func(*fluent.FluentRecordSet) error) error {
+	defaultTag, defaultTime := filepath.Base(path), time.Now()
+	if i := strings.LastIndex(defaultTag, "."); i > 0 {
+		if t, err := time.ParseInLocation(dumpFileTimeFormat, defaultTag[i+1:], time.Local); err == nil {
+			defaultTag, defaultTime = defaultTag[:i], t
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	b := &recordSetBuilder{fn: fn}
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		tag, ts := defaultTag, defaultTime
+		// optional columns of time and tag
+		for i := 0; i < 2 && len(line) > 0 && line[0] != '{'; i++ {
+			j := bytes.IndexByte(line, '\t')
+			if j < 0 {
+				break
+			}
+			col := string(line[:j])
+			if t, err := time.Parse(time.RFC3339, col); err == nil {
+				ts = t
+			} else if !strings.Contains(col, LTSVDataSeparatorStr) {
+				tag = col
+			} else {
+				break
+			}
+			line = line[j+1:]
+		}
+		var (
+			record *fluent.TinyFluentRecord
+			err    error
+		)
+		if len(line) == 0 {
+			return fmt.Errorf("line %d: no record", n)
+		}
+		if line[0] == '{' {
+			record, err = parseJSON(DefaultFieldName, line)
+		} else {
+			record, err = parseLTSV(DefaultFieldName, line)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		record.Timestamp = ts
+		if err := b.add(tag, record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return b.flush()
+}
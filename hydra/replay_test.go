@@ -0,0 +1,141 @@
+package hydra_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+var dumpLines = "" +
+	`{"a":"1"}` + "\n" +
+	"2026-10-19T10:20:30Z\tother\t" + `{"b":"2"}` + "\n" +
+	"2026-10-19T10:20:31Z\tk:v\tk2:v2\n"
+
+func TestReadDumpFile(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-replay")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.access.2026-10-19-10")
+	ioutil.WriteFile(path, []byte(dumpLines), 0644)
+
+	var sets []*fluent.FluentRecordSet
+	err := hydra.ReadReplayFile(path, func(rs *fluent.FluentRecordSet) error {
+		sets = append(sets, rs)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		tag   string
+		time  time.Time
+		key   string
+		value string
+	}{
+		{"app.access", time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local), "a", "1"},
+		{"other", time.Date(2026, 10, 19, 10, 20, 30, 0, time.UTC), "b", "2"},
+		{"app.access", time.Date(2026, 10, 19, 10, 20, 31, 0, time.UTC), "k2", "v2"},
+	}
+	if len(sets) != len(expected) {
+		t.Fatalf("read %d record sets expected %d", len(sets), len(expected))
+	}
+	for i, e := range expected {
+		rs := sets[i]
+		if rs.Tag != e.tag {
+			t.Errorf("[%d] tag %s expected %s", i, rs.Tag, e.tag)
+		}
+		record := rs.Records[0].(*fluent.TinyFluentRecord)
+		if !record.Timestamp.Equal(e.time) {
+			t.Errorf("[%d] time %s expected %s", i, record.Timestamp, e.time)
+		}
+		if v, _ := record.GetData(e.key); v != e.value {
+			t.Errorf("[%d] %s=%v expected %s", i, e.key, v, e.value)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-replay")
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, format := range []string{hydra.SecondaryMsgpack, hydra.SecondaryJSON} {
+		config := &hydra.ConfigSecondary{Path: dir, Format: format}
+		config.Restrict(nil)
+		s, _ := hydra.NewSecondaryFile(config, format)
+		for i := 0; i < 3; i++ {
+			s.Write(prepareRecordSet())
+		}
+		s.Close()
+		files, _ := filepath.Glob(filepath.Join(dir, format+".*"))
+		paths = append(paths, files...)
+	}
+	dump := filepath.Join(dir, "app.access.2026-10-19-10")
+	ioutil.WriteFile(dump, []byte(dumpLines), 0644)
+	paths = append(paths, dump)
+
+	counter := int64(0)
+	addr, closer := runMockServer(t, "", &counter)
+	defer close(closer)
+	config := &hydra.Config{Servers: []*hydra.ConfigServer{newConfigServer(addr)}}
+	config.Restrict()
+
+	start := time.Now()
+	err := hydra.Replay(config, paths, hydra.ReplayOption{Rate: 10, ProgressInterval: 500 * time.Millisecond})
+	if err != nil {
+		t.Error(err)
+	}
+	elapsed := time.Since(start)
+	time.Sleep(500 * time.Millisecond)
+	expected := int64(2*3*len(TestMessageLines) + 3)
+	if n := atomic.LoadInt64(&counter); n != expected {
+		t.Errorf("recieved %d expected %d", n, expected)
+	}
+	// 21 records at 10 records/s
+	if elapsed < 1500*time.Millisecond {
+		t.Errorf("replayed too fast %s. rate limit is not applied", elapsed)
+	}
+}
+
+func TestReplayTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-replay")
+	defer os.RemoveAll(dir)
+	var paths []string
+	for _, name := range []string{"app.a.2026-10-19-10", "app.b.2026-10-19-10"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(dumpLines), 0644)
+		paths = append(paths, path)
+	}
+
+	// reserve an address, and leave the server down
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	config := &hydra.Config{Servers: []*hydra.ConfigServer{newConfigServer(addr)}}
+	config.Restrict()
+
+	done := make(chan error)
+	go func() {
+		done <- hydra.Replay(config, paths, hydra.ReplayOption{Timeout: time.Second})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Replay must fail when servers are down")
+		}
+		for _, path := range paths {
+			if !strings.Contains(err.Error(), path) {
+				t.Errorf("%s must be listed in the error: %s", path, err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Replay must give up after Timeout")
+	}
+}
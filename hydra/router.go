@@ -0,0 +1,169 @@
+package hydra
+
+import (
+	"log"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+// Router recieve FluentRecordSet from inputs (or filters), and dispatch it to outputs of server groups by tag.
+type Router struct {
+	routes       []*route
+	defaultGroup string
+	outputs      map[string]chan *fluent.FluentRecordSet
+	pending      []*fluent.FluentRecordSet
+	undelivered  map[string][]*fluent.FluentRecordSet
+	warned       map[string]bool
+	stopCh       chan interface{}
+	done         chan interface{}
+}
+
+type route struct {
+	matcher *TagMatcher
+	groups  []string
+}
+
+// NewRouter creates a Router which has an output channel for each server group in config.
+// Invalid routes are ignored.
+func NewRouter(config *Config) *Router {
+	r := &Router{
+		defaultGroup: config.DefaultOutputGroup(),
+		outputs:      make(map[string]chan *fluent.FluentRecordSet),
+		undelivered:  make(map[string][]*fluent.FluentRecordSet),
+		warned:       make(map[string]bool),
+		stopCh:       make(chan interface{}),
+		done:         make(chan interface{}),
+	}
+	for _, group := range config.OutputGroups() {
+		r.outputs[group.Name] = make(chan *fluent.FluentRecordSet, MessageChannelBufferLen)
+	}
+	for _, cr := range config.Routes {
+		matcher, err := NewTagMatcher(cr.Match)
+		if err != nil {
+			log.Println("[error] route ignored.", err)
+			continue
+		}
+		log.Println("[info] Route", matcher, "to", cr.Groups)
+		r.routes = append(r.routes, &route{matcher: matcher, groups: cr.Groups})
+	}
+	return r
+}
+
+// Output returns the channel for the server group.
+func (r *Router) Output(group string) chan *fluent.FluentRecordSet {
+	return r.outputs[group]
+}
+
+// TakeOver makes r to route record sets at first.
+func (r *Router) TakeOver(pending []*fluent.FluentRecordSet) {
+	r.pending = pending
+}
+
+// Stop stops routing and waits for finishing it.
+// Record sets which couldn't be passed to outputs yet are returned by group names.
+func (r *Router) Stop() map[string][]*fluent.FluentRecordSet {
+	close(r.stopCh)
+	<-r.done
+	return r.undelivered
+}
+
+// Groups returns names of server groups which the tag is routed to.
+// The first route matched to the tag is used. When no routes are matched, the default group is used.
+func (r *Router) Groups(tag string) []string {
+	for _, rt := range r.routes {
+		if rt.matcher.Match(tag) {
+			return rt.groups
+		}
+	}
+	return []string{r.defaultGroup}
+}
+
+func (r *Router) Run(c *Context) {
+	c.OutputProcess.Add(1)
+	defer c.OutputProcess.Done()
+	defer close(r.done)
+
+	c.StartProcess.Done()
+
+	pending := r.pending
+	r.pending = nil
+	for i, rs := range pending {
+		if !r.route(rs) {
+			for _, rest := range pending[i+1:] {
+				r.keep(rest, r.Groups(rest.Tag))
+			}
+			log.Println("[info] stop router")
+			return
+		}
+	}
+	for {
+		select {
+		case rs, ok := <-c.OutputCh:
+			if !ok {
+				log.Println("[info] shutdown router")
+				for _, ch := range r.outputs {
+					close(ch)
+				}
+				return
+			}
+			if !r.route(rs) {
+				log.Println("[info] stop router")
+				return
+			}
+		case <-r.stopCh:
+			log.Println("[info] stop router")
+			return
+		}
+	}
+}
+
+// route passes rs to outputs. It returns false when the router was stopped.
+// When rs is routed to multiple groups, each group gets its own copy not to share records modified by outputs.
+func (r *Router) route(rs *fluent.FluentRecordSet) bool {
+	groups := r.Groups(rs.Tag)
+	sets := copies(rs, len(groups))
+	for i, group := range groups {
+		ch, ok := r.outputs[group]
+		if !ok {
+			if !r.warned[rs.Tag] {
+				log.Printf("[warning] server group %s for tag %s is not defined. records are dropped", group, rs.Tag)
+				r.warned[rs.Tag] = true
+			}
+			continue
+		}
+		select {
+		case ch <- sets[i]:
+		case <-r.stopCh:
+			for j, rest := range groups[i:] {
+				r.keepGroup(sets[i+j], rest)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Router) keep(rs *fluent.FluentRecordSet, groups []string) {
+	for i, set := range copies(rs, len(groups)) {
+		r.keepGroup(set, groups[i])
+	}
+}
+
+func (r *Router) keepGroup(rs *fluent.FluentRecordSet, group string) {
+	if _, ok := r.outputs[group]; ok {
+		r.undelivered[group] = append(r.undelivered[group], rs)
+	}
+}
+
+// copies returns rs and n-1 copies of it, which are made before rs is passed to any outputs.
+func copies(rs *fluent.FluentRecordSet, n int) []*fluent.FluentRecordSet {
+	sets := make([]*fluent.FluentRecordSet, n)
+	for i := range sets {
+		if i == 0 {
+			sets[i] = rs
+		} else {
+			sets[i] = rs.Copy()
+		}
+	}
+	return sets
+}
@@ -0,0 +1,111 @@
+package hydra_test
+
+import (
+	"log"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func TestRouterGroups(t *testing.T) {
+	config := &hydra.Config{
+		Routes: []*hydra.ConfigRoute{
+			{Match: "security.** audit.*", Groups: []string{"security"}},
+			{Match: "both.*", Groups: []string{"security", "app"}},
+			{Match: "**", Groups: []string{"all"}},
+		},
+	}
+	router := hydra.NewRouter(config)
+	tests := map[string][]string{
+		"security":       {"security"},
+		"security.login": {"security"},
+		"audit.x":        {"security"},
+		"both.x":         {"security", "app"},
+		"app.access":     {"all"},
+	}
+	for tag, expected := range tests {
+		if groups := router.Groups(tag); !reflect.DeepEqual(groups, expected) {
+			t.Errorf("%s expected %v got %v", tag, expected, groups)
+		}
+	}
+
+	router = hydra.NewRouter(&hydra.Config{DefaultGroup: "app"})
+	if groups := router.Groups("foo"); !reflect.DeepEqual(groups, []string{"app"}) {
+		t.Errorf("unmatched tag must be routed to DefaultGroup. got %v", groups)
+	}
+}
+
+func TestRouterCopy(t *testing.T) {
+	config := &hydra.Config{
+		ServerGroups: []*hydra.ConfigServerGroup{{Name: "a"}, {Name: "b"}},
+		Routes:       []*hydra.ConfigRoute{{Match: "**", Groups: []string{"a", "b"}}},
+	}
+	router := hydra.NewRouter(config)
+	c := hydra.NewContext()
+	c.RunProcess(router)
+	c.StartProcess.Wait()
+
+	c.OutputCh <- &fluent.FluentRecordSet{
+		Tag: "test",
+		Records: []fluent.FluentRecordType{
+			&fluent.TinyFluentRecord{Data: map[string]interface{}{"message": "original"}},
+		},
+	}
+	a := <-router.Output("a")
+	a.Records[0].GetAllData()["message"] = "modified"
+	b := <-router.Output("b")
+	if v, _ := b.Records[0].GetData("message"); v != "original" {
+		t.Errorf("records modified for a group must not affect another group. got %v", v)
+	}
+	router.Stop()
+}
+
+func TestRouting(t *testing.T) {
+	log.Println("---- TestRouting ----")
+	var defaultCounter, securityCounter int64
+	defaultAddr, defaultCloser := runMockServer(t, "", &defaultCounter)
+	defer close(defaultCloser)
+	securityAddr, securityCloser := runMockServer(t, "", &securityCounter)
+	defer close(securityCloser)
+
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{newConfigServer(defaultAddr)},
+		ServerGroups: []*hydra.ConfigServerGroup{
+			{
+				Name:    "security",
+				Servers: []*hydra.ConfigServer{newConfigServer(securityAddr)},
+			},
+		},
+		Routes: []*hydra.ConfigRoute{
+			{Match: "security.**", Groups: []string{"security"}},
+			{Match: "audit.**", Groups: []string{"security", hydra.DefaultServerGroup}},
+		},
+	}
+	config.Restrict()
+	if errs := config.Validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	c, err := hydra.Run(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleep(1)
+
+	n := int64(len(TestMessageLines))
+	for _, tag := range []string{"app.access", "security.login", "audit.x"} {
+		rs := prepareRecordSet()
+		rs.Tag = tag
+		c.MessageCh <- rs
+	}
+	sleep(2)
+	if got := atomic.LoadInt64(&defaultCounter); got != n*2 {
+		t.Errorf("default group recieved %d expected %d", got, n*2)
+	}
+	if got := atomic.LoadInt64(&securityCounter); got != n*2 {
+		t.Errorf("security group recieved %d expected %d", got, n*2)
+	}
+	c.Shutdown()
+}
@@ -0,0 +1,259 @@
+package hydra
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+)
+
+const (
+	SecondaryMsgpack = "msgpack"
+	SecondaryJSON    = "json"
+
+	DefaultSecondaryRetryTimeout   = 60 * time.Second
+	DefaultSecondaryRotateSize     = 64 * 1024 * 1024
+	DefaultSecondaryRotateInterval = 1 * time.Hour
+
+	secondaryWritingSuffix = ".writing"
+	secondaryTimeFormat    = "20060102T150405.000000000"
+	readRecordSetLimit     = 1000 // max records of a record set read from line based files
+)
+
+// SecondaryFile writes record sets which couldn't be sent to any server into files (like fluentd's <secondary>).
+// Files are rotated by size and interval, and they can be replayed by ReadSecondaryFile.
+// A file being written has the ".writing" suffix, which is removed when the file is rotated or closed.
+type SecondaryFile struct {
+	RetryTimeout time.Duration // record sets are written after servers are unavailable for the duration
+
+	config *ConfigSecondary
+	name   string
+	file   *os.File
+	path   string
+	size   int64
+	opened time.Time
+}
+
+// NewSecondaryFile returns a SecondaryFile which writes files named with name in config.Path.
+// Files left being written by the previous process are closed at first.
+func NewSecondaryFile(config *ConfigSecondary, name string) (*SecondaryFile, error) {
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, err
+	}
+	s := &SecondaryFile{
+		RetryTimeout: config.RetryTimeout.Duration,
+		config:       config,
+		name:         url.PathEscape(name),
+	}
+	left, _ := filepath.Glob(filepath.Join(config.Path, s.name+".*"+secondaryWritingSuffix))
+	for _, path := range left {
+		log.Println("[info] close secondary file left by the previous process", path)
+		if err := os.Rename(path, strings.TrimSuffix(path, secondaryWritingSuffix)); err != nil {
+			log.Println("[warning]", err)
+		}
+	}
+	return s, nil
+}
+
+// Write appends rs to the current file, which is rotated if needed.
+func (s *SecondaryFile) Write(rs *fluent.FluentRecordSet) error {
+	var data []byte
+	var err error
+	if s.config.Format == SecondaryJSON {
+		data, err = jsonLines(rs)
+	} else {
+		data, err = rs.PackAsPackedForward()
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if s.file != nil && (s.size >= s.config.RotateSize || now.Sub(s.opened) >= s.config.RotateInterval.Duration) {
+		if err := s.Close(); err != nil {
+			log.Println("[warning] Couldn't close secondary file.", err)
+		}
+	}
+	if s.file == nil {
+		if err := s.open(now); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	s.size += int64(len(data))
+	return nil
+}
+
+func (s *SecondaryFile) open(now time.Time) error {
+	ext := SecondaryMsgpack
+	if s.config.Format == SecondaryJSON {
+		ext = "jsonl"
+	}
+	path := filepath.Join(s.config.Path, fmt.Sprintf("%s.%s.%s", s.name, now.Format(secondaryTimeFormat), ext))
+	f, err := os.OpenFile(path+secondaryWritingSuffix, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	log.Println("[info] open secondary file", path)
+	s.file = f
+	s.path = path
+	s.size = 0
+	s.opened = now
+	return nil
+}
+
+// Close closes the current file and removes the ".writing" suffix.
+func (s *SecondaryFile) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(s.path+secondaryWritingSuffix, s.path)
+}
+
+// secondaryLine is a record in JSON lines format.
+type secondaryLine struct {
+	Tag    string                 `json:"tag"`
+	Time   time.Time              `json:"time"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// decodeRecordSet returns rs in the form decoded from forward protocol,
+// which records have timestamps and string values instead of []byte.
+func decodeRecordSet(rs *fluent.FluentRecordSet) (*fluent.FluentRecordSet, error) {
+	packed, err := rs.PackAsPackedForward()
+	if err != nil {
+		return nil, err
+	}
+	sets, err := fluent.DecodeEntries(bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) != 1 {
+		return nil, fmt.Errorf("unexpected %d record sets", len(sets))
+	}
+	return &sets[0], nil
+}
+
+func jsonLines(rs *fluent.FluentRecordSet) ([]byte, error) {
+	decoded, err := decodeRecordSet(rs)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, record := range decoded.Records {
+		r := record.(*fluent.TinyFluentRecord)
+		if err := enc.Encode(secondaryLine{Tag: rs.Tag, Time: r.Timestamp, Record: r.Data}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// ReadSecondaryFile reads record sets from the file written by SecondaryFile, and calls fn for each of them.
+// The format is detected by the extension of path.
+func ReadSecondaryFile(path string, fn func(*fluent.FluentRecordSet) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(strings.TrimSuffix(path, secondaryWritingSuffix), ".jsonl") {
+		return readJSONLines(f, fn)
+	}
+	return readMsgpack(bufio.NewReader(f), fn)
+}
+
+// readMsgpack reads messages of forward protocol until EOF.
+func readMsgpack(r *bufio.Reader, fn func(*fluent.FluentRecordSet) error) error {
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		}
+		sets, err := fluent.DecodeEntries(r)
+		if err != nil {
+			return err
+		}
+		for i := range sets {
+			if err := fn(&sets[i]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readJSONLines reads JSON lines, and calls fn for each record set of consecutive lines with the same tag.
+func readJSONLines(r io.Reader, fn func(*fluent.FluentRecordSet) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	b := &recordSetBuilder{fn: fn}
+	n := 0
+	for scanner.Scan() {
+		n++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line secondaryLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if line.Tag == "" {
+			return fmt.Errorf("line %d: tag is missing", n)
+		}
+		if err := b.add(line.Tag, &fluent.TinyFluentRecord{Timestamp: line.Time, Data: line.Record}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// recordSetBuilder builds record sets from records read one by one.
+// Consecutive records with the same tag are passed to fn as a record set.
+type recordSetBuilder struct {
+	rs *fluent.FluentRecordSet
+	fn func(*fluent.FluentRecordSet) error
+}
+
+func (b *recordSetBuilder) add(tag string, record fluent.FluentRecordType) error {
+	if b.rs != nil && (b.rs.Tag != tag || len(b.rs.Records) >= readRecordSetLimit) {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	if b.rs == nil {
+		b.rs = &fluent.FluentRecordSet{Tag: tag}
+	}
+	b.rs.Records = append(b.rs.Records, record)
+	return nil
+}
+
+func (b *recordSetBuilder) flush() error {
+	if b.rs == nil {
+		return nil
+	}
+	rs := b.rs
+	b.rs = nil
+	return b.fn(rs)
+}
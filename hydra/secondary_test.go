@@ -0,0 +1,147 @@
+package hydra_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+func readSecondaryFiles(t *testing.T, dir string) []*fluent.FluentRecordSet {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(paths)
+	var sets []*fluent.FluentRecordSet
+	for _, path := range paths {
+		err := hydra.ReadSecondaryFile(path, func(rs *fluent.FluentRecordSet) error {
+			sets = append(sets, rs)
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	return sets
+}
+
+func TestSecondaryFile(t *testing.T) {
+	for _, format := range []string{hydra.SecondaryMsgpack, hydra.SecondaryJSON} {
+		dir, _ := ioutil.TempDir(os.TempDir(), "hydra-secondary")
+		defer os.RemoveAll(dir)
+
+		config := &hydra.ConfigSecondary{Path: dir, Format: format, RotateSize: 1}
+		config.Restrict(nil)
+		s, err := hydra.NewSecondaryFile(config, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tag := range []string{"a", "b", "c"} {
+			rs := prepareRecordSet()
+			rs.Tag = tag
+			if err := s.Write(rs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if writing, _ := filepath.Glob(filepath.Join(dir, "*.writing")); len(writing) != 1 {
+			t.Errorf("%s: %d files are being written, expected 1", format, len(writing))
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "default.*")); len(files) != 3 {
+			t.Errorf("%s: %d files expected 3 (rotated by size)", format, len(files))
+		}
+
+		sets := readSecondaryFiles(t, dir)
+		if len(sets) != 3 {
+			t.Fatalf("%s: read %d record sets expected 3", format, len(sets))
+		}
+		for i, tag := range []string{"a", "b", "c"} {
+			if sets[i].Tag != tag {
+				t.Errorf("%s: tag %s expected %s", format, sets[i].Tag, tag)
+			}
+			if len(sets[i].Records) != len(TestMessageLines) {
+				t.Errorf("%s: %d records expected %d", format, len(sets[i].Records), len(TestMessageLines))
+				continue
+			}
+			for j, record := range sets[i].Records {
+				if v, _ := record.GetData(TestFieldName); v != TestMessageLines[j] {
+					t.Errorf("%s: message %v expected %s", format, v, TestMessageLines[j])
+				}
+			}
+		}
+	}
+}
+
+func TestSecondaryFileLeft(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-secondary")
+	defer os.RemoveAll(dir)
+
+	config := &hydra.ConfigSecondary{Path: dir}
+	config.Restrict(nil)
+	s, _ := hydra.NewSecondaryFile(config, "default")
+	s.Write(prepareRecordSet())
+	// crashed without closing
+
+	if _, err := hydra.NewSecondaryFile(config, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if writing, _ := filepath.Glob(filepath.Join(dir, "*.writing")); len(writing) != 0 {
+		t.Errorf("files left being written must be closed: %v", writing)
+	}
+	if sets := readSecondaryFiles(t, dir); len(sets) != 1 {
+		t.Errorf("read %d record sets expected 1", len(sets))
+	}
+}
+
+func TestForwardSecondary(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-secondary")
+	defer os.RemoveAll(dir)
+
+	// reserve an address, and leave the server down
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	config := &hydra.ConfigSecondary{
+		Path:         dir,
+		RetryTimeout: hydra.Duration{Duration: 500 * time.Millisecond},
+	}
+	config.Restrict(nil)
+	secondary, err := hydra.NewSecondaryFile(config, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{newConfigServer(addr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outForward.Secondary = secondary
+	c.RunProcess(outForward)
+
+	n := 5
+	for i := 0; i < n; i++ {
+		select {
+		case c.MessageCh <- prepareRecordSet():
+		case <-time.After(5 * time.Second):
+			t.Fatal("inputs are blocked after the retry timeout")
+		}
+	}
+	// all record sets are written to secondary, so shutdown doesn't block
+	c.Shutdown()
+
+	sets := readSecondaryFiles(t, dir)
+	if len(sets) != n {
+		t.Errorf("%d record sets written to secondary, expected %d", len(sets), n)
+	}
+	if writing, _ := filepath.Glob(filepath.Join(dir, "*.writing")); len(writing) != 0 {
+		t.Errorf("secondary files must be closed on shutdown: %v", writing)
+	}
+}
@@ -0,0 +1,101 @@
+package hydra
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagMatcher matches tags by fluentd style patterns.
+//
+//	"a.*"     matches "a.b", not "a" nor "a.b.c"
+//	"a.**"    matches "a", "a.b" and "a.b.c"
+//	"{a,b}.c" matches "a.c" and "b.c"
+//
+// Multiple patterns are separated by whitespace.
+type TagMatcher struct {
+	patterns []string
+	regexps  []*regexp.Regexp
+}
+
+func NewTagMatcher(pattern string) (*TagMatcher, error) {
+	m := &TagMatcher{}
+	for _, p := range strings.Fields(pattern) {
+		expr, err := tagPatternToRegexp(p)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %s: %s", p, err)
+		}
+		m.patterns = append(m.patterns, p)
+		m.regexps = append(m.regexps, re)
+	}
+	if len(m.regexps) == 0 {
+		return nil, fmt.Errorf("empty tag pattern")
+	}
+	return m, nil
+}
+
+func (m *TagMatcher) Match(tag string) bool {
+	for _, re := range m.regexps {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *TagMatcher) String() string {
+	return strings.Join(m.patterns, " ")
+}
+
+func (m *TagMatcher) UnmarshalText(text []byte) error {
+	_m, err := NewTagMatcher(string(text))
+	if err != nil {
+		return err
+	}
+	*m = *_m
+	return nil
+}
+
+func tagPatternToRegexp(p string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], ".**"):
+			// "a.**" matches "a" too
+			b.WriteString(`(?:\..*)?`)
+			i += 2
+		case strings.HasPrefix(p[i:], "**."):
+			// "**.a" matches "a" too
+			b.WriteString(`(?:.*\.)?`)
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(`.*`)
+			i++
+		case c == '*':
+			b.WriteString(`[^.]*`)
+		case c == '{':
+			end := strings.IndexByte(p[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("invalid tag pattern %s: unclosed {", p)
+			}
+			alts := strings.Split(p[i+1:i+end], ",")
+			exprs := make([]string, 0, len(alts))
+			for _, alt := range alts {
+				expr, err := tagPatternToRegexp(alt)
+				if err != nil {
+					return "", err
+				}
+				exprs = append(exprs, expr)
+			}
+			b.WriteString("(?:" + strings.Join(exprs, "|") + ")")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
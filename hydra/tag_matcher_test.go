@@ -0,0 +1,56 @@
+package hydra_test
+
+import (
+	"testing"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+var tagMatcherTests = []struct {
+	pattern string
+	tag     string
+	match   bool
+}{
+	{"a", "a", true},
+	{"a", "b", false},
+	{"a.*", "a.b", true},
+	{"a.*", "a", false},
+	{"a.*", "a.b.c", false},
+	{"a.**", "a", true},
+	{"a.**", "a.b", true},
+	{"a.**", "a.b.c", true},
+	{"a.**", "ab", false},
+	{"**.c", "c", true},
+	{"**.c", "a.b.c", true},
+	{"a.**.c", "a.c", true},
+	{"a.**.c", "a.b.c", true},
+	{"a.**.c", "a.b.d", false},
+	{"**", "anything.goes", true},
+	{"{a,b}.c", "a.c", true},
+	{"{a,b}.c", "b.c", true},
+	{"{a,b}.c", "x.c", false},
+	{"a.{b,c.*}", "a.c.d", true},
+	{"a b", "b", true},
+	{"a b", "c", false},
+}
+
+func TestTagMatcher(t *testing.T) {
+	for _, tt := range tagMatcherTests {
+		m, err := hydra.NewTagMatcher(tt.pattern)
+		if err != nil {
+			t.Errorf("%s: %s", tt.pattern, err)
+			continue
+		}
+		if got := m.Match(tt.tag); got != tt.match {
+			t.Errorf("%s match %s got %v expected %v", tt.pattern, tt.tag, got, tt.match)
+		}
+	}
+}
+
+func TestTagMatcherInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "a.{b,c"} {
+		if _, err := hydra.NewTagMatcher(pattern); err == nil {
+			t.Errorf("pattern %q must be invalid", pattern)
+		}
+	}
+}
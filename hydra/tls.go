@@ -0,0 +1,81 @@
+package hydra
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig returns a client TLS config to connect to the server. It returns nil if TLS is not enabled.
+func (cs *ConfigServer) TLSConfig() (*tls.Config, error) {
+	if !cs.TLS {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         cs.ServerName,
+		InsecureSkipVerify: cs.InsecureSkipVerify,
+	}
+	if cs.CAFile != "" {
+		pool, err := loadCertPool(cs.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if cs.CertFile != "" || cs.KeyFile != "" {
+		cert, err := loadKeyPair(cs.CertFile, cs.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// TLSConfig returns a server TLS config for the receiver. It returns nil if TLS is not enabled.
+func (cr *ConfigReceiver) TLSConfig() (*tls.Config, error) {
+	if !cr.TLS {
+		return nil, nil
+	}
+	cert, err := loadKeyPair(cr.CertFile, cr.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if cr.ClientCAFile != "" {
+		pool, err := loadCertPool(cr.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, errors.New("both of CertFile and KeyFile are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, fmt.Errorf("Couldn't load key pair: %s", err)
+	}
+	return cert, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,156 @@
+package hydra_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+)
+
+// writeCert generates a certificate signed by parent (self-signed if parent is nil), and writes it to dir/name.{crt,key}.
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func prepareCerts(t *testing.T, dir string) {
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hydra test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "hydra"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+}
+
+func TestForwardTLS(t *testing.T) {
+	log.Println("---- TestForwardTLS ----")
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-tls")
+	defer os.RemoveAll(dir)
+	prepareCerts(t, dir)
+
+	receiver := hydra.NewContext()
+	inForward, err := hydra.NewInForward(&hydra.ConfigReceiver{
+		Host:              "127.0.0.1",
+		MaxBufferMessages: 1000,
+		TLS:               true,
+		CertFile:          filepath.Join(dir, "server.crt"),
+		KeyFile:           filepath.Join(dir, "server.key"),
+		ClientCAFile:      filepath.Join(dir, "ca.crt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.RunProcess(inForward)
+	defer receiver.Shutdown()
+
+	// a client without certificate is rejected
+	server := newConfigServer(inForward.Addr.String())
+	server.TLS = true
+	server.InsecureSkipVerify = true
+	c := hydra.NewContext()
+	outForward, err := hydra.NewOutForward([]*hydra.ConfigServer{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+	c.MessageCh <- prepareRecordSet()
+	select {
+	case <-receiver.MessageCh:
+		t.Error("records from a client without certificate must be rejected")
+	case <-time.After(time.Second):
+	}
+	c.Shutdown()
+
+	server = newConfigServer(inForward.Addr.String())
+	server.TLS = true
+	server.CAFile = filepath.Join(dir, "ca.crt")
+	server.CertFile = filepath.Join(dir, "client.crt")
+	server.KeyFile = filepath.Join(dir, "client.key")
+	c = hydra.NewContext()
+	outForward, err = hydra.NewOutForward([]*hydra.ConfigServer{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RunProcess(outForward)
+	defer c.Shutdown()
+	c.MessageCh <- prepareRecordSet()
+	select {
+	case rs := <-receiver.MessageCh:
+		if len(rs.Records) != len(TestMessageLines) {
+			t.Errorf("recieved %d records expected %d", len(rs.Records), len(TestMessageLines))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("records were not recieved via TLS")
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	config := &hydra.Config{
+		Servers: []*hydra.ConfigServer{
+			{Host: "127.0.0.1", TLS: true, CertFile: "client.crt"},
+		},
+		Receiver: &hydra.ConfigReceiver{TLS: true},
+	}
+	config.Restrict()
+	expected := []string{
+		"Servers[0]: TLS: both of CertFile and KeyFile are required",
+		"Receiver: TLS: both of CertFile and KeyFile are required",
+	}
+	errs := config.Validate()
+	if len(errs) != len(expected) {
+		t.Fatalf("%d problems expected, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %s got %s", expected[i], err)
+		}
+	}
+}
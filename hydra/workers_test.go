@@ -0,0 +1,298 @@
+package hydra_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/fluent-agent-hydra/fluent"
+	"github.com/fujiwara/fluent-agent-hydra/hydra"
+	"github.com/mattn/go-scan"
+)
+
+// orderCollector records the sequence numbers and connections of records for each tag.
+type orderCollector struct {
+	mu    sync.Mutex
+	seqs  map[string][]string
+	conns map[string]map[string]bool
+	count int
+}
+
+func (oc *orderCollector) run(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				remote := conn.RemoteAddr().String()
+				for {
+					recordSets, err := fluent.DecodeEntries(conn)
+					if err != nil {
+						return
+					}
+					oc.mu.Lock()
+					for _, rs := range recordSets {
+						if oc.conns[rs.Tag] == nil {
+							oc.conns[rs.Tag] = make(map[string]bool)
+						}
+						oc.conns[rs.Tag][remote] = true
+						for _, record := range rs.Records {
+							v, _ := record.GetData("seq")
+							oc.seqs[rs.Tag] = append(oc.seqs[rs.Tag], fmt.Sprint(v))
+							oc.count++
+						}
+					}
+					oc.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func (oc *orderCollector) wait(n int) {
+	for i := 0; i < 50; i++ {
+		oc.mu.Lock()
+		count := oc.count
+		oc.mu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestForwardWorkers(t *testing.T) {
+	oc := &orderCollector{
+		seqs:  make(map[string][]string),
+		conns: make(map[string]map[string]bool),
+	}
+	addr, closer := oc.run(t)
+	defer closer()
+
+	config := &hydra.Config{
+		Servers:          []*hydra.ConfigServer{newConfigServer(addr)},
+		ServerWorkers:    4,
+		ServerOrderByTag: true,
+	}
+	tags := []string{"app.a", "app.b", "app.c", "app.d", "app.e", "app.f", "app.g", "app.h"}
+	sets := 20
+	c := runWorkers(t, config, tags, sets)
+	oc.wait(sets * len(tags))
+	c.Shutdown()
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	used := make(map[string]bool)
+	for _, tag := range tags {
+		seqs := oc.seqs[tag]
+		if len(seqs) != sets {
+			t.Errorf("tag %s: recieved %d records expected %d", tag, len(seqs), sets)
+			continue
+		}
+		for i, seq := range seqs {
+			if seq != fmt.Sprint(i) {
+				t.Errorf("tag %s: recieved seq %s at %d. order is not preserved", tag, seq, i)
+				break
+			}
+		}
+		if len(oc.conns[tag]) != 1 {
+			t.Errorf("tag %s: sent by %d connections expected 1", tag, len(oc.conns[tag]))
+		}
+		for conn := range oc.conns[tag] {
+			used[conn] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("records were sent by %d connections, expected parallel connections", len(used))
+	}
+}
+
+// runWorkers sends record sets of tags, which have sequence numbers as "seq".
+func runWorkers(t *testing.T, config *hydra.Config, tags []string, sets int) *hydra.Context {
+	config.Restrict()
+	if errs := config.Validate(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	c, err := hydra.Run(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 0; seq < sets; seq++ {
+		for _, tag := range tags {
+			c.MessageCh <- &fluent.FluentRecordSet{
+				Tag: tag,
+				Records: []fluent.FluentRecordType{
+					&fluent.TinyFluentRecord{
+						Timestamp: time.Now(),
+						Data:      map[string]interface{}{"seq": int64(seq)},
+					},
+				},
+			}
+		}
+	}
+	return c
+}
+
+func TestForwardWorkersSpread(t *testing.T) {
+	oc := &orderCollector{
+		seqs:  make(map[string][]string),
+		conns: make(map[string]map[string]bool),
+	}
+	addr, closer := oc.run(t)
+	defer closer()
+
+	config := &hydra.Config{
+		Servers:       []*hydra.ConfigServer{newConfigServer(addr)},
+		ServerWorkers: 4,
+	}
+	sets := 40
+	c := runWorkers(t, config, []string{"app.access"}, sets)
+	oc.wait(sets)
+	c.Shutdown()
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, seq := range oc.seqs["app.access"] {
+		seen[seq] = true
+	}
+	if len(seen) != sets {
+		t.Errorf("recieved %d records expected %d", len(seen), sets)
+	}
+	// records of a tag are sent by all workers in parallel
+	if n := len(oc.conns["app.access"]); n != 4 {
+		t.Errorf("records of a tag were sent by %d connections, expected 4", n)
+	}
+}
+
+func TestForwardWorkersBufferMoved(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "hydra-buffer")
+	defer os.RemoveAll(dir)
+
+	counter := int64(0)
+	addr, closer := runMockServer(t, "", &counter)
+	defer close(closer)
+
+	config := &hydra.Config{
+		Servers:       []*hydra.ConfigServer{newConfigServer(addr)},
+		ServerWorkers: 2,
+		Buffer:        &hydra.ConfigBuffer{Path: dir},
+	}
+	config.Restrict()
+
+	// record sets left in the buffer of the worker which was removed by decreasing workers
+	removed := config.Buffer.WorkerPath(hydra.DefaultServerGroup, 3)
+	b, err := hydra.NewDiskBuffer(removed, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Push(prepareRecordSet()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := hydra.Run(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleep(2)
+	expected := int64(3 * len(TestMessageLines))
+	if n := atomic.LoadInt64(&counter); n != expected {
+		t.Errorf("recieved %d expected %d", n, expected)
+	}
+	if _, err := os.Stat(removed); !os.IsNotExist(err) {
+		t.Errorf("buffer of the removed worker must be removed. %v", err)
+	}
+	c.Shutdown()
+}
+
+func TestDispatcherSplit(t *testing.T) {
+	d := hydra.NewDispatcher("test", make(chan *fluent.FluentRecordSet), 3)
+	var sets []*fluent.FluentRecordSet
+	for i := 0; i < 30; i++ {
+		sets = append(sets, &fluent.FluentRecordSet{Tag: fmt.Sprintf("tag%d", i%10)})
+	}
+	for i, worker := range d.Split(sets) {
+		if len(worker) != 10 {
+			t.Errorf("%d record sets are split into %d, expected 10 (in turn)", len(worker), i)
+		}
+	}
+
+	d.OrderByTag = true
+	split := d.Split(sets)
+	if len(split) != 3 {
+		t.Fatalf("split into %d expected 3", len(split))
+	}
+	n := 0
+	for i, worker := range split {
+		for _, rs := range worker {
+			if w := d.Worker(rs.Tag); w != i {
+				t.Errorf("tag %s is split into %d, expected %d", rs.Tag, i, w)
+			}
+			n++
+		}
+	}
+	if n != len(sets) {
+		t.Errorf("split %d record sets expected %d", n, len(sets))
+	}
+}
+
+func TestMonitorConnections(t *testing.T) {
+	config := &hydra.Config{
+		Monitor: &hydra.ConfigMonitor{
+			Host: "localhost",
+			Port: 0,
+		},
+	}
+	c := hydra.NewContext()
+	monitor, _ := hydra.NewMonitor(config)
+	c.RunProcess(monitor)
+
+	for worker, alive := range []bool{false, true} {
+		c.MonitorCh <- &hydra.ServerStat{
+			Address: "127.0.0.1:24224",
+			Alive:   alive,
+			Worker:  worker,
+			Connections: []*hydra.ConnectionStat{
+				{Alive: alive, Messages: int64(100 * (worker + 1)), MessagesPerSec: 10},
+			},
+		}
+	}
+	sleep(1)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/", monitor.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	var alive bool
+	scan.ScanJSON(bytes.NewReader(body), "/servers[0]/alive", &alive)
+	if !alive {
+		t.Errorf("server must be alive while any connection is alive. %s", body)
+	}
+	for worker, expected := range []int64{100, 200} {
+		var got int64
+		scan.ScanJSON(bytes.NewReader(body), fmt.Sprintf("/servers[0]/connections[%d]/messages", worker), &got)
+		if got != expected {
+			t.Errorf("connections[%d] messages got %d expected %d", worker, got, expected)
+		}
+	}
+}